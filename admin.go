@@ -0,0 +1,164 @@
+package main
+
+import (
+	"fmt"
+	"github.com/liuxp0827/Tcppass/common/json"
+	. "github.com/liuxp0827/Tcppass/dump"
+	"net/http"
+	"strconv"
+)
+
+// The admin handlers are served with pprof by httpPprof.
+func init() {
+	http.HandleFunc("/recorder/snapshot", recorderSnapshot)
+	http.HandleFunc("/ifaces", ifacesList)
+	http.HandleFunc("/ifaces/start", ifacesStart)
+	http.HandleFunc("/ifaces/stop", ifacesStop)
+	http.HandleFunc("/ifaces/filter", ifacesFilter)
+	http.HandleFunc("/metrics", serveMetrics)
+	http.HandleFunc("/streams", streamsList)
+	http.HandleFunc("/streams/detail", streamsDetail)
+	http.HandleFunc("/streams/summary", streamsSummary)
+	http.HandleFunc("/events", serveEvents)
+}
+
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	w.Write(data)
+	w.Write([]byte("\n"))
+}
+
+func writeError(w http.ResponseWriter, code int, err error) {
+	writeJSON(w, code, map[string]string{"error": err.Error()})
+}
+
+func allowPost(w http.ResponseWriter, r *http.Request) bool {
+	if r.Method != "POST" {
+		w.Header().Set("Allow", "POST")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return false
+	}
+	return true
+}
+
+// recorderSnapshot writes a flight recorder snapshot of the interface given
+// by the iface parameter, or of every interface.
+func recorderSnapshot(w http.ResponseWriter, r *http.Request) {
+	if !allowPost(w, r) {
+		return
+	}
+
+	files, err := SnapshotAll(r.FormValue("iface"), "api")
+	if err != nil && len(files) == 0 {
+		writeError(w, http.StatusNotFound, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string][]string{"files": files})
+}
+
+// ifacesList reports the state of every captured interface.
+func ifacesList(w http.ResponseWriter, r *http.Request) {
+	if captures == nil {
+		writeError(w, http.StatusServiceUnavailable, fmt.Errorf("no live capture"))
+		return
+	}
+	writeJSON(w, http.StatusOK, captures.Status())
+}
+
+// ifacesStart starts the capture on interface name. The settings of the
+// interface in pass.json are used unless given as parameters.
+func ifacesStart(w http.ResponseWriter, r *http.Request) {
+	if !allowPost(w, r) {
+		return
+	}
+
+	if captures == nil {
+		writeError(w, http.StatusServiceUnavailable, fmt.Errorf("no live capture"))
+		return
+	}
+	name := r.FormValue("name")
+	if name == "" {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("missing interface name"))
+		return
+	}
+
+	iface := captures.Configured(name)
+
+	if _, ok := r.Form["filter"]; ok {
+		iface.BPFFilter = r.FormValue("filter")
+	}
+	var err error
+	if v := r.FormValue("snaplen"); v != "" {
+		if iface.Snaplen, err = strconv.Atoi(v); err != nil {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("bad snaplen %q", v))
+			return
+		}
+	}
+	if v := r.FormValue("bufferSize"); v != "" {
+		if iface.BufferSize, err = strconv.Atoi(v); err != nil {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("bad bufferSize %q", v))
+			return
+		}
+	}
+	if v := r.FormValue("promisc"); v != "" {
+		if iface.Promisc, err = strconv.ParseBool(v); err != nil {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("bad promisc %q", v))
+			return
+		}
+	}
+
+	if err = captures.Start(&iface); err != nil {
+		writeError(w, http.StatusConflict, err)
+		return
+	}
+	writeIfaceStatus(w, name)
+}
+
+// ifacesStop stops the capture on interface name.
+func ifacesStop(w http.ResponseWriter, r *http.Request) {
+	if !allowPost(w, r) {
+		return
+	}
+
+	name := r.FormValue("name")
+	if captures == nil {
+		writeError(w, http.StatusServiceUnavailable, fmt.Errorf("no live capture"))
+		return
+	}
+
+	if err := captures.Stop(name); err != nil {
+		writeError(w, http.StatusNotFound, err)
+		return
+	}
+	writeIfaceStatus(w, name)
+}
+
+// ifacesFilter replaces the BPF filter of interface name on its live handle.
+func ifacesFilter(w http.ResponseWriter, r *http.Request) {
+	if !allowPost(w, r) {
+		return
+	}
+
+	name := r.FormValue("name")
+	if captures == nil {
+		writeError(w, http.StatusServiceUnavailable, fmt.Errorf("no live capture"))
+		return
+	}
+
+	if err := captures.SetFilter(name, r.FormValue("filter")); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	writeIfaceStatus(w, name)
+}
+
+func writeIfaceStatus(w http.ResponseWriter, name string) {
+	st, _ := captures.Lookup(name)
+	writeJSON(w, http.StatusOK, st)
+}
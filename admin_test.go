@@ -0,0 +1,51 @@
+package main
+
+import (
+	. "github.com/liuxp0827/Tcppass/common/config"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestIfacesStart(t *testing.T) {
+	defer func(c *captureManager) { captures = c }(captures)
+
+	post := func(form string) int {
+		r := httptest.NewRequest("POST", "/ifaces/start", strings.NewReader(form))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		w := httptest.NewRecorder()
+		ifacesStart(w, r)
+		return w.Code
+	}
+
+	captures = nil
+	if code := post("name=eth0"); code != http.StatusServiceUnavailable {
+		t.Errorf("no live capture: %d", code)
+	}
+
+	captures = newCaptureManager(nil, nil)
+	for form, want := range map[string]int{
+		"":                          http.StatusBadRequest,
+		"name=eth0&snaplen=big":     http.StatusBadRequest,
+		"name=eth0&bufferSize=-x":   http.StatusBadRequest,
+		"name=eth0&promisc=perhaps": http.StatusBadRequest,
+	} {
+		if code := post(form); code != want {
+			t.Errorf("%q: %d, want %d", form, code, want)
+		}
+	}
+}
+
+func TestCapturesConfigured(t *testing.T) {
+	m := newCaptureManager(nil, []*NetworkIface{{Name: "eth0", Snaplen: 512}})
+	if iface := m.Configured("eth0"); iface.Snaplen != 512 {
+		t.Errorf("eth0 %+v", iface)
+	}
+
+	// 重新加载的列表替换原来的配置
+	m.Reload(nil)
+	if iface := m.Configured("eth0"); iface.Snaplen != 0 || iface.Name != "eth0" {
+		t.Errorf("eth0 after reload %+v", iface)
+	}
+}
@@ -0,0 +1,332 @@
+package main
+
+import (
+	"fmt"
+	"github.com/google/gopacket/pcap"
+	. "github.com/liuxp0827/Tcppass/common/config"
+	"github.com/liuxp0827/Tcppass/common/log"
+	. "github.com/liuxp0827/Tcppass/dump"
+	"github.com/liuxp0827/Tcppass/tcpassembly"
+	"runtime"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	captureStarting = "starting"
+	captureRunning  = "running"
+	captureStopped  = "stopped"
+	captureFailed   = "failed"
+)
+
+var captures *captureManager
+
+// captureWorker runs the live capture of one interface until it is stopped.
+type captureWorker struct {
+	mu     sync.Mutex
+	iface  NetworkIface
+	handle *pcap.Handle
+	state  string
+	err    error
+	since  time.Time
+
+	done   chan struct{}
+	exited chan struct{}
+}
+
+// captureStatus is the per-interface state reported by the admin API.
+type captureStatus struct {
+	Name             string    `json:"name"`
+	State            string    `json:"state"`
+	Filter           string    `json:"filter"`
+	Snaplen          int       `json:"snaplen"`
+	BufferSize       int       `json:"bufferSize"`
+	Promisc          bool      `json:"promisc"`
+	Since            time.Time `json:"since"`
+	Error            string    `json:"error,omitempty"`
+	PacketsReceived  int       `json:"packetsReceived"`
+	PacketsDropped   int       `json:"packetsDropped"`
+	PacketsIfDropped int       `json:"packetsIfDropped"`
+}
+
+type captureManager struct {
+	mu      sync.Mutex
+	pool    *tcpassembly.StreamPool
+	ifaces  []*NetworkIface // 配置文件中的接口，SIGHUP时更新
+	workers map[string]*captureWorker
+}
+
+func newCaptureManager(pool *tcpassembly.StreamPool, ifaces []*NetworkIface) *captureManager {
+	return &captureManager{
+		pool:    pool,
+		ifaces:  ifaces,
+		workers: make(map[string]*captureWorker),
+	}
+}
+
+// Start opens iface and starts capturing on it. It fails if the interface is
+// already captured or its handle can not be opened.
+func (m *captureManager) Start(iface *NetworkIface) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if w, ok := m.workers[iface.Name]; ok && w.running() {
+		return fmt.Errorf("interface %s is already %s", iface.Name, w.status().State)
+	}
+
+	if iface.Snaplen <= 0 {
+		iface.Snaplen = 2048
+	}
+	if iface.BufferSize <= 0 {
+		iface.BufferSize = 5120
+	}
+
+	w := &captureWorker{
+		iface:  *iface,
+		state:  captureStarting,
+		since:  time.Now(),
+		done:   make(chan struct{}),
+		exited: make(chan struct{}),
+	}
+
+	started := make(chan error, 1)
+	go w.run(m.pool, started)
+	if err := <-started; err != nil {
+		return err
+	}
+
+	m.workers[iface.Name] = w
+	return nil
+}
+
+// Stop stops the capture on interface name and waits for its worker to exit.
+func (m *captureManager) Stop(name string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	w, ok := m.workers[name]
+	if !ok || !w.running() {
+		return fmt.Errorf("interface %s is not captured", name)
+	}
+	w.stop()
+	return nil
+}
+
+// SetFilter validates filter and installs it on the live handle of
+// interface name, the streams of the interface are kept.
+func (m *captureManager) SetFilter(name, filter string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	w, ok := m.workers[name]
+	if !ok || !w.running() {
+		return fmt.Errorf("interface %s is not captured", name)
+	}
+	return w.setFilter(filter)
+}
+
+// Status returns the state of every interface known to the manager.
+func (m *captureManager) Status() []captureStatus {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	status := make([]captureStatus, 0, len(m.workers))
+	for _, w := range m.workers {
+		status = append(status, w.status())
+	}
+	sort.Slice(status, func(i, j int) bool { return status[i].Name < status[j].Name })
+	return status
+}
+
+// Lookup returns the state of interface name.
+func (m *captureManager) Lookup(name string) (captureStatus, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if w, ok := m.workers[name]; ok {
+		return w.status(), true
+	}
+	return captureStatus{}, false
+}
+
+// Configured returns the settings of interface name in the configuration
+// file, or only its name if it is not listed.
+func (m *captureManager) Configured(name string) NetworkIface {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, iface := range m.ifaces {
+		if iface.Name == name {
+			return *iface
+		}
+	}
+	return NetworkIface{Name: name}
+}
+
+// Reload applies a new interface list: interfaces that disappeared are
+// stopped, new ones are started, a changed filter is replaced on the live
+// handle and any other change restarts the capture. The list replaces the
+// configured one.
+func (m *captureManager) Reload(ifaces []*NetworkIface) {
+	m.mu.Lock()
+	m.ifaces = ifaces
+	m.mu.Unlock()
+
+	wanted := make(map[string]*NetworkIface, len(ifaces))
+	for _, iface := range ifaces {
+		wanted[iface.Name] = iface
+	}
+
+	for _, st := range m.Status() {
+		if _, ok := wanted[st.Name]; !ok && st.State == captureRunning {
+			log.Infof("reload: stop capture on interface %s", st.Name)
+			if err := m.Stop(st.Name); err != nil {
+				log.Errorf("reload: %v", err)
+			}
+		}
+	}
+
+	for _, iface := range ifaces {
+		st, ok := m.Lookup(iface.Name)
+		switch {
+		case !ok || st.State != captureRunning:
+			log.Infof("reload: start capture on interface %s", iface.Name)
+		case st.Snaplen != iface.Snaplen || st.BufferSize != iface.BufferSize || st.Promisc != iface.Promisc:
+			log.Infof("reload: restart capture on interface %s", iface.Name)
+			if err := m.Stop(iface.Name); err != nil {
+				log.Errorf("reload: %v", err)
+			}
+		case st.Filter != iface.BPFFilter:
+			log.Infof("reload: replace filter of interface %s with %q", iface.Name, iface.BPFFilter)
+			if err := m.SetFilter(iface.Name, iface.BPFFilter); err != nil {
+				log.Errorf("reload: %v", err)
+			}
+			continue
+		default:
+			continue
+		}
+
+		if err := m.Start(iface); err != nil {
+			log.Errorf("reload: %v", err)
+		}
+	}
+}
+
+func (w *captureWorker) run(pool *tcpassembly.StreamPool, started chan<- error) {
+	runtime.LockOSThread()
+	defer close(w.exited)
+
+	log.Infof("starting capture on interface %s", w.iface.Name)
+	handle, err := openCapture(&w.iface)
+	if err != nil {
+		w.setState(captureFailed, err)
+		started <- fmt.Errorf("interface %s: %v", w.iface.Name, err)
+		return
+	}
+	defer handle.Close()
+
+	// Set up tcpassembly
+	assembler := tcpassembly.NewAssembler(w.iface.Name, pool)
+	assembler.LinkType = handle.LinkType()
+	defer assembler.Close()
+
+	if TConfig.Recorder.Enabled() {
+		recorder, err := NewRecorder(w.iface.Name, handle.LinkType(), TConfig.Recorder)
+		if err != nil {
+			log.Errorf("could not create recorder on interface %s: %v", w.iface.Name, err)
+		} else {
+			defer RemoveRecorder(recorder)
+		}
+	}
+
+	w.mu.Lock()
+	w.handle = handle
+	w.state = captureRunning
+	w.since = time.Now()
+	w.mu.Unlock()
+	started <- nil
+
+	log.Info("reading in packets")
+	handle1(handle, assembler, w.done)
+
+	select {
+	case <-w.done:
+		w.setState(captureStopped, nil)
+	default:
+		w.setState(captureFailed, fmt.Errorf("capture ended unexpectedly"))
+	}
+	log.Infof("capture on interface %s is %s", w.iface.Name, w.status().State)
+}
+
+func (w *captureWorker) running() bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.state == captureStarting || w.state == captureRunning
+}
+
+func (w *captureWorker) stop() {
+	close(w.done)
+	<-w.exited
+}
+
+func (w *captureWorker) setState(state string, err error) {
+	w.mu.Lock()
+	w.state = state
+	w.err = err
+	w.since = time.Now()
+	w.handle = nil
+	w.mu.Unlock()
+}
+
+func (w *captureWorker) setFilter(filter string) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.handle == nil {
+		return fmt.Errorf("interface %s has no live handle", w.iface.Name)
+	}
+
+	if filter != "" {
+		if _, err := w.handle.CompileBPFFilter(filter); err != nil {
+			return fmt.Errorf("invalid BPF filter %q: %v", filter, err)
+		}
+	}
+
+	// An empty expression compiles to a program that accepts every packet.
+	if err := w.handle.SetBPFFilter(filter); err != nil {
+		return fmt.Errorf("BPF %s filter error: %v", filter, err)
+	}
+
+	log.Infof("BPF filter of interface %s set to %q", w.iface.Name, filter)
+	w.iface.BPFFilter = filter
+	return nil
+}
+
+func (w *captureWorker) status() captureStatus {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	st := captureStatus{
+		Name:       w.iface.Name,
+		State:      w.state,
+		Filter:     w.iface.BPFFilter,
+		Snaplen:    w.iface.Snaplen,
+		BufferSize: w.iface.BufferSize,
+		Promisc:    w.iface.Promisc,
+		Since:      w.since,
+	}
+
+	if w.err != nil {
+		st.Error = w.err.Error()
+	}
+
+	if w.handle != nil {
+		if stats, err := w.handle.Stats(); err == nil {
+			st.PacketsReceived = stats.PacketsReceived
+			st.PacketsDropped = stats.PacketsDropped
+			st.PacketsIfDropped = stats.PacketsIfDropped
+		}
+	}
+	return st
+}
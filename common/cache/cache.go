@@ -1,11 +1,11 @@
 package cache
 
 import (
-	"container/list"
 	"fmt"
 	"github.com/google/gopacket"
 	"github.com/liuxp0827/Tcppass/common/log"
 	"github.com/liuxp0827/Tcppass/tcp"
+	"sort"
 	"sync"
 	"time"
 )
@@ -25,14 +25,22 @@ func SetCacheLog(cacheLogFile string) {
 	}
 }
 
+// maxPending bounds the segments waiting for an ACK in one direction, the
+// oldest are dropped first.
+const maxPending = 1 << 14
+
+// RTTCache matches the ACKs of one direction with the segments sent in the
+// other. Segments are kept per direction in the order of the sequence number
+// ending them, so an ACK only has to pop the segments it covers.
 type RTTCache struct {
 	closed bool
 	sync.Mutex
-	Duration   time.Duration
-	cache      map[interface{}]*list.Element
-	linkedList *list.List
+	Duration time.Duration
+	flows    map[[2]gopacket.Flow]*seqQueue
 }
 
+// RTTCacheKey identifies a segment by its direction and the sequence number
+// following it, i.e. the ACK expected for it.
 type RTTCacheKey struct {
 	Net       gopacket.Flow
 	Transport gopacket.Flow
@@ -43,30 +51,59 @@ func (k RTTCacheKey) String() string {
 	return fmt.Sprintf("%s:%s->%s:%s [%d]", k.Net.Src(), k.Transport.Src(), k.Net.Dst(), k.Transport.Dst(), k.Seq)
 }
 
-func (k RTTCacheKey) sameKey(rckey RTTCacheKey) bool {
-	return k.Net.String() == rckey.Net.String() && k.Transport.String() == rckey.Transport.String()
+func (k RTTCacheKey) flow() [2]gopacket.Flow {
+	return [2]gopacket.Flow{k.Net, k.Transport}
 }
 
 type RTTCacheValue struct {
-	key  RTTCacheKey
-	Seen time.Time
+	key           RTTCacheKey
+	start         tcp.Sequence // end of the previous segment, key.Seq if unknown
+	Seen          time.Time
+	retransmitted bool
 }
 
 func (rcache *RTTCacheValue) String() string {
 	return fmt.Sprintf("%s", rcache.key)
 }
 
+// contains reports whether a retransmission ending at seq, at or before the
+// end of the segment, ends within it.
+func (rcache *RTTCacheValue) contains(seq tcp.Sequence) bool {
+	// 第一个段的起点未知，只认完全相同的重传
+	return seq == rcache.key.Seq || rcache.start.Difference(seq) > 0
+}
+
+// seqQueue is the list of segments of one direction waiting for their ACK,
+// ordered by RTTCacheKey.Seq with wrap-around.
+type seqQueue struct {
+	pending []*RTTCacheValue
+	highest tcp.Sequence
+}
+
+// search returns the index of the first pending segment ending at or after
+// seq.
+func (q *seqQueue) search(seq tcp.Sequence) int {
+	return sort.Search(len(q.pending), func(i int) bool {
+		return seq.Difference(q.pending[i].key.Seq) >= 0
+	})
+}
+
+func (q *seqQueue) removeAt(i int) {
+	copy(q.pending[i:], q.pending[i+1:])
+	q.pending[len(q.pending)-1] = nil
+	q.pending = q.pending[:len(q.pending)-1]
+}
+
 func NewRTTCache(Duration time.Duration) *RTTCache {
 
 	return &RTTCache{
-		Duration:   Duration,
-		linkedList: list.New(),
-		cache:      make(map[interface{}]*list.Element),
+		Duration: Duration,
+		flows:    make(map[[2]gopacket.Flow]*seqQueue, 2),
 	}
 }
 
 func (c *RTTCache) Length() int {
-	return c.linkedList.Len()
+	return c.Len()
 }
 
 func (c *RTTCache) output(in bool, format string, v ...interface{}) {
@@ -79,7 +116,12 @@ func (c *RTTCache) output(in bool, format string, v ...interface{}) {
 	}
 }
 
-func (c *RTTCache) Push(key RTTCacheKey, ts time.Time) (exist bool, err error) {
+// Push records a segment sent at ts. A segment that does not advance the
+// highest sequence number of its direction is a retransmission: it is not
+// recorded and, following Karn's rule, the pending segment it ends in will
+// not give an RTT sample. The retransmission of data already acknowledged
+// leaves the pending segments alone.
+func (c *RTTCache) Push(key RTTCacheKey, ts time.Time) (retransmit bool, err error) {
 	c.Lock()
 	defer c.Unlock()
 	if c.closed {
@@ -87,19 +129,33 @@ func (c *RTTCache) Push(key RTTCacheKey, ts time.Time) (exist bool, err error) {
 	}
 
 	//c.output(true, "Push key: %v", key)
-	var e *list.Element
-	if e, ok := c.cache[key]; ok {
-		c.linkedList.MoveToFront(e)
-		e.Value.(*RTTCacheValue).Seen = ts
-		exist = true
-		return
+	start := key.Seq
+	q, ok := c.flows[key.flow()]
+	if !ok {
+		q = &seqQueue{}
+		c.flows[key.flow()] = q
+	} else if q.highest.Difference(key.Seq) <= 0 {
+		if i := q.search(key.Seq); i < len(q.pending) && q.pending[i].contains(key.Seq) {
+			q.pending[i].retransmitted = true
+		}
+		return true, nil
+	} else {
+		start = q.highest
 	}
-	e = c.linkedList.PushBack(&RTTCacheValue{key, ts})
-	c.cache[key] = e
-	return
+
+	if len(q.pending) >= maxPending {
+		// 单向流量看不到ACK，队列一直是满的，丢弃队首不能拷贝整个队列
+		q.pending[0] = nil
+		q.pending = q.pending[1:]
+	}
+	q.pending = append(q.pending, &RTTCacheValue{key: key, start: start, Seen: ts})
+	q.highest = key.Seq
+	return false, nil
 }
 
-// looks up a key's value from the cache, move item to the front of LRU queue
+// Pull removes the segments acknowledged by key.Seq from the direction of
+// key. It returns the last of them if the ACK ends exactly on it and none of
+// the acknowledged segments was retransmitted.
 func (c *RTTCache) Pull(key RTTCacheKey) (*RTTCacheValue, bool, error) {
 	c.Lock()
 	defer c.Unlock()
@@ -108,60 +164,46 @@ func (c *RTTCache) Pull(key RTTCacheKey) (*RTTCacheValue, bool, error) {
 	}
 
 	//c.output(false, "Pull key: %v", key)
-	var e *list.Element
-	var value *RTTCacheValue
-	var ok bool
-
-	if e, ok = c.cache[key]; ok {
-		value = e.Value.(*RTTCacheValue)
-		for e != nil {
-			tmp := e.Prev()
-			c.removeElement(e)
-			e = tmp
-		}
-		//c.output(false, "%s Pull value: %v", c.Name, value)
-		return value, true, nil
+	q, ok := c.flows[key.flow()]
+	if !ok {
+		return nil, false, nil
 	}
 
-	for e = c.linkedList.Front(); e != nil; {
-		if tmpV := e.Value.(*RTTCacheValue); tmpV != nil && tmpV.key.sameKey(key) {
-			if tmpV.key.Seq <= key.Seq+1 {
-				tmpE := e.Next()
-				c.removeElement(e)
-				e = tmpE
-				value = tmpV
-			} else {
-				break
-			}
-		} else {
-			e = e.Next()
-		}
+	var value *RTTCacheValue
+	retransmitted := false
+	n := 0
+	for ; n < len(q.pending) && q.pending[n].key.Seq.Difference(key.Seq) >= 0; n++ {
+		value = q.pending[n]
+		retransmitted = retransmitted || value.retransmitted
+		q.pending[n] = nil
 	}
+	q.pending = q.pending[n:]
 
-	if value == nil || (value.key.Seq != key.Seq+1 && value.key.Seq != key.Seq-1) {
+	if value == nil || retransmitted || value.key.Seq != key.Seq {
 		return nil, false, nil
 	}
 
 	//c.output(false, "%s Pull value: %v", c.Name, value)
 	return value, true, nil
-
 }
 
-func (c *RTTCache) Purge() (err error) {
+// Purge drops the segments seen more than Duration before now, the time of
+// the packets.
+func (c *RTTCache) Purge(now time.Time) (err error) {
 	c.Lock()
 	defer c.Unlock()
 
-	for e := c.linkedList.Front(); e != nil; {
-		key := e.Value.(*RTTCacheValue).key
-		timestamp := e.Value.(*RTTCacheValue).Seen
-		if c.Duration != 0 && time.Now().Sub(timestamp) > c.Duration {
-			if ele, hit := c.cache[key]; hit {
-				e = c.removeElement(ele)
-			}
-			continue
-		}
+	if c.Duration == 0 {
 		return
 	}
+
+	for _, q := range c.flows {
+		n := 0
+		for ; n < len(q.pending) && now.Sub(q.pending[n].Seen) > c.Duration; n++ {
+			q.pending[n] = nil
+		}
+		q.pending = q.pending[n:]
+	}
 	return
 }
 
@@ -169,8 +211,10 @@ func (c *RTTCache) Purge() (err error) {
 func (c *RTTCache) Remove(key RTTCacheKey) (err error) {
 	c.Lock()
 	defer c.Unlock()
-	if e, hit := c.cache[key]; hit {
-		c.removeElement(e)
+	if q, ok := c.flows[key.flow()]; ok {
+		if i := q.search(key.Seq); i < len(q.pending) && q.pending[i].key.Seq == key.Seq {
+			q.removeAt(i)
+		}
 	}
 	return
 }
@@ -178,8 +222,8 @@ func (c *RTTCache) Remove(key RTTCacheKey) (err error) {
 func (c *RTTCache) RemoveAll() error {
 	c.Lock()
 	defer c.Unlock()
-	for e := c.linkedList.Front(); e != nil; {
-		e = c.removeElement(e)
+	for k := range c.flows {
+		delete(c.flows, k)
 	}
 	c.closed = true
 	return nil
@@ -191,37 +235,13 @@ func (c *RTTCache) Reset() {
 	c.closed = false
 }
 
-func (c *RTTCache) RemoveOldest() (err error) {
-	c.Lock()
-	defer c.Unlock()
-
-	c.removeOldest()
-	return
-}
-func (c *RTTCache) removeOldest() {
-	if c.cache == nil {
-		return
-	}
-	e := c.linkedList.Back()
-	if e != nil {
-		c.removeElement(e)
-	}
-}
-
-func (c *RTTCache) removeElement(e *list.Element) *list.Element {
-	eNext := e.Next()
-	c.linkedList.Remove(e)
-	kv := e.Value.(*RTTCacheValue)
-	delete(c.cache, kv.key)
-	return eNext
-}
-
 // Len returns the number of items in the cache.
 func (c *RTTCache) Len() int {
 	c.Lock()
 	defer c.Unlock()
-	if c.cache == nil {
-		return 0
+	n := 0
+	for _, q := range c.flows {
+		n += len(q.pending)
 	}
-	return c.linkedList.Len()
+	return n
 }
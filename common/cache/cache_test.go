@@ -2,25 +2,145 @@ package cache
 
 import (
 	"github.com/google/gopacket"
-	"github.com/liuxp0827/Tcppass/common/log"
+	"github.com/google/gopacket/layers"
 	"github.com/liuxp0827/Tcppass/tcp"
+	"net"
 	"testing"
 	"time"
 )
 
+var (
+	testNetFlow   = gopacket.NewFlow(layers.EndpointIPv4, net.IP{10, 0, 0, 1}, net.IP{10, 0, 0, 2})
+	testTransport = gopacket.NewFlow(layers.EndpointTCPPort, []byte{0x30, 0x39}, []byte{0, 80})
+)
+
+func testKey(seq int64) RTTCacheKey {
+	return RTTCacheKey{testNetFlow, testTransport, tcp.Sequence(seq)}
+}
+
 func TestRTTCache(t *testing.T) {
 	cache := NewRTTCache(300000 * time.Millisecond)
+	now := time.Now()
+
+	cache.Push(testKey(3), now)
+
+	if _, ok, err := cache.Pull(testKey(2)); err != nil || ok {
+		t.Fatalf("Pull(2) = %v, %v, want no sample", ok, err)
+	}
+
+	value, ok, err := cache.Pull(testKey(3))
+	if err != nil || !ok || !value.Seen.Equal(now) {
+		t.Fatalf("Pull(3) = %v, %v, %v, want the segment pushed at %v", value, ok, err, now)
+	}
+
+	if cache.Len() != 0 {
+		t.Errorf("Len() = %d after the segment is acked, want 0", cache.Len())
+	}
+}
+
+func TestRTTCacheCumulativeAck(t *testing.T) {
+	cache := NewRTTCache(0)
+	now := time.Now()
+
+	for i := int64(1); i <= 4; i++ {
+		cache.Push(testKey(i*100), now.Add(time.Duration(i)*time.Millisecond))
+	}
+
+	value, ok, _ := cache.Pull(testKey(300))
+	if !ok || !value.Seen.Equal(now.Add(3*time.Millisecond)) {
+		t.Fatalf("Pull(300) = %v, %v, want the segment ending at 300", value, ok)
+	}
+
+	if _, ok, _ = cache.Pull(testKey(350)); ok {
+		t.Errorf("Pull(350) gave a sample for a partial ack")
+	}
+
+	if cache.Len() != 1 {
+		t.Errorf("Len() = %d, want 1", cache.Len())
+	}
+}
+
+func TestRTTCacheWrap(t *testing.T) {
+	cache := NewRTTCache(0)
+	now := time.Now()
+
+	cache.Push(testKey(0xFFFFFF00), now)
+	cache.Push(testKey(0x00000100), now.Add(time.Millisecond))
+
+	if _, ok, _ := cache.Pull(testKey(0xFFFFFF00)); !ok {
+		t.Fatalf("Pull before the wrap gave no sample")
+	}
+
+	value, ok, _ := cache.Pull(testKey(0x00000100))
+	if !ok || !value.Seen.Equal(now.Add(time.Millisecond)) {
+		t.Fatalf("Pull after the wrap = %v, %v", value, ok)
+	}
+}
 
-	net := gopacket.InvalidFlow
-	transport := gopacket.InvalidFlow
-	cache.Push(RTTCacheKey{net, transport, tcp.Sequence(3)}, time.Now())
+func TestRTTCacheKarn(t *testing.T) {
+	cache := NewRTTCache(0)
+	now := time.Now()
+
+	cache.Push(testKey(100), now)
+	cache.Push(testKey(200), now)
+
+	if retransmit, _ := cache.Push(testKey(200), now.Add(time.Second)); !retransmit {
+		t.Fatalf("Push of a retransmitted segment was not detected")
+	}
 
-	value, ok, err := cache.Pull(RTTCacheKey{net, transport, tcp.Sequence(2)})
-	if err != nil {
-		t.Error(err)
+	if _, ok, _ := cache.Pull(testKey(100)); !ok {
+		t.Errorf("Pull(100) gave no sample for a segment sent once")
 	}
-	if !ok {
-		log.Info("can not find", RTTCacheKey{net, transport, tcp.Sequence(2)})
+
+	if _, ok, _ := cache.Pull(testKey(200)); ok {
+		t.Errorf("Pull(200) gave a sample for a retransmitted segment")
+	}
+}
+
+func TestRTTCacheKarnAcked(t *testing.T) {
+	cache := NewRTTCache(0)
+	now := time.Now()
+
+	cache.Push(testKey(100), now)
+	cache.Push(testKey(200), now)
+	cache.Push(testKey(300), now)
+	cache.Pull(testKey(100))
+
+	// 已确认数据的重传不影响等待中的段
+	if retransmit, _ := cache.Push(testKey(100), now.Add(time.Second)); !retransmit {
+		t.Fatalf("Push of acked data was not detected as a retransmission")
+	}
+	if _, ok, _ := cache.Pull(testKey(200)); !ok {
+		t.Errorf("Pull(200) gave no sample after a retransmission of acked data")
+	}
+
+	// 结束在段内的重传只标记该段
+	cache.Push(testKey(250), now.Add(time.Second))
+	if _, ok, _ := cache.Pull(testKey(300)); ok {
+		t.Errorf("Pull(300) gave a sample for a segment partly retransmitted")
+	}
+}
+
+func TestRTTCacheBounds(t *testing.T) {
+	cache := NewRTTCache(time.Second)
+	now := time.Now()
+
+	for i := int64(1); i <= maxPending+10; i++ {
+		cache.Push(testKey(i*100), now.Add(time.Duration(i)*time.Microsecond))
+	}
+	if cache.Len() != maxPending {
+		t.Fatalf("Len() = %d, want %d", cache.Len(), maxPending)
+	}
+	if _, ok, _ := cache.Pull(testKey(1000)); ok {
+		t.Errorf("Pull(1000) gave a sample for a dropped segment")
+	}
+	if _, ok, _ := cache.Pull(testKey(1100)); !ok {
+		t.Errorf("Pull(1100) gave no sample for the oldest segment kept")
+	}
+
+	cache.Push(testKey((maxPending+20)*100), now.Add(2*time.Second))
+	cache.Purge(now.Add(1500 * time.Millisecond))
+	if cache.Len() != 1 {
+		t.Errorf("Len() = %d after Purge, want 1", cache.Len())
 	}
-	log.Info("value:", value)
 }
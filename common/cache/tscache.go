@@ -0,0 +1,55 @@
+package cache
+
+import "time"
+
+// TSCache pairs the TSval values sent in one direction with the TSecr
+// echoing them in the other. It keeps the time each TSval was first seen,
+// ordered by TSval with wrap-around. It is not safe for concurrent use.
+type TSCache struct {
+	pending []tsValue
+	highest uint32
+}
+
+type tsValue struct {
+	val  uint32
+	seen time.Time
+}
+
+// tsBefore compares two timestamps modulo 2^32.
+func tsBefore(a, b uint32) bool {
+	return int32(a-b) < 0
+}
+
+// Push records the first time val was seen, later segments with the same or
+// an older TSval are ignored.
+func (c *TSCache) Push(val uint32, seen time.Time) {
+	if len(c.pending) > 0 && !tsBefore(c.highest, val) {
+		return
+	}
+
+	if len(c.pending) >= maxPending {
+		c.pending = c.pending[1:]
+	}
+	c.pending = append(c.pending, tsValue{val, seen})
+	c.highest = val
+}
+
+// Pull removes the values echoed by ecr and returns when ecr itself was first
+// seen. Each TSval gives at most one sample.
+func (c *TSCache) Pull(ecr uint32) (time.Time, bool) {
+	var seen time.Time
+	found := false
+	n := 0
+	for ; n < len(c.pending) && !tsBefore(ecr, c.pending[n].val); n++ {
+		if c.pending[n].val == ecr {
+			seen, found = c.pending[n].seen, true
+		}
+	}
+	c.pending = c.pending[n:]
+	return seen, found
+}
+
+func (c *TSCache) Reset() {
+	c.pending = c.pending[:0]
+	c.highest = 0
+}
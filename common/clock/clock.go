@@ -0,0 +1,207 @@
+// Package clock provides the time source of the periodic jobs, either the
+// wall clock or, when replaying a capture, the time of the packets.
+package clock
+
+import (
+	"container/heap"
+	"sync"
+	"time"
+)
+
+// Clock tells the time and creates tickers.
+type Clock interface {
+	Now() time.Time
+	NewTicker(d time.Duration) *Ticker
+}
+
+// Ticker delivers ticks on C, like time.Ticker it drops ticks for slow
+// receivers.
+type Ticker struct {
+	C    <-chan time.Time
+	stop func()
+}
+
+// Stop turns off the ticker, no more ticks will be sent.
+func (t *Ticker) Stop() {
+	t.stop()
+}
+
+var current Clock = realClock{}
+
+// Set replaces the default clock, it must be called before any ticker is
+// created.
+func Set(c Clock) {
+	current = c
+}
+
+// Now returns the current time of the default clock.
+func Now() time.Time {
+	return current.Now()
+}
+
+// Since returns the time elapsed since t on the default clock.
+func Since(t time.Time) time.Duration {
+	return current.Now().Sub(t)
+}
+
+// NewTicker returns a ticker of the default clock.
+func NewTicker(d time.Duration) *Ticker {
+	return current.NewTicker(d)
+}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+func (realClock) NewTicker(d time.Duration) *Ticker {
+	t := time.NewTicker(d)
+	return &Ticker{C: t.C, stop: t.Stop}
+}
+
+// PacketClock is driven by the timestamps of replayed packets. With a speed
+// above 0 Advance also sleeps to follow the original timing scaled by speed,
+// with 0 it jumps straight from one timestamp to the next.
+type PacketClock struct {
+	mu      sync.Mutex
+	speed   float64
+	now     time.Time
+	first   time.Time
+	start   time.Time
+	tickers tickerHeap      // by next tick
+	pending []*packetTicker // created before the first packet
+}
+
+type packetTicker struct {
+	c     chan time.Time
+	d     time.Duration
+	next  time.Time
+	index int // in the heap, -1 if not in it
+}
+
+// tickerHeap is a min-heap of the tickers by next tick, so that a packet
+// only costs the tickers that came due.
+type tickerHeap []*packetTicker
+
+func (h tickerHeap) Len() int           { return len(h) }
+func (h tickerHeap) Less(i, j int) bool { return h[i].next.Before(h[j].next) }
+
+func (h tickerHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *tickerHeap) Push(x interface{}) {
+	t := x.(*packetTicker)
+	t.index = len(*h)
+	*h = append(*h, t)
+}
+
+func (h *tickerHeap) Pop() interface{} {
+	old := *h
+	t := old[len(old)-1]
+	old[len(old)-1] = nil
+	*h = old[:len(old)-1]
+	t.index = -1
+	return t
+}
+
+func NewPacketClock(speed float64) *PacketClock {
+	return &PacketClock{
+		speed: speed,
+	}
+}
+
+func (c *PacketClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *PacketClock) NewTicker(d time.Duration) *Ticker {
+	if d <= 0 {
+		panic("clock: non-positive interval for NewTicker")
+	}
+
+	t := &packetTicker{
+		c:     make(chan time.Time, 1),
+		d:     d,
+		index: -1,
+	}
+
+	c.mu.Lock()
+	if c.now.IsZero() {
+		c.pending = append(c.pending, t)
+	} else {
+		t.next = c.now.Add(d)
+		heap.Push(&c.tickers, t)
+	}
+	c.mu.Unlock()
+
+	return &Ticker{C: t.c, stop: func() {
+		c.mu.Lock()
+		c.remove(t)
+		c.mu.Unlock()
+	}}
+}
+
+func (c *PacketClock) remove(t *packetTicker) {
+	if t.index >= 0 {
+		heap.Remove(&c.tickers, t.index)
+		return
+	}
+	for i, p := range c.pending {
+		if p == t {
+			c.pending = append(c.pending[:i], c.pending[i+1:]...)
+			return
+		}
+	}
+}
+
+// Advance moves the clock to ts, the time of the next packet, and fires the
+// tickers that came due. Packets older than the clock do not move it back.
+func (c *PacketClock) Advance(ts time.Time) {
+	c.mu.Lock()
+	if c.first.IsZero() {
+		c.first = ts
+		c.start = time.Now()
+	}
+	speed, first, start := c.speed, c.first, c.start
+	c.mu.Unlock()
+
+	if speed > 0 {
+		due := start.Add(time.Duration(float64(ts.Sub(first)) / speed))
+		if wait := due.Sub(time.Now()); wait > 0 {
+			time.Sleep(wait)
+		}
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if !ts.After(c.now) {
+		return
+	}
+	c.now = ts
+
+	for _, t := range c.pending {
+		t.next = ts.Add(t.d)
+		heap.Push(&c.tickers, t)
+	}
+	c.pending = nil
+
+	for len(c.tickers) > 0 && !ts.Before(c.tickers[0].next) {
+		t := c.tickers[0]
+		select {
+		case t.c <- t.next:
+		default:
+		}
+
+		for !ts.Before(t.next) {
+			t.next = t.next.Add(t.d)
+		}
+		heap.Fix(&c.tickers, 0)
+	}
+}
@@ -0,0 +1,57 @@
+package clock
+
+import (
+	"testing"
+	"time"
+)
+
+func TestPacketClockTickers(t *testing.T) {
+	c := NewPacketClock(0)
+	start := time.Unix(1500000000, 0)
+
+	early := c.NewTicker(time.Second) // started by the first packet
+	c.Advance(start)
+	slow := c.NewTicker(10 * time.Second)
+	stopped := c.NewTicker(time.Second)
+	stopped.Stop()
+
+	ticked := func(tk *Ticker) (time.Time, bool) {
+		select {
+		case ts := <-tk.C:
+			return ts, true
+		default:
+			return time.Time{}, false
+		}
+	}
+
+	c.Advance(start.Add(500 * time.Millisecond))
+	if _, ok := ticked(early); ok {
+		t.Fatal("early ticker fired before its interval")
+	}
+
+	c.Advance(start.Add(2500 * time.Millisecond))
+	if ts, ok := ticked(early); !ok || !ts.Equal(start.Add(time.Second)) {
+		t.Fatalf("early ticker %v %v", ts, ok)
+	}
+	if _, ok := ticked(slow); ok {
+		t.Fatal("slow ticker fired")
+	}
+	if _, ok := ticked(stopped); ok {
+		t.Fatal("stopped ticker fired")
+	}
+
+	// the ticks missed meanwhile are dropped, the next one is on the grid
+	c.Advance(start.Add(10 * time.Second))
+	if ts, ok := ticked(early); !ok || !ts.Equal(start.Add(3*time.Second)) {
+		t.Fatalf("early ticker %v %v", ts, ok)
+	}
+	if ts, ok := ticked(slow); !ok || !ts.Equal(start.Add(10*time.Second)) {
+		t.Fatalf("slow ticker %v %v", ts, ok)
+	}
+
+	early.Stop()
+	slow.Stop()
+	if len(c.tickers) != 0 || len(c.pending) != 0 {
+		t.Fatalf("%d tickers left", len(c.tickers)+len(c.pending))
+	}
+}
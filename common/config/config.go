@@ -17,10 +17,19 @@ func init() {
 }
 
 type Config struct {
-	Interfaces []*NetworkIface `json:"ifaces"`
-	Loglevel   int             `json:"loglevel"`
-	CacheLog   string          `json:"cacheLog"`
-	Timeout    int             `json:"timeout"`
+	Interfaces    []*NetworkIface `json:"ifaces"`
+	Loglevel      int             `json:"loglevel"`
+	CacheLog      string          `json:"cacheLog"`
+	Timeout       int             `json:"timeout"`
+	ActiveTimeout int             `json:"activeTimeout"` // seconds between interim records, 0 disables them
+	Export        *ExportConfig   `json:"export"`
+	Recorder      *RecorderConfig `json:"recorder"`
+	Inputs        *InputConfig    `json:"inputs"`
+	Services      *ServiceConfig  `json:"services"`
+	Sinks         []*SinkConfig   `json:"sinks"`
+	Metrics       *MetricsConfig  `json:"metrics"`
+	Events        *EventsConfig   `json:"events"`
+	Syslog        json.RawMessage `json:"syslog"` // config of the syslog log adapter, disabled if empty
 }
 
 type NetworkIface struct {
@@ -31,12 +40,113 @@ type NetworkIface struct {
 	Promisc    bool   `json:"promisc"`
 }
 
+// ExportConfig describes which finished streams are written to per-flow pcap
+// files. A stream is exported when any of the rules matches.
+type ExportConfig struct {
+	Dir        string        `json:"dir"`
+	MaxPackets int           `json:"maxPackets"` // packets buffered per flow
+	MaxBytes   int           `json:"maxBytes"`   // bytes buffered per flow
+	Queue      int           `json:"queue"`      // flows waiting to be written
+	Rules      []*ExportRule `json:"rules"`
+}
+
+// ExportRule matches a finished stream, all the non-empty fields must match.
+type ExportRule struct {
+	CloseReason string `json:"closeReason"` // fin, rst, timeout or reuse
+	RTTAbove    int64  `json:"rttAbove"`    // max rtt strictly above, in µs
+	DPIType     string `json:"dpiType"`     // http, unknown
+	StatusAbove int    `json:"statusAbove"` // last HTTP response status strictly above, e.g. 499 for 5xx
+	Ports       []int  `json:"ports"`       // client or server port
+}
+
+func (e *ExportConfig) Enabled() bool {
+	return e != nil && e.Dir != "" && len(e.Rules) > 0
+}
+
+// RecorderConfig sizes the per-interface flight recorder and sets the
+// thresholds of its internal triggers, a zero threshold disables a trigger.
+type RecorderConfig struct {
+	Dir       string `json:"dir"`
+	Seconds   int    `json:"seconds"`
+	Megabytes int    `json:"megabytes"`
+	RSTBurst  int    `json:"rstBurst"`  // RSTs within one second
+	DropSpike int    `json:"dropSpike"` // packets dropped between two pcap stats
+	Cooldown  int    `json:"cooldown"`  // seconds between two triggered snapshots
+}
+
+func (r *RecorderConfig) Enabled() bool {
+	return r != nil && r.Dir != ""
+}
+
+// InputConfig enables the packet sources other than the local interfaces.
+type InputConfig struct {
+	PcapListen  string `json:"pcapListen"`  // tcp address accepting pcap streams, e.g. tcpdump -w -
+	SFlowListen string `json:"sflowListen"` // udp address of the sFlow v5 collector
+}
+
+func (i *InputConfig) Enabled() bool {
+	return i != nil && (i.PcapListen != "" || i.SFlowListen != "")
+}
+
+// ServiceConfig sets the rolling windows of the RTT distribution kept per
+// server ip:port.
+type ServiceConfig struct {
+	Window  int `json:"window"`  // seconds per window
+	Windows int `json:"windows"` // windows of the rolling period
+	Max     int `json:"max"`     // services tracked, the others are ignored
+}
+
+// SinkConfig configures one output of the flow records, several sinks of
+// the same type may be configured.
+type SinkConfig struct {
+	Type   string          `json:"type"`   // registered sink, e.g. jsonl
+	Config json.RawMessage `json:"config"` // passed to the Init of the sink
+	Kinds  []string        `json:"kinds"`  // tcp, http or udp, all of them if empty
+	Buffer int             `json:"buffer"` // records queued to the sink, dropped when full
+	Filter *FlowFilter     `json:"filter"`
+}
+
+// FlowFilter selects the records written to a sink, all the non-empty fields
+// must match. The HTTP transactions have no close reason nor byte counts, a
+// filter on CloseReasons or MinBytes drops them.
+type FlowFilter struct {
+	Ports        []int    `json:"ports"`        // client or server port
+	DPITypes     []string `json:"dpiTypes"`     // http, unknown
+	CloseReasons []string `json:"closeReasons"` // fin, rst, timeout or reuse
+	MinBytes     int64    `json:"minBytes"`     // bytes of both directions
+	RTTAbove     int64    `json:"rttAbove"`     // max rtt, or http latency, in µs
+}
+
+// MetricsConfig bounds the label values of the /metrics endpoint.
+type MetricsConfig struct {
+	Services        []string  `json:"services"`        // ip:port with RTT histograms, the busiest ones if empty
+	MaxServices     int       `json:"maxServices"`     // services with RTT histograms when none are listed
+	RTTBuckets      []float64 `json:"rttBuckets"`      // histogram upper bounds in ms
+	HTTPStatusClass bool      `json:"httpStatusClass"` // label HTTP statuses by class, 2xx, not by code
+	AggregateIfaces bool      `json:"aggregateIfaces"` // sum the interfaces, no iface label
+}
+
+// EventsConfig bounds the subscribers of the /events stream.
+type EventsConfig struct {
+	MaxSubscribers int `json:"maxSubscribers"`
+	Buffer         int `json:"buffer"` // events queued per subscriber, it is disconnected when full
+}
+
 var TConfig *Config
 
 func InitConfig(filename string) error {
 	return TConfig.Initialize(filename)
 }
 
+// LoadConfig reads filename into a new Config, leaving TConfig untouched.
+func LoadConfig(filename string) (*Config, error) {
+	conf := &Config{}
+	if err := conf.Initialize(filename); err != nil {
+		return nil, err
+	}
+	return conf, nil
+}
+
 func (this *Config) Initialize(filename string) error {
 	data, err := ioutil.ReadFile(filename)
 	if err != nil {
@@ -54,7 +164,7 @@ func (this *Config) Initialize(filename string) error {
 		return err
 	}
 
-	if this.Interfaces == nil || len(this.Interfaces) == 0 {
+	if len(this.Interfaces) == 0 && !this.Inputs.Enabled() {
 		return fmt.Errorf("Interfaces to listen can not be nil")
 	}
 
@@ -66,6 +176,84 @@ func (this *Config) Initialize(filename string) error {
 		this.Timeout = 120
 	}
 
+	if this.ActiveTimeout < 0 {
+		this.ActiveTimeout = 0
+	}
+
+	if this.Export != nil {
+		if this.Export.MaxPackets <= 0 {
+			this.Export.MaxPackets = 1000
+		}
+
+		if this.Export.MaxBytes <= 0 {
+			this.Export.MaxBytes = 4 * 1024 * 1024
+		}
+
+		if this.Export.Queue <= 0 {
+			this.Export.Queue = 64
+		}
+	}
+
+	if this.Recorder != nil {
+		if this.Recorder.Seconds <= 0 {
+			this.Recorder.Seconds = 30
+		}
+
+		if this.Recorder.Megabytes <= 0 {
+			this.Recorder.Megabytes = 64
+		}
+
+		if this.Recorder.Cooldown <= 0 {
+			this.Recorder.Cooldown = 60
+		}
+	}
+
+	if this.Services == nil {
+		this.Services = &ServiceConfig{}
+	}
+
+	if this.Services.Window <= 0 {
+		this.Services.Window = 60
+	}
+
+	if this.Services.Windows <= 0 {
+		this.Services.Windows = 5
+	}
+
+	if this.Services.Max <= 0 {
+		this.Services.Max = 1000
+	}
+
+	if this.Metrics == nil {
+		this.Metrics = &MetricsConfig{}
+	}
+
+	if this.Metrics.MaxServices <= 0 {
+		this.Metrics.MaxServices = 50
+	}
+
+	if len(this.Metrics.RTTBuckets) == 0 {
+		this.Metrics.RTTBuckets = []float64{0.5, 1, 2, 5, 10, 20, 50, 100, 200, 500, 1000, 2000, 5000}
+	}
+
+	if this.Events == nil {
+		this.Events = &EventsConfig{}
+	}
+
+	if this.Events.MaxSubscribers <= 0 {
+		this.Events.MaxSubscribers = 16
+	}
+
+	if this.Events.Buffer <= 0 {
+		this.Events.Buffer = 1024
+	}
+
+	for _, sink := range this.Sinks {
+		if sink.Buffer <= 0 {
+			sink.Buffer = 1024
+		}
+	}
+
 	for _, iface := range this.Interfaces {
 		if iface.Snaplen <= 0 {
 			iface.Snaplen = 2048
@@ -24,6 +24,11 @@ func SetLogFuncCall(b bool) {
 	logger.SetLogFuncCall(b)
 }
 
+// SetLogger adds the adapter registered as adapterName to the logger.
+func SetLogger(adapterName string, config string) error {
+	return logger.SetLogger(adapterName, config)
+}
+
 func SetLogFile(logFile string, level int, isRotateDaily, drawColor bool, rotateMaxDays int) {
 	logger.SetLogFile(logFile, level, isRotateDaily, drawColor, rotateMaxDays)
 }
@@ -0,0 +1,383 @@
+package log
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Syslog facilities, RFC 5424 section 6.2.1.
+var facilities = map[string]int{
+	"kern": 0, "user": 1, "mail": 2, "daemon": 3, "auth": 4, "syslog": 5,
+	"lpr": 6, "news": 7, "uucp": 8, "cron": 9, "authpriv": 10, "ftp": 11,
+	"local0": 16, "local1": 17, "local2": 18, "local3": 19,
+	"local4": 20, "local5": 21, "local6": 22, "local7": 23,
+}
+
+// severities maps the levels to the syslog severities. Alert carries the
+// periodic reports of the streams, it is no emergency for a syslog server.
+var severities = []int{
+	2, // Fatal  critical
+	3, // Error  error
+	5, // Alert  notice
+	4, // Warn   warning
+	5, // Notice notice
+	6, // Info   informational
+	7, // Debug  debug
+	7, // Trace  debug
+}
+
+const (
+	minBackoff = time.Second
+	maxBackoff = time.Minute
+)
+
+// flowKeyPattern finds the flow of a message, like
+// [10.0.0.1:40000->10.0.0.2:80] ID[12].
+var flowKeyPattern = regexp.MustCompile(`\[([0-9A-Fa-f.:]+):(\d+)->([0-9A-Fa-f.:]+):(\d+)\](?: ID\[(\d+)\])?`)
+
+// syslogWriter implements LoggerInterface.
+// It sends RFC 5424 messages over UDP, TCP with octet counting framing or a
+// unix socket. The messages are queued to a writer goroutine so that a slow
+// server never blocks the logger, they are dropped when the queue is full or
+// while the server is unreachable. It is dialed again after a backoff
+// doubling up to a minute.
+type syslogWriter struct {
+	sync.Mutex
+	Network  string `json:"network"` // udp, tcp, unix or unixgram
+	Addr     string `json:"addr"`    // host:port or socket path
+	Facility string `json:"facility"`
+	AppName  string `json:"appname"`
+	Hostname string `json:"hostname"`
+
+	// StructuredData are static SD elements added to every message, by
+	// SD-ID, like {"meta@32473":{"env":"prod"}}
+	StructuredData map[string]map[string]string `json:"structuredData"`
+
+	// FlowSDID is the SD-ID of the element with the flow of a message,
+	// empty to leave it out
+	FlowSDID string `json:"flowSdId"`
+
+	Level int `json:"level"`
+
+	// Queue is the number of messages waiting for the writer goroutine
+	Queue int `json:"queue"`
+
+	queue     chan string // nil once destroyed
+	done      chan struct{}
+	conn      net.Conn
+	facility  int
+	procID    string
+	staticSD  string
+	backoff   time.Duration
+	nextDial  time.Time
+	dropped   int64 // atomic
+	lastError error
+}
+
+func newSyslogWriter() Logger {
+	hostname, _ := os.Hostname()
+	return &syslogWriter{
+		Network:  "udp",
+		Addr:     "127.0.0.1:514",
+		Facility: "local0",
+		AppName:  "tcppass",
+		Hostname: hostname,
+		FlowSDID: "flow@32473",
+		Level:    LevelDebug,
+		Queue:    1024,
+	}
+}
+
+// Init syslog logger with json config.
+// jsonConfig like:
+//	{
+//	"network":"tcp",
+//	"addr":"10.0.0.1:601",
+//	"facility":"local3",
+//	"appname":"tcppass",
+//	"structuredData":{"meta@32473":{"env":"prod"}},
+//	"flowSdId":"flow@32473",
+//	"level":6,
+//	"queue":1024
+//	}
+func (w *syslogWriter) Init(jsonConfig string) error {
+	if len(jsonConfig) > 0 {
+		if err := json.Unmarshal([]byte(jsonConfig), w); err != nil {
+			return err
+		}
+	}
+
+	switch w.Network {
+	case "udp", "tcp", "unix", "unixgram":
+	default:
+		return fmt.Errorf("unknown syslog network %q", w.Network)
+	}
+	if len(w.Addr) == 0 {
+		return errors.New("jsonconfig must have addr")
+	}
+	if w.Queue <= 0 {
+		return fmt.Errorf("invalid syslog queue %d", w.Queue)
+	}
+
+	facility, ok := facilities[w.Facility]
+	if !ok {
+		return fmt.Errorf("unknown syslog facility %q", w.Facility)
+	}
+	w.facility = facility
+	w.procID = strconv.Itoa(os.Getpid())
+
+	sd, err := formatSD(w.StructuredData)
+	if err != nil {
+		return err
+	}
+	w.staticSD = sd
+
+	if err := w.dial(); err != nil {
+		// the server may come up later
+		fmt.Fprintf(os.Stderr, "syslogWriter(%s %s): %v\n", w.Network, w.Addr, err)
+	}
+
+	w.queue = make(chan string, w.Queue)
+	w.done = make(chan struct{})
+	go w.run(w.queue)
+	return nil
+}
+
+// WriteMsg queues the message for the syslog server, it is dropped if the
+// queue is full.
+func (w *syslogWriter) WriteMsg(msg string, level int) error {
+	if level > w.Level {
+		return nil
+	}
+	if level < 0 || level >= len(severities) {
+		level = LevelDebug
+	}
+
+	line := w.format(time.Now(), msg, level)
+
+	w.Lock()
+	defer w.Unlock()
+
+	if w.queue == nil {
+		return nil
+	}
+	select {
+	case w.queue <- line:
+	default:
+		atomic.AddInt64(&w.dropped, 1)
+	}
+	return nil
+}
+
+// run sends the queued messages until the queue is closed.
+func (w *syslogWriter) run(queue chan string) {
+	defer close(w.done)
+
+	for line := range queue {
+		w.send(line)
+	}
+	if w.conn != nil {
+		w.conn.Close()
+		w.conn = nil
+	}
+}
+
+// send writes one message, dialing the server again if its backoff is over.
+func (w *syslogWriter) send(line string) {
+	if w.conn == nil {
+		if time.Now().Before(w.nextDial) {
+			atomic.AddInt64(&w.dropped, 1)
+			return
+		}
+		if err := w.dial(); err != nil {
+			atomic.AddInt64(&w.dropped, 1)
+			return
+		}
+	}
+
+	if err := w.write(line); err != nil {
+		w.fail(err)
+		atomic.AddInt64(&w.dropped, 1)
+	}
+}
+
+// format builds the RFC 5424 message:
+// <PRI>1 TIMESTAMP HOSTNAME APP-NAME PROCID MSGID STRUCTURED-DATA MSG
+func (w *syslogWriter) format(now time.Time, msg string, level int) string {
+	sd := w.staticSD
+	if w.FlowSDID != "" {
+		sd += flowSD(w.FlowSDID, msg)
+	}
+	if sd == "" {
+		sd = "-"
+	}
+
+	return fmt.Sprintf("<%d>1 %s %s %s %s - %s %s",
+		w.facility*8+severities[level],
+		now.Format("2006-01-02T15:04:05.000000Z07:00"),
+		header(w.Hostname, 255), header(w.AppName, 48), w.procID,
+		sd, msg)
+}
+
+func (w *syslogWriter) dial() error {
+	conn, err := net.DialTimeout(w.Network, w.Addr, 2*time.Second)
+	if err != nil {
+		w.fail(err)
+		return err
+	}
+
+	w.conn = conn
+	w.backoff = 0
+	w.lastError = nil
+	if dropped := atomic.SwapInt64(&w.dropped, 0); dropped > 0 {
+		w.write(w.format(time.Now(), fmt.Sprintf("syslog reconnected, %d messages dropped", dropped), LevelWarn))
+	}
+	return nil
+}
+
+// fail closes the connection and schedules the next dial.
+func (w *syslogWriter) fail(err error) {
+	if w.conn != nil {
+		w.conn.Close()
+		w.conn = nil
+	}
+
+	if w.backoff == 0 {
+		w.backoff = minBackoff
+	} else if w.backoff *= 2; w.backoff > maxBackoff {
+		w.backoff = maxBackoff
+	}
+	w.nextDial = time.Now().Add(w.backoff)
+
+	if w.lastError == nil || w.lastError.Error() != err.Error() {
+		fmt.Fprintf(os.Stderr, "syslogWriter(%s %s): %v, retry in %v\n", w.Network, w.Addr, err, w.backoff)
+	}
+	w.lastError = err
+}
+
+// write sends one message, framed by its length on a stream socket.
+func (w *syslogWriter) write(line string) error {
+	if w.conn == nil {
+		return errors.New("not connected")
+	}
+
+	w.conn.SetWriteDeadline(time.Now().Add(2 * time.Second))
+	switch w.Network {
+	case "tcp", "unix":
+		_, err := fmt.Fprintf(w.conn, "%d %s", len(line), line)
+		return err
+	}
+	_, err := w.conn.Write([]byte(line))
+	return err
+}
+
+// header returns a printable header field of at most max characters.
+func header(s string, max int) string {
+	if s == "" {
+		return "-"
+	}
+	b := []byte(s)
+	for i, c := range b {
+		if c < 33 || c > 126 {
+			b[i] = '_'
+		}
+	}
+	if len(b) > max {
+		b = b[:max]
+	}
+	return string(b)
+}
+
+// flowSD returns the SD element of the flow a message is about, if any.
+func flowSD(id, msg string) string {
+	m := flowKeyPattern.FindStringSubmatch(msg)
+	if m == nil {
+		return ""
+	}
+
+	sd := fmt.Sprintf(`[%s src="%s" sport="%s" dst="%s" dport="%s"`, id, m[1], m[2], m[3], m[4])
+	if m[5] != "" {
+		sd += fmt.Sprintf(` flowId="%s"`, m[5])
+	}
+	return sd + "]"
+}
+
+var sdValueReplacer = strings.NewReplacer(`\`, `\\`, `"`, `\"`, `]`, `\]`)
+
+// formatSD formats the static SD elements sorted by SD-ID and name.
+func formatSD(elements map[string]map[string]string) (string, error) {
+	ids := make([]string, 0, len(elements))
+	for id := range elements {
+		if !validSDName(id) {
+			return "", fmt.Errorf("invalid SD-ID %q", id)
+		}
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	var sd string
+	for _, id := range ids {
+		params := elements[id]
+		names := make([]string, 0, len(params))
+		for name := range params {
+			if !validSDName(name) {
+				return "", fmt.Errorf("invalid SD parameter %q of %s", name, id)
+			}
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		sd += "[" + id
+		for _, name := range names {
+			sd += fmt.Sprintf(` %s="%s"`, name, sdValueReplacer.Replace(params[name]))
+		}
+		sd += "]"
+	}
+	return sd, nil
+}
+
+// validSDName reports whether s is a valid SD-ID or PARAM-NAME.
+func validSDName(s string) bool {
+	if len(s) == 0 || len(s) > 32 {
+		return false
+	}
+	for _, c := range []byte(s) {
+		if c < 33 || c > 126 || c == '=' || c == ' ' || c == ']' || c == '"' {
+			return false
+		}
+	}
+	return true
+}
+
+// Destroy sends the queued messages and closes the connection.
+func (w *syslogWriter) Destroy() {
+	w.Lock()
+	queue := w.queue
+	w.queue = nil
+	w.Unlock()
+
+	if queue != nil {
+		close(queue)
+		<-w.done
+	}
+}
+
+// Flush implementing method. empty, the writer goroutine sends the queued
+// messages as fast as the server takes them.
+func (w *syslogWriter) Flush() {
+
+}
+
+func init() {
+	Register("syslog", newSyslogWriter)
+}
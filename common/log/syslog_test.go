@@ -0,0 +1,160 @@
+package log
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSyslogFraming(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	w := newSyslogWriter().(*syslogWriter)
+	err = w.Init(fmt.Sprintf(`{"network":"tcp","addr":%q,"hostname":"probe 1","structuredData":{"meta@32473":{"env":"prod"}},"level":%d}`,
+		ln.Addr().String(), LevelInfo))
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	w.WriteMsg("[10.0.0.1:40000->10.0.0.2:80] ID[7] FINISH", LevelNotice)
+	w.WriteMsg("debug is filtered", LevelDebug)
+	w.WriteMsg("multi\nline", LevelError)
+	w.Destroy()
+
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	data, err := ioutil.ReadAll(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var msgs []string
+	for rest := string(data); len(rest) > 0; {
+		sp := strings.IndexByte(rest, ' ')
+		if sp < 0 {
+			t.Fatalf("bad frame %q", rest)
+		}
+		n, err := strconv.Atoi(rest[:sp])
+		if err != nil || sp+1+n > len(rest) {
+			t.Fatalf("bad frame %q", rest)
+		}
+		msgs = append(msgs, rest[sp+1:sp+1+n])
+		rest = rest[sp+1+n:]
+	}
+	if len(msgs) != 2 {
+		t.Fatalf("messages %q", msgs)
+	}
+
+	// local0 notice, local0 error
+	fields := strings.SplitN(msgs[0], " ", 7)
+	if fields[0] != "<133>1" || fields[2] != "probe_1" || fields[3] != "tcppass" || fields[5] != "-" {
+		t.Errorf("header %q", fields)
+	}
+	sd := `[meta@32473 env="prod"][flow@32473 src="10.0.0.1" sport="40000" dst="10.0.0.2" dport="80" flowId="7"] `
+	if !strings.HasPrefix(fields[6], sd) || !strings.HasSuffix(msgs[0], " FINISH") {
+		t.Errorf("message %q", msgs[0])
+	}
+	if !strings.HasPrefix(msgs[1], "<131>1 ") || !strings.HasSuffix(msgs[1], `[meta@32473 env="prod"] multi`+"\n"+"line") {
+		t.Errorf("message %q", msgs[1])
+	}
+}
+
+func TestFormatSD(t *testing.T) {
+	sd, err := formatSD(map[string]map[string]string{
+		"b@1": {"z": "1", "a": `say "hi" \ [x]`},
+		"a@1": {"k": ""},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := `[a@1 k=""][b@1 a="say \"hi\" \\ [x\]" z="1"]`; sd != want {
+		t.Errorf("sd %s, want %s", sd, want)
+	}
+
+	for _, elements := range []map[string]map[string]string{
+		{"bad id": {}},
+		{"a=b": {}},
+		{"ok@1": {`p"`: "v"}},
+		{strings.Repeat("x", 33): {}},
+	} {
+		if _, err := formatSD(elements); err == nil {
+			t.Errorf("%v accepted", elements)
+		}
+	}
+}
+
+func TestFlowSD(t *testing.T) {
+	tests := []struct {
+		msg, want string
+	}{
+		{"[10.0.0.1:40000->10.0.0.2:443] ID[12] RST FINISH",
+			`[f src="10.0.0.1" sport="40000" dst="10.0.0.2" dport="443" flowId="12"]`},
+		{"[fe80::1:40000->2001:db8::a:80] ACTIVE#1",
+			`[f src="fe80::1" sport="40000" dst="2001:db8::a" dport="80"]`},
+		{"created the bidirectional stream [::ffff:10.0.0.1:5000->::ffff:10.0.0.2:53] ID[3] at 2017-07-14 02:40:00",
+			`[f src="::ffff:10.0.0.1" sport="5000" dst="::ffff:10.0.0.2" dport="53" flowId="3"]`},
+		{"stream [10.0.0.1:40000->10.0.0.2:80] ID[7] is reused by a new connection, ISN 1000",
+			`[f src="10.0.0.1" sport="40000" dst="10.0.0.2" dport="80" flowId="7"]`},
+		{"[PASSSTAT] Goroutine[12], Thread[8]", ""},
+	}
+	for _, test := range tests {
+		if got := flowSD("f", test.msg); got != test.want {
+			t.Errorf("%q: %s, want %s", test.msg, got, test.want)
+		}
+	}
+}
+
+func TestSyslogBackoff(t *testing.T) {
+	w := newSyslogWriter().(*syslogWriter)
+	w.Network, w.Addr = "tcp", "127.0.0.1:1"
+
+	want := []time.Duration{1, 2, 4, 8, 16, 32, 60, 60}
+	for i, backoff := range want {
+		before := time.Now()
+		w.fail(errors.New("connection refused"))
+		if w.backoff != backoff*time.Second || w.nextDial.Before(before.Add(w.backoff)) {
+			t.Fatalf("failure %d: backoff %v, next dial in %v", i+1, w.backoff, w.nextDial.Sub(before))
+		}
+	}
+
+	// 退避期间不重新连接，消息丢弃
+	w.send("lost")
+	if w.conn != nil || w.dropped != 1 {
+		t.Errorf("conn %v, dropped %d", w.conn, w.dropped)
+	}
+
+	// 队列满时丢弃，不阻塞
+	w.queue = make(chan string, 1)
+	w.WriteMsg("queued", LevelInfo)
+	w.WriteMsg("dropped", LevelInfo)
+	if len(w.queue) != 1 || w.dropped != 2 {
+		t.Errorf("queued %d, dropped %d", len(w.queue), w.dropped)
+	}
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	w.Addr = ln.Addr().String()
+	if err := w.dial(); err != nil {
+		t.Fatal(err)
+	}
+	defer w.conn.Close()
+	if w.backoff != 0 || w.dropped != 0 {
+		t.Errorf("after dial: backoff %v, dropped %d", w.backoff, w.dropped)
+	}
+}
@@ -10,3 +10,27 @@ const (
 	HTTP_REQUEST  = 1000
 	HTTP_RESPONSE = 1001
 )
+
+var typeNames = map[int]string{
+	UNKNOWN:    "unknown",
+	HTTP:       "http",
+	BITTORRENT: "bittorrent",
+}
+
+// TypeName returns the lower case name of a stream type, as used in pass.json.
+func TypeName(streamType int) string {
+	if name, ok := typeNames[streamType]; ok {
+		return name
+	}
+	return typeNames[UNKNOWN]
+}
+
+// ParseType is the reverse of TypeName, it returns UNKNOWN for unknown names.
+func ParseType(name string) int {
+	for t, n := range typeNames {
+		if n == name {
+			return t
+		}
+	}
+	return UNKNOWN
+}
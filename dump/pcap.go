@@ -0,0 +1,203 @@
+package dump
+
+import (
+	"fmt"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+	"github.com/liuxp0827/Tcppass/common/log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+type packetData struct {
+	ci   gopacket.CaptureInfo
+	data []byte
+}
+
+// FlowBuffer keeps the raw packets of one flow. It is bounded by packet count
+// and bytes: the first half of the budget holds the head of the flow (the
+// handshake), the rest keeps its most recent packets.
+type FlowBuffer struct {
+	maxPackets int
+	maxBytes   int
+
+	head    []packetData
+	tail    []packetData
+	bytes   int
+	dropped int
+}
+
+func NewFlowBuffer(maxPackets, maxBytes int) *FlowBuffer {
+	if maxPackets < 2 {
+		maxPackets = 2
+	}
+	return &FlowBuffer{
+		maxPackets: maxPackets,
+		maxBytes:   maxBytes,
+	}
+}
+
+// Add copies data into the buffer, evicting the oldest tail packets if the
+// flow is over its budget.
+func (b *FlowBuffer) Add(ci gopacket.CaptureInfo, data []byte) {
+	if len(data) == 0 {
+		return
+	}
+
+	p := packetData{ci: ci, data: append([]byte(nil), data...)}
+	p.ci.CaptureLength = len(p.data)
+	if p.ci.Length < p.ci.CaptureLength {
+		p.ci.Length = p.ci.CaptureLength
+	}
+
+	if len(b.head) < b.maxPackets/2 && (b.maxBytes <= 0 || b.bytes+len(p.data) <= b.maxBytes/2) {
+		b.head = append(b.head, p)
+		b.bytes += len(p.data)
+		return
+	}
+
+	for len(b.tail) > 0 &&
+		(len(b.head)+len(b.tail) >= b.maxPackets || (b.maxBytes > 0 && b.bytes+len(p.data) > b.maxBytes)) {
+		b.bytes -= len(b.tail[0].data)
+		b.tail = b.tail[1:]
+		b.dropped++
+	}
+
+	if b.maxBytes > 0 && b.bytes+len(p.data) > b.maxBytes {
+		b.dropped++
+		return
+	}
+
+	b.tail = append(b.tail, p)
+	b.bytes += len(p.data)
+}
+
+// Len returns the number of packets held.
+func (b *FlowBuffer) Len() int {
+	return len(b.head) + len(b.tail)
+}
+
+// Dropped returns the number of packets evicted to stay within budget.
+func (b *FlowBuffer) Dropped() int {
+	return b.dropped
+}
+
+// Take returns the buffered packets in capture order and empties the buffer.
+func (b *FlowBuffer) Take() []packetData {
+	packets := make([]packetData, 0, b.Len())
+	packets = append(packets, b.head...)
+	packets = append(packets, b.tail...)
+	b.Reset()
+	return packets
+}
+
+func (b *FlowBuffer) Reset() {
+	b.head = nil
+	b.tail = nil
+	b.bytes = 0
+	b.dropped = 0
+}
+
+type exportJob struct {
+	name     string
+	linkType layers.LinkType
+	packets  []packetData
+}
+
+// FlowExporter writes flow buffers to pcap files from a background goroutine
+// so that the capture path never waits on the disk.
+type FlowExporter struct {
+	dir     string
+	jobs    chan *exportJob
+	dropped int64
+}
+
+func NewFlowExporter(dir string, queue int) (*FlowExporter, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	e := &FlowExporter{
+		dir:  dir,
+		jobs: make(chan *exportJob, queue),
+	}
+	go e.run()
+	return e, nil
+}
+
+// Export queues the packets of buffer b to be written as a pcap file named
+// after the flow key and its first and last timestamps. It returns false if
+// the queue is full and the flow was dropped.
+func (e *FlowExporter) Export(key string, first, last time.Time, linkType layers.LinkType, b *FlowBuffer) bool {
+	if b.Len() == 0 {
+		return false
+	}
+
+	job := &exportJob{
+		name:     filepath.Join(e.dir, PcapName(key, first, last)),
+		linkType: linkType,
+		packets:  b.Take(),
+	}
+
+	select {
+	case e.jobs <- job:
+		return true
+	default:
+		atomic.AddInt64(&e.dropped, 1)
+		log.Warnf("flow exporter queue is full, drop %s", job.name)
+		return false
+	}
+}
+
+// Dropped returns the number of flows dropped because the queue was full.
+func (e *FlowExporter) Dropped() int64 {
+	return atomic.LoadInt64(&e.dropped)
+}
+
+func (e *FlowExporter) run() {
+	for job := range e.jobs {
+		if err := writePcap(job.name, job.linkType, job.packets); err != nil {
+			log.Errorf("export %s failed, %v", job.name, err)
+			continue
+		}
+		log.Infof("exported %d packets to %s", len(job.packets), job.name)
+	}
+}
+
+var pcapNameReplacer = strings.NewReplacer("->", "_", ":", "-", "/", "-", " ", "")
+
+// PcapName builds a file name from a flow key like "1.1.1.1:80->2.2.2.2:1234"
+// and the flow's first and last timestamps.
+func PcapName(key string, first, last time.Time) string {
+	return fmt.Sprintf("%s_%s_%s.pcap", pcapNameReplacer.Replace(key),
+		first.Format("20060102T150405.000000"), last.Format("20060102T150405.000000"))
+}
+
+func writePcap(name string, linkType layers.LinkType, packets []packetData) error {
+	f, err := os.Create(name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	snaplen := 0
+	for _, p := range packets {
+		if p.ci.Length > snaplen {
+			snaplen = p.ci.Length
+		}
+	}
+
+	w := pcapgo.NewWriter(f)
+	if err = w.WriteFileHeader(uint32(snaplen), linkType); err != nil {
+		return err
+	}
+	for _, p := range packets {
+		if err = w.WritePacket(p.ci, p.data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
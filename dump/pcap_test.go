@@ -0,0 +1,110 @@
+package dump
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestFlowBuffer(t *testing.T) {
+	start := time.Unix(1500000000, 0)
+	add := func(b *FlowBuffer, i, size int) {
+		b.Add(gopacket.CaptureInfo{Timestamp: start.Add(time.Duration(i) * time.Millisecond)}, bytes.Repeat([]byte{byte(i)}, size))
+	}
+	firsts := func(packets []packetData) []int {
+		var ids []int
+		for _, p := range packets {
+			ids = append(ids, int(p.data[0]))
+		}
+		return ids
+	}
+
+	tests := []struct {
+		name       string
+		maxPackets int
+		maxBytes   int
+		sizes      []int
+		want       []int
+		dropped    int
+	}{
+		{"under budget", 10, 0, []int{10, 10, 10}, []int{0, 1, 2}, 0},
+		// 前一半保留握手，后一半保留最近的包
+		{"packet bound", 4, 0, []int{10, 10, 10, 10, 10, 10}, []int{0, 1, 4, 5}, 2},
+		{"byte bound", 10, 100, []int{30, 30, 30, 30, 30}, []int{0, 3, 4}, 2},
+		{"oversized packet", 10, 100, []int{30, 200, 30}, []int{0, 2}, 1},
+		{"empty packet", 10, 0, []int{10, 0, 10}, []int{0, 2}, 0},
+		{"minimum budget", 1, 0, []int{10, 10, 10}, []int{0, 2}, 1},
+	}
+	for _, test := range tests {
+		b := NewFlowBuffer(test.maxPackets, test.maxBytes)
+		for i, size := range test.sizes {
+			add(b, i, size)
+		}
+		if b.Len() != len(test.want) || b.Dropped() != test.dropped {
+			t.Errorf("%s: %d packets, %d dropped", test.name, b.Len(), b.Dropped())
+		}
+		packets := b.Take()
+		if got := firsts(packets); fmt.Sprint(got) != fmt.Sprint(test.want) {
+			t.Errorf("%s: packets %v, want %v", test.name, got, test.want)
+		}
+		if b.Len() != 0 || b.Dropped() != 0 || b.bytes != 0 {
+			t.Errorf("%s: not empty after Take", test.name)
+		}
+	}
+}
+
+func TestPcapName(t *testing.T) {
+	first := time.Date(2017, 7, 14, 2, 40, 0, 123456000, time.UTC)
+	last := first.Add(90 * time.Second)
+	tests := []struct {
+		key, want string
+	}{
+		{"10.0.0.1:40000->10.0.0.2:80", "10.0.0.1-40000_10.0.0.2-80_20170714T024000.123456_20170714T024130.123456.pcap"},
+		{"[2001:db8::1]:40000->[2001:db8::2]:443", "[2001-db8--1]-40000_[2001-db8--2]-443_20170714T024000.123456_20170714T024130.123456.pcap"},
+		{"sflow/10.0.0.254 a", "sflow-10.0.0.254a_20170714T024000.123456_20170714T024130.123456.pcap"},
+	}
+	for _, test := range tests {
+		if got := PcapName(test.key, first, last); got != test.want {
+			t.Errorf("%s: %s, want %s", test.key, got, test.want)
+		}
+	}
+}
+
+func TestWritePcap(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pcap")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	start := time.Unix(1500000000, 123456000)
+	written := []packetData{
+		{gopacket.CaptureInfo{Timestamp: start, CaptureLength: 3, Length: 3}, []byte{1, 2, 3}},
+		{gopacket.CaptureInfo{Timestamp: start.Add(time.Millisecond), CaptureLength: 4, Length: 1514}, []byte{4, 5, 6, 7}},
+	}
+	name := filepath.Join(dir, "flow.pcap")
+	if err := writePcap(name, layers.LinkTypeLinuxSLL, written); err != nil {
+		t.Fatal(err)
+	}
+
+	linkType, read := readPcap(t, name)
+	if linkType != layers.LinkTypeLinuxSLL || len(read) != len(written) {
+		t.Fatalf("link type %v, %d packets", linkType, len(read))
+	}
+	for i, p := range read {
+		w := written[i]
+		if !p.ci.Timestamp.Equal(w.ci.Timestamp) || p.ci.CaptureLength != w.ci.CaptureLength || p.ci.Length != w.ci.Length || !bytes.Equal(p.data, w.data) {
+			t.Errorf("packet %d %+v %v, want %+v %v", i, p.ci, p.data, w.ci, w.data)
+		}
+	}
+
+	if err := writePcap(filepath.Join(dir, "missing", "flow.pcap"), layers.LinkTypeEthernet, written); err == nil {
+		t.Error("wrote into a missing directory")
+	}
+}
@@ -0,0 +1,214 @@
+package dump
+
+import (
+	"fmt"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/liuxp0827/Tcppass/common/clock"
+	. "github.com/liuxp0827/Tcppass/common/config"
+	"github.com/liuxp0827/Tcppass/common/log"
+	"github.com/liuxp0827/Tcppass/events"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+var (
+	recordersMu sync.RWMutex
+	recorders   = make(map[string]*Recorder)
+)
+
+// Recorder is a flight recorder for one interface: it holds the last seconds
+// or megabytes of captured packets and writes them to a pcap file when
+// triggered, either on demand or by a RST burst or drop spike.
+type Recorder struct {
+	mu       sync.Mutex
+	name     string
+	conf     *RecorderConfig
+	linkType layers.LinkType
+	window   time.Duration
+	maxBytes int
+
+	packets []packetData
+	bytes   int
+
+	lastTrigger time.Time
+	rstSecond   int64
+	rstCount    int
+	drops       int64
+}
+
+// NewRecorder creates the recorder of interface name and registers it, it
+// replaces any previous recorder of the same interface.
+func NewRecorder(name string, linkType layers.LinkType, conf *RecorderConfig) (*Recorder, error) {
+	if err := os.MkdirAll(conf.Dir, 0755); err != nil {
+		return nil, err
+	}
+
+	r := &Recorder{
+		name:     name,
+		conf:     conf,
+		linkType: linkType,
+		window:   time.Duration(conf.Seconds) * time.Second,
+		maxBytes: conf.Megabytes * 1024 * 1024,
+		drops:    -1,
+	}
+
+	recordersMu.Lock()
+	recorders[name] = r
+	recordersMu.Unlock()
+	return r, nil
+}
+
+// GetRecorder returns the recorder of interface name, or nil.
+func GetRecorder(name string) *Recorder {
+	recordersMu.RLock()
+	defer recordersMu.RUnlock()
+	return recorders[name]
+}
+
+// RemoveRecorder unregisters r if it is still the recorder of its interface.
+func RemoveRecorder(r *Recorder) {
+	recordersMu.Lock()
+	if recorders[r.name] == r {
+		delete(recorders, r.name)
+	}
+	recordersMu.Unlock()
+}
+
+// Add appends a captured packet and drops the packets that fell out of the
+// time or size window.
+func (r *Recorder) Add(ci gopacket.CaptureInfo, data []byte) {
+	p := packetData{ci: ci, data: append([]byte(nil), data...)}
+	p.ci.CaptureLength = len(p.data)
+	if p.ci.Length < p.ci.CaptureLength {
+		p.ci.Length = p.ci.CaptureLength
+	}
+
+	r.mu.Lock()
+	r.packets = append(r.packets, p)
+	r.bytes += len(p.data)
+
+	oldest := ci.Timestamp.Add(-r.window)
+	n := 0
+	for n < len(r.packets)-1 &&
+		(r.bytes > r.maxBytes || r.packets[n].ci.Timestamp.Before(oldest)) {
+		r.bytes -= len(r.packets[n].data)
+		r.packets[n] = packetData{}
+		n++
+	}
+	r.packets = r.packets[n:]
+	r.mu.Unlock()
+}
+
+// ObserveRST counts a RST seen at ts and triggers a snapshot once RSTBurst
+// of them are seen within the same second, at most once per second.
+func (r *Recorder) ObserveRST(ts time.Time) {
+	if r.conf.RSTBurst <= 0 {
+		return
+	}
+
+	r.mu.Lock()
+	if sec := ts.Unix(); sec != r.rstSecond {
+		r.rstSecond = sec
+		r.rstCount = 0
+	}
+	r.rstCount++
+	burst := r.rstCount == r.conf.RSTBurst
+	r.mu.Unlock()
+
+	if burst {
+		r.Trigger("rst-burst")
+	}
+}
+
+// ObserveDrops takes the cumulative count of packets dropped by the capture
+// and triggers a snapshot when it grew by DropSpike or more since the last
+// call.
+func (r *Recorder) ObserveDrops(drops int64) {
+	if r.conf.DropSpike <= 0 {
+		return
+	}
+
+	r.mu.Lock()
+	spike := r.drops >= 0 && drops-r.drops >= int64(r.conf.DropSpike)
+	r.drops = drops
+	r.mu.Unlock()
+
+	if spike {
+		r.Trigger("drop-spike")
+	}
+}
+
+// Trigger writes a snapshot in the background unless another trigger fired
+// within the cooldown period.
+func (r *Recorder) Trigger(reason string) {
+	r.mu.Lock()
+	now := clock.Now()
+	if now.Sub(r.lastTrigger) < time.Duration(r.conf.Cooldown)*time.Second {
+		r.mu.Unlock()
+		return
+	}
+	r.lastTrigger = now
+	r.mu.Unlock()
+
+	log.Alertf("[%s RECORDER] %s triggered a snapshot", r.name, reason)
+	events.Publish(&events.Event{Type: events.Alert, Time: now, Iface: r.name, Reason: reason})
+	go func() {
+		if _, err := r.Snapshot(reason); err != nil {
+			log.Errorf("[%s RECORDER] snapshot failed, %v", r.name, err)
+		}
+	}()
+}
+
+// Snapshot writes the current content of the recorder to a timestamped pcap
+// file and returns its name.
+func (r *Recorder) Snapshot(reason string) (string, error) {
+	r.mu.Lock()
+	packets := make([]packetData, len(r.packets))
+	copy(packets, r.packets)
+	r.mu.Unlock()
+
+	if len(packets) == 0 {
+		return "", fmt.Errorf("recorder %s is empty", r.name)
+	}
+
+	name := filepath.Join(r.conf.Dir, fmt.Sprintf("%s_%s_%s.pcap",
+		pcapNameReplacer.Replace(r.name), clock.Now().Format("20060102T150405.000000"), reason))
+	if err := writePcap(name, r.linkType, packets); err != nil {
+		return "", err
+	}
+
+	log.Infof("[%s RECORDER] wrote %d packets to %s", r.name, len(packets), name)
+	return name, nil
+}
+
+// SnapshotAll writes a snapshot of every registered recorder, or of the one
+// of interface name if it is not empty.
+func SnapshotAll(name, reason string) (files []string, err error) {
+	recordersMu.RLock()
+	var all []*Recorder
+	for n, r := range recorders {
+		if name == "" || n == name {
+			all = append(all, r)
+		}
+	}
+	recordersMu.RUnlock()
+
+	if name != "" && len(all) == 0 {
+		return nil, fmt.Errorf("no recorder on interface %s", name)
+	}
+
+	sort.Slice(all, func(i, j int) bool { return all[i].name < all[j].name })
+	for _, r := range all {
+		file, e := r.Snapshot(reason)
+		if e != nil {
+			err = e
+			continue
+		}
+		files = append(files, file)
+	}
+	return files, err
+}
@@ -0,0 +1,185 @@
+package dump
+
+import (
+	"bytes"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+	. "github.com/liuxp0827/Tcppass/common/config"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// readPcap returns the link type and the packets of pcap file name.
+func readPcap(t *testing.T, name string) (layers.LinkType, []packetData) {
+	f, err := os.Open(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	r, err := pcapgo.NewReader(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var packets []packetData
+	for {
+		data, ci, err := r.ReadPacketData()
+		if err != nil {
+			break
+		}
+		packets = append(packets, packetData{ci: ci, data: data})
+	}
+	return r.LinkType(), packets
+}
+
+// waitSnapshots waits for the triggered snapshots to write n files in dir.
+func waitSnapshots(t *testing.T, dir string, n int) {
+	var files []string
+	for i := 0; i < 100; i++ {
+		files, _ = filepath.Glob(filepath.Join(dir, "*.pcap"))
+		if len(files) >= n {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	// 再等一会，确认没有多余的快照
+	time.Sleep(30 * time.Millisecond)
+	if files, _ = filepath.Glob(filepath.Join(dir, "*.pcap")); len(files) != n {
+		t.Fatalf("%d snapshots, want %d: %v", len(files), n, files)
+	}
+}
+
+func testRecorder(t *testing.T, conf *RecorderConfig) *Recorder {
+	dir, err := ioutil.TempDir("", "recorder")
+	if err != nil {
+		t.Fatal(err)
+	}
+	conf.Dir = dir
+	r, err := NewRecorder("eth0", layers.LinkTypeEthernet, conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return r
+}
+
+func cleanup(r *Recorder) {
+	RemoveRecorder(r)
+	os.RemoveAll(r.conf.Dir)
+}
+
+func TestRecorderRing(t *testing.T) {
+	r := testRecorder(t, &RecorderConfig{Seconds: 10, Megabytes: 1})
+	defer cleanup(r)
+
+	start := time.Unix(1500000000, 0)
+	add := func(d time.Duration, size int) {
+		r.Add(gopacket.CaptureInfo{Timestamp: start.Add(d)}, make([]byte, size))
+	}
+
+	// 时间窗口外的包被丢弃
+	add(0, 100)
+	add(5*time.Second, 100)
+	add(12*time.Second, 100)
+	if len(r.packets) != 2 || r.bytes != 200 || !r.packets[0].ci.Timestamp.Equal(start.Add(5*time.Second)) {
+		t.Fatalf("time window kept %d packets, %d bytes", len(r.packets), r.bytes)
+	}
+
+	// 超过字节上限时丢弃最旧的包，但总是保留最新的一个
+	r.maxBytes = 250
+	add(13*time.Second, 100)
+	if len(r.packets) != 2 || r.bytes != 200 || !r.packets[0].ci.Timestamp.Equal(start.Add(12*time.Second)) {
+		t.Fatalf("byte bound kept %d packets, %d bytes", len(r.packets), r.bytes)
+	}
+	add(14*time.Second, 300)
+	if len(r.packets) != 1 || r.bytes != 300 {
+		t.Fatalf("oversized packet kept %d packets, %d bytes", len(r.packets), r.bytes)
+	}
+}
+
+func TestRecorderTriggers(t *testing.T) {
+	r := testRecorder(t, &RecorderConfig{Seconds: 10, Megabytes: 1, RSTBurst: 3, DropSpike: 100})
+	defer cleanup(r)
+
+	start := time.Unix(1500000000, 0)
+	r.Add(gopacket.CaptureInfo{Timestamp: start}, []byte{1, 2, 3})
+
+	r.ObserveRST(start)
+	r.ObserveRST(start.Add(100 * time.Millisecond))
+	waitSnapshots(t, r.conf.Dir, 0)
+	r.ObserveRST(start.Add(200 * time.Millisecond))
+	waitSnapshots(t, r.conf.Dir, 1)
+	// 同一秒内只触发一次
+	r.ObserveRST(start.Add(300 * time.Millisecond))
+	waitSnapshots(t, r.conf.Dir, 1)
+	// 新的一秒重新计数
+	for i := 0; i < 3; i++ {
+		r.ObserveRST(start.Add(time.Second))
+	}
+	waitSnapshots(t, r.conf.Dir, 2)
+
+	// 第一次只记录基数
+	r.ObserveDrops(1000)
+	r.ObserveDrops(1050)
+	waitSnapshots(t, r.conf.Dir, 2)
+	r.ObserveDrops(1150)
+	waitSnapshots(t, r.conf.Dir, 3)
+}
+
+func TestRecorderCooldown(t *testing.T) {
+	r := testRecorder(t, &RecorderConfig{Seconds: 10, Megabytes: 1, RSTBurst: 1, Cooldown: 3600})
+	defer cleanup(r)
+
+	start := time.Unix(1500000000, 0)
+	r.Add(gopacket.CaptureInfo{Timestamp: start}, []byte{1, 2, 3})
+
+	r.Trigger("manual")
+	waitSnapshots(t, r.conf.Dir, 1)
+	r.ObserveRST(start)
+	r.Trigger("manual")
+	waitSnapshots(t, r.conf.Dir, 1)
+}
+
+func TestRecorderSnapshot(t *testing.T) {
+	r := testRecorder(t, &RecorderConfig{Seconds: 10, Megabytes: 1})
+	defer cleanup(r)
+
+	if _, err := r.Snapshot("empty"); err == nil {
+		t.Error("empty recorder wrote a snapshot")
+	}
+
+	start := time.Unix(1500000000, 0)
+	for i := 0; i < 3; i++ {
+		r.Add(gopacket.CaptureInfo{Timestamp: start.Add(time.Duration(i) * time.Second), Length: 1500}, []byte{byte(i), 1, 2, 3})
+	}
+
+	name, err := r.Snapshot("manual")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if filepath.Dir(name) != r.conf.Dir || filepath.Ext(name) != ".pcap" {
+		t.Errorf("snapshot %s", name)
+	}
+
+	linkType, packets := readPcap(t, name)
+	if linkType != layers.LinkTypeEthernet || len(packets) != 3 {
+		t.Fatalf("link type %v, %d packets", linkType, len(packets))
+	}
+	for i, p := range packets {
+		if !p.ci.Timestamp.Equal(start.Add(time.Duration(i)*time.Second)) || p.ci.Length != 1500 || p.ci.CaptureLength != 4 ||
+			!bytes.Equal(p.data, []byte{byte(i), 1, 2, 3}) {
+			t.Errorf("packet %d %+v %v", i, p.ci, p.data)
+		}
+	}
+
+	files, err := SnapshotAll("eth0", "all")
+	if err != nil || len(files) != 1 {
+		t.Errorf("SnapshotAll %v, %v", files, err)
+	}
+	if _, err = SnapshotAll("eth9", "all"); err == nil {
+		t.Error("snapshot of a missing recorder")
+	}
+}
@@ -0,0 +1,139 @@
+// Package engine embeds the TCP reassembly, RTT measurement and DPI of
+// Tcppass in another program: packets are fed to an Engine and the streams
+// are reported to a Handler as typed events.
+package engine
+
+import (
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/liuxp0827/Tcppass/flow"
+	"github.com/liuxp0827/Tcppass/tcpassembly"
+	"sync"
+)
+
+type (
+	Handler    = tcpassembly.Handler
+	NopHandler = tcpassembly.NopHandler
+	StreamInfo = tcpassembly.StreamInfo
+	FlowRecord = flow.FlowRecord
+	HTTPRecord = flow.HTTPRecord
+	Direction  = tcpassembly.Direction
+
+	// Options configure an Engine, the zero value logs nothing periodically
+	// and exports no pcap files.
+	Options = tcpassembly.PoolOptions
+)
+
+const (
+	ClientToServer = tcpassembly.ClientToServer
+	ServerToClient = tcpassembly.ServerToClient
+)
+
+// MultiHandler returns a Handler that passes every event to handlers in turn.
+func MultiHandler(handlers ...Handler) Handler {
+	return tcpassembly.MultiHandler(handlers...)
+}
+
+// Engine tracks the TCP streams of the packets of one or more interfaces.
+type Engine struct {
+	mu         sync.Mutex
+	pool       *tcpassembly.StreamPool
+	assemblers map[string]*tcpassembly.Assembler
+	closed     bool
+}
+
+// New creates an engine reporting to h, which may be nil.
+func New(h Handler, opts Options) *Engine {
+	pool := tcpassembly.NewStreamPool(opts)
+	if h != nil {
+		pool.SetHandler(h)
+	}
+	return &Engine{
+		pool:       pool,
+		assemblers: make(map[string]*tcpassembly.Assembler),
+	}
+}
+
+// HandlePacket assembles a packet captured on iface, the packets other than
+// TCP are ignored. The packet must carry its link layer when the streams are
+// exported to pcap files.
+func (e *Engine) HandlePacket(iface string, packet gopacket.Packet) {
+	if packet.NetworkLayer() == nil {
+		return
+	}
+
+	tcp, ok := packet.TransportLayer().(*layers.TCP)
+	if !ok {
+		return
+	}
+
+	a := e.assembler(iface, packet)
+	if a == nil {
+		return
+	}
+
+	a.AssembleWithContext(packet.NetworkLayer().NetworkFlow(), tcp, &tcpassembly.CaptureContext{
+		CaptureInfo: packet.Metadata().CaptureInfo,
+		Data:        packet.Data(),
+	})
+}
+
+// HandleTCP assembles an already decoded TCP segment.
+func (e *Engine) HandleTCP(iface string, netFlow gopacket.Flow, tcp *layers.TCP, ci gopacket.CaptureInfo) {
+	if a := e.assembler(iface, nil); a != nil {
+		a.AssembleWithContext(netFlow, tcp, &tcpassembly.CaptureContext{CaptureInfo: ci})
+	}
+}
+
+func (e *Engine) assembler(iface string, packet gopacket.Packet) *tcpassembly.Assembler {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if e.closed {
+		return nil
+	}
+
+	a, ok := e.assemblers[iface]
+	if !ok {
+		a = tcpassembly.NewAssembler(iface, e.pool)
+		if packet != nil && packet.LinkLayer() != nil {
+			a.LinkType = linkType(packet.LinkLayer().LayerType())
+		}
+		e.assemblers[iface] = a
+	}
+	return a
+}
+
+func linkType(t gopacket.LayerType) layers.LinkType {
+	switch t {
+	case layers.LayerTypeLinuxSLL:
+		return layers.LinkTypeLinuxSLL
+	case layers.LayerTypeLoopback:
+		return layers.LinkTypeNull
+	}
+	return layers.LinkTypeEthernet
+}
+
+// Flush finishes the streams in progress, they are reported to the handler
+// before it returns. It must not run concurrently with HandlePacket or
+// HandleTCP.
+func (e *Engine) Flush() {
+	e.pool.Flush()
+}
+
+// Close stops accepting packets, finishes the streams in progress and
+// releases the assemblers.
+func (e *Engine) Close() {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if e.closed {
+		return
+	}
+	e.closed = true
+	e.pool.Flush()
+	for iface, a := range e.assemblers {
+		a.Close()
+		delete(e.assemblers, iface)
+	}
+}
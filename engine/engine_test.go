@@ -0,0 +1,224 @@
+package engine
+
+import (
+	"fmt"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/liuxp0827/Tcppass/common/clock"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+type recorder struct {
+	mu      sync.Mutex
+	events  []string
+	interim *FlowRecord
+	record  *FlowRecord
+}
+
+func (r *recorder) add(event string) {
+	r.mu.Lock()
+	r.events = append(r.events, event)
+	r.mu.Unlock()
+}
+
+func (r *recorder) OnStreamOpen(info *StreamInfo) {
+	r.add(fmt.Sprintf("open %d", info.ID))
+}
+
+func (r *recorder) OnData(info *StreamInfo, dir Direction, data []byte, gap int, ts time.Time) {
+	r.add(fmt.Sprintf("data %s %q", dir, data))
+}
+
+func (r *recorder) OnTransaction(info *StreamInfo, record *HTTPRecord) {}
+
+func (r *recorder) OnInterim(info *StreamInfo, record *FlowRecord) {
+	r.add(fmt.Sprintf("interim %d", info.ID))
+	r.mu.Lock()
+	r.interim = record
+	r.mu.Unlock()
+}
+
+func (r *recorder) OnStreamClose(info *StreamInfo, record *FlowRecord) {
+	r.add(fmt.Sprintf("close %d", info.ID))
+	r.mu.Lock()
+	r.record = record
+	r.mu.Unlock()
+}
+
+// sender returns a function feeding e a TCP packet between 10.0.0.1:40000
+// and 10.0.0.2:80, ms after start.
+func sender(t *testing.T, e *Engine, start time.Time) func(ms int, c2s bool, seq, ack uint32, flags string, payload string) {
+	client, server := net.IP{10, 0, 0, 1}, net.IP{10, 0, 0, 2}
+	return func(ms int, c2s bool, seq, ack uint32, flags string, payload string) {
+		tcp := &layers.TCP{SrcPort: 40000, DstPort: 80, Seq: seq, Ack: ack, Window: 65535}
+		netFlow := gopacket.NewFlow(layers.EndpointIPv4, client, server)
+		if !c2s {
+			tcp.SrcPort, tcp.DstPort = tcp.DstPort, tcp.SrcPort
+			netFlow = netFlow.Reverse()
+		}
+		for _, f := range flags {
+			switch f {
+			case 'S':
+				tcp.SYN = true
+			case 'A':
+				tcp.ACK = true
+			case 'P':
+				tcp.PSH = true
+			case 'F':
+				tcp.FIN = true
+			case 'R':
+				tcp.RST = true
+			}
+		}
+		// 编码再解码，TransportFlow需要端口的原始字节
+		buf := gopacket.NewSerializeBuffer()
+		if err := gopacket.SerializeLayers(buf, gopacket.SerializeOptions{FixLengths: true}, tcp, gopacket.Payload(payload)); err != nil {
+			t.Fatal(err)
+		}
+		tcp = &layers.TCP{}
+		if err := tcp.DecodeFromBytes(buf.Bytes(), gopacket.NilDecodeFeedback); err != nil {
+			t.Fatal(err)
+		}
+		ts := start.Add(time.Duration(ms) * time.Millisecond)
+		e.HandleTCP("eth0", netFlow, tcp, gopacket.CaptureInfo{Timestamp: ts, CaptureLength: 54 + len(payload), Length: 54 + len(payload)})
+	}
+}
+
+func TestHandleTCP(t *testing.T) {
+	r := &recorder{}
+	e := New(r, Options{})
+
+	start := time.Unix(1500000000, 0)
+	packet := sender(t, e, start)
+
+	packet(0, true, 1000, 0, "S", "")
+	packet(10, false, 5000, 1001, "SA", "")
+	packet(20, true, 1001, 5001, "A", "")
+	packet(30, true, 1001, 5001, "PA", "hello")
+	packet(40, false, 5001, 1006, "PA", "world!")
+	packet(50, true, 1006, 5007, "FA", "")
+	packet(60, false, 5007, 1007, "FA", "")
+	packet(70, true, 1007, 5008, "A", "")
+	e.Close()
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	want := []string{"open 1", `data c2s "hello"`, `data s2c "world!"`, "close 1"}
+	if fmt.Sprint(r.events) != fmt.Sprint(want) {
+		t.Fatalf("events %q, want %q", r.events, want)
+	}
+
+	rec := r.record
+	if rec.SrcIP != "10.0.0.1" || rec.SrcPort != 40000 || rec.DstIP != "10.0.0.2" || rec.DstPort != 80 {
+		t.Errorf("endpoints %s:%d -> %s:%d", rec.SrcIP, rec.SrcPort, rec.DstIP, rec.DstPort)
+	}
+	if rec.Iface != "eth0" || !rec.Final || rec.CloseReason != "fin" {
+		t.Errorf("record %+v", rec)
+	}
+	// 两个FIN之后stream即结束，最后的ACK不计入
+	if !rec.FirstSeen.Equal(start) || !rec.LastSeen.Equal(start.Add(60*time.Millisecond)) {
+		t.Errorf("seen %s - %s", rec.FirstSeen, rec.LastSeen)
+	}
+	if rec.TxBytes != 5 || rec.TxPackets != 4 || rec.RxBytes != 6 || rec.RxPackets != 3 {
+		t.Errorf("tx %dB/%d, rx %dB/%d", rec.TxBytes, rec.TxPackets, rec.RxBytes, rec.RxPackets)
+	}
+	if rec.RTT == nil || rec.RTT.First != 10000 || rec.RTT.Avg != 10000 {
+		t.Errorf("rtt %+v", rec.RTT)
+	}
+}
+
+func TestInterimRecord(t *testing.T) {
+	// 中间记录由ticker触发，用报文时钟控制时间
+	start := time.Unix(1500000000, 0)
+	replay := clock.NewPacketClock(0)
+	clock.Set(replay)
+	replay.Advance(start)
+
+	r := &recorder{}
+	e := New(r, Options{ActiveTimeout: time.Second})
+	packet := sender(t, e, start)
+
+	packet(0, true, 1000, 0, "S", "")
+	packet(10, false, 5000, 1001, "SA", "")
+	packet(20, true, 1001, 5001, "A", "")
+	packet(30, true, 1001, 5001, "PA", "hello")
+	packet(40, false, 5001, 1006, "PA", "world!")
+
+	for i := 1; i <= 100; i++ {
+		replay.Advance(start.Add(time.Duration(i) * time.Second))
+		time.Sleep(10 * time.Millisecond)
+		r.mu.Lock()
+		done := r.interim != nil
+		r.mu.Unlock()
+		if done {
+			break
+		}
+	}
+
+	r.mu.Lock()
+	rec := r.interim
+	r.mu.Unlock()
+	if rec == nil {
+		t.Fatal("no interim record")
+	}
+	if rec.Final || rec.CloseReason != "" || !rec.FirstSeen.Equal(start) || !rec.LastSeen.After(rec.FirstSeen) {
+		t.Errorf("interim %+v", rec)
+	}
+	if rec.TxBytes != 5 || rec.TxPackets != 3 || rec.RxBytes != 6 || rec.RxPackets != 2 {
+		t.Errorf("interim tx %dB/%d, rx %dB/%d", rec.TxBytes, rec.TxPackets, rec.RxBytes, rec.RxPackets)
+	}
+	e.Close()
+
+	// 最终记录仍然是全部的计数
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if rec := r.record; rec == nil || !rec.Final || rec.TxBytes != 5 || rec.RxBytes != 6 {
+		t.Errorf("final %+v", rec)
+	}
+}
+
+func TestConnFailure(t *testing.T) {
+	type packet struct {
+		ms       int
+		c2s      bool
+		seq, ack uint32
+		flags    string
+		payload  string
+	}
+	tests := []struct {
+		name    string
+		packets []packet
+		want    bool
+	}{
+		{"refused", []packet{{0, true, 1000, 0, "S", ""}, {10, false, 0, 1001, "RA", ""}}, true},
+		{"silent server", []packet{{0, true, 1000, 0, "S", ""}, {1000, true, 1000, 0, "S", ""}}, true},
+		{"reset after handshake", []packet{{0, true, 1000, 0, "S", ""}, {10, false, 5000, 1001, "SA", ""},
+			{20, true, 1001, 5001, "A", ""}, {30, false, 5001, 1001, "RA", ""}}, false},
+		// 只抓到客户端方向，客户端的ACK说明服务端响应过
+		{"asymmetric capture", []packet{{0, true, 1000, 0, "S", ""}, {20, true, 1001, 5001, "A", ""},
+			{30, true, 1001, 5001, "PA", "hello"}}, false},
+	}
+	for _, test := range tests {
+		r := &recorder{}
+		e := New(r, Options{})
+		packet := sender(t, e, time.Unix(1500000000, 0))
+		for _, p := range test.packets {
+			packet(p.ms, p.c2s, p.seq, p.ack, p.flags, p.payload)
+		}
+		e.Close()
+
+		r.mu.Lock()
+		rec := r.record
+		r.mu.Unlock()
+		if rec == nil {
+			t.Errorf("%s: no record", test.name)
+			continue
+		}
+		if got := rec.ConnFailure(); got != test.want {
+			t.Errorf("%s: conn failure %v, want %v, record %+v", test.name, got, test.want, rec)
+		}
+	}
+}
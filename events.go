@@ -0,0 +1,156 @@
+package main
+
+import (
+	"fmt"
+	. "github.com/liuxp0827/Tcppass/common/config"
+	"github.com/liuxp0827/Tcppass/common/json"
+	"github.com/liuxp0827/Tcppass/events"
+	"github.com/liuxp0827/Tcppass/flow"
+	"github.com/liuxp0827/Tcppass/tcpassembly"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// eventHandler publishes the events of the streams to the subscribers of
+// /events, it costs nothing while there are none.
+type eventHandler struct {
+	tcpassembly.NopHandler
+}
+
+func (eventHandler) OnStreamOpen(info *tcpassembly.StreamInfo) {
+	if !events.Listening() {
+		return
+	}
+
+	e := &events.Event{Type: events.StreamOpen, Time: info.FirstSeen, Iface: info.Iface, ID: info.ID}
+	e.SetEndpoints(info.Net, info.Transport)
+	events.Publish(e)
+}
+
+func (eventHandler) OnTransaction(info *tcpassembly.StreamInfo, record *flow.HTTPRecord) {
+	if !events.Listening() {
+		return
+	}
+
+	events.Publish(&events.Event{
+		Type:    events.HTTP,
+		Time:    record.Time,
+		Iface:   record.Iface,
+		ID:      record.FlowID,
+		SrcIP:   record.SrcIP,
+		SrcPort: record.SrcPort,
+		DstIP:   record.DstIP,
+		DstPort: record.DstPort,
+		HTTP:    record,
+	})
+}
+
+func (eventHandler) OnStreamClose(info *tcpassembly.StreamInfo, record *flow.FlowRecord) {
+	if !events.Listening() {
+		return
+	}
+
+	events.Publish(flowEvent(events.StreamClose, record))
+
+	if record.ConnFailure() {
+		events.Publish(flowEvent(events.ConnFailure, record))
+	}
+}
+
+func flowEvent(typ string, record *flow.FlowRecord) *events.Event {
+	return &events.Event{
+		Type:    typ,
+		Time:    record.LastSeen,
+		Iface:   record.Iface,
+		ID:      record.ID,
+		SrcIP:   record.SrcIP,
+		SrcPort: record.SrcPort,
+		DstIP:   record.DstIP,
+		DstPort: record.DstPort,
+		Reason:  record.CloseReason,
+		Flow:    record,
+	}
+}
+
+// sseKeepalive is the interval of the comments keeping idle proxies from
+// closing the stream.
+const sseKeepalive = 15 * time.Second
+
+// serveEvents streams the live events as Server-Sent Events. The events are
+// selected by type (comma separated), iface, ip, port and the expression
+// filter, see events.Filter. A subscriber that does not keep up receives an
+// overflow event and is disconnected.
+func serveEvents(w http.ResponseWriter, r *http.Request) {
+	if captures == nil {
+		writeError(w, http.StatusServiceUnavailable, fmt.Errorf("no live capture"))
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeError(w, http.StatusInternalServerError, fmt.Errorf("streaming unsupported"))
+		return
+	}
+
+	filter := &events.Filter{
+		Iface: r.FormValue("iface"),
+		IP:    r.FormValue("ip"),
+	}
+	if v := r.FormValue("type"); v != "" {
+		filter.Types = strings.Split(v, ",")
+	}
+	if v := r.FormValue("port"); v != "" {
+		port, err := strconv.Atoi(v)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("bad port %q", v))
+			return
+		}
+		filter.Port = port
+	}
+	if err := filter.SetExpr(r.FormValue("filter")); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	sub, err := events.Subscribe(filter, TConfig.Events.Buffer, TConfig.Events.MaxSubscribers)
+	if err != nil {
+		writeError(w, http.StatusServiceUnavailable, err)
+		return
+	}
+	defer events.Unsubscribe(sub)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprint(w, "retry: 3000\n\n")
+	flusher.Flush()
+
+	keepalive := time.NewTicker(sseKeepalive)
+	defer keepalive.Stop()
+
+	for {
+		select {
+		case e := <-sub.C:
+			data, err := json.Marshal(e)
+			if err != nil {
+				continue
+			}
+			if _, err = fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", e.Seq, e.Type, data); err != nil {
+				return
+			}
+		case <-sub.Overflow():
+			fmt.Fprintf(w, "event: overflow\ndata: {\"error\":\"more than %d events queued, disconnected\"}\n\n", cap(sub.C))
+			flusher.Flush()
+			return
+		case <-keepalive.C:
+			if _, err := fmt.Fprint(w, ": keepalive\n\n"); err != nil {
+				return
+			}
+		case <-r.Context().Done():
+			return
+		}
+		flusher.Flush()
+	}
+}
@@ -0,0 +1,123 @@
+// Package events fans out live events of the streams to the subscribers of
+// the admin server. Publishing never blocks: a subscriber that does not keep
+// up is disconnected.
+package events
+
+import (
+	"errors"
+	"github.com/google/gopacket"
+	"github.com/liuxp0827/Tcppass/flow"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Event types.
+const (
+	StreamOpen  = "stream_open"
+	StreamClose = "stream_close"
+	HTTP        = "http"
+	ConnFailure = "conn_failure" // the server did not answer the SYN before a RST or the timeout
+	Alert       = "alert"
+)
+
+// Event is one live event. Flow is set for StreamClose and ConnFailure, HTTP
+// for HTTP.
+type Event struct {
+	Seq     int64            `json:"seq"`
+	Type    string           `json:"type"`
+	Time    time.Time        `json:"time"`
+	Iface   string           `json:"iface,omitempty"`
+	ID      int64            `json:"id,omitempty"` // flow ID
+	SrcIP   string           `json:"srcIp,omitempty"`
+	SrcPort int              `json:"srcPort,omitempty"`
+	DstIP   string           `json:"dstIp,omitempty"`
+	DstPort int              `json:"dstPort,omitempty"`
+	Reason  string           `json:"reason,omitempty"` // close reason, or cause of an alert
+	Flow    *flow.FlowRecord `json:"flow,omitempty"`
+	HTTP    *flow.HTTPRecord `json:"http,omitempty"`
+}
+
+// SetEndpoints fills the addresses of the event from the network and
+// transport flows of the client to server direction.
+func (e *Event) SetEndpoints(net, transport gopacket.Flow) {
+	e.SrcIP, e.SrcPort, e.DstIP, e.DstPort = flow.Endpoints(net, transport)
+}
+
+// ErrTooMany is returned by Subscribe beyond the maximum of subscribers.
+var ErrTooMany = errors.New("too many event subscribers")
+
+// Subscriber receives the events matching its filter.
+type Subscriber struct {
+	C chan *Event
+
+	filter   *Filter
+	overflow chan struct{}
+	once     sync.Once
+}
+
+// Overflow is closed when the subscriber was disconnected because C was full.
+func (s *Subscriber) Overflow() <-chan struct{} {
+	return s.overflow
+}
+
+var (
+	mu          sync.RWMutex
+	subscribers = make(map[*Subscriber]bool)
+	listening   int32 // len(subscribers)
+	seq         int64
+)
+
+// Listening reports whether anyone subscribed, the events need not be built
+// otherwise.
+func Listening() bool {
+	return atomic.LoadInt32(&listening) > 0
+}
+
+// Subscribe registers a subscriber of the events matching filter, nil for all
+// of them, with buffer events queued at most. max bounds the subscribers.
+func Subscribe(filter *Filter, buffer, max int) (*Subscriber, error) {
+	s := &Subscriber{
+		C:        make(chan *Event, buffer),
+		filter:   filter,
+		overflow: make(chan struct{}),
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(subscribers) >= max {
+		return nil, ErrTooMany
+	}
+	subscribers[s] = true
+	atomic.StoreInt32(&listening, int32(len(subscribers)))
+	return s, nil
+}
+
+// Unsubscribe removes s, it receives no more events.
+func Unsubscribe(s *Subscriber) {
+	mu.Lock()
+	delete(subscribers, s)
+	atomic.StoreInt32(&listening, int32(len(subscribers)))
+	mu.Unlock()
+}
+
+// Publish hands e to the subscribers whose filter it matches.
+func Publish(e *Event) {
+	if !Listening() {
+		return
+	}
+	e.Seq = atomic.AddInt64(&seq, 1)
+
+	mu.RLock()
+	defer mu.RUnlock()
+	for s := range subscribers {
+		if s.filter != nil && !s.filter.Match(e) {
+			continue
+		}
+		select {
+		case s.C <- e:
+		default:
+			s.once.Do(func() { close(s.overflow) })
+		}
+	}
+}
@@ -0,0 +1,97 @@
+package events
+
+import (
+	"github.com/liuxp0827/Tcppass/flow"
+	"testing"
+	"time"
+)
+
+func TestFilter(t *testing.T) {
+	start := time.Unix(1500000000, 0)
+	closed := &Event{Type: StreamClose, Iface: "eth0", ID: 7, SrcIP: "10.0.0.1", SrcPort: 40000, DstIP: "10.0.0.2", DstPort: 443,
+		Reason: "rst", Flow: &flow.FlowRecord{FirstSeen: start, LastSeen: start.Add(time.Second), TxBytes: 100, RTT: &flow.RTTStats{Count: 1, Avg: 250000}}}
+	tx := &Event{Type: HTTP, Iface: "eth1", ID: 8, SrcIP: "10.0.0.3", SrcPort: 40001, DstIP: "10.0.0.2", DstPort: 80,
+		HTTP: &flow.HTTPRecord{Method: "GET", Host: "api.example.com", URL: "/v1/users", Status: 503, Latency: 1200}}
+	alert := &Event{Type: Alert, Iface: "eth0", Reason: "rst-burst"}
+
+	tests := []struct {
+		filter Filter
+		expr   string
+		want   [3]bool // closed, tx, alert
+	}{
+		{Filter{}, "", [3]bool{true, true, true}},
+		{Filter{Types: []string{HTTP, Alert}}, "", [3]bool{false, true, true}},
+		{Filter{Iface: "eth0"}, "", [3]bool{true, false, true}},
+		{Filter{IP: "10.0.0.2", Port: 443}, "", [3]bool{true, false, false}},
+		{Filter{}, "status>=500", [3]bool{false, true, false}},
+		{Filter{}, "type==http && host~example && method=GET", [3]bool{false, true, false}},
+		{Filter{}, "rtt > 200ms || reason == 'rst-burst'", [3]bool{true, false, true}},
+		{Filter{}, "latency<1ms", [3]bool{false, false, false}},
+		{Filter{}, "port!=80", [3]bool{true, false, false}},
+		{Filter{}, "ip==10.0.0.3 || bytes>=100 && duration>=1s", [3]bool{true, true, false}},
+		{Filter{Iface: "eth1"}, "id=7 || id=8", [3]bool{false, true, false}},
+	}
+	for _, test := range tests {
+		f := test.filter
+		if err := f.SetExpr(test.expr); err != nil {
+			t.Fatalf("%q: %v", test.expr, err)
+		}
+		got := [3]bool{f.Match(closed), f.Match(tx), f.Match(alert)}
+		if got != test.want {
+			t.Errorf("%+v %q matched %v, want %v", test.filter, test.expr, got, test.want)
+		}
+	}
+
+	for _, expr := range []string{"status", "nope==1", "==1", "host", "status>", "type==http &&"} {
+		var f Filter
+		if err := f.SetExpr(expr); err == nil {
+			t.Errorf("%q accepted", expr)
+		}
+	}
+}
+
+func TestSubscriberOverflow(t *testing.T) {
+	Publish(&Event{Type: Alert})
+	if Listening() {
+		t.Fatal("listening without subscribers")
+	}
+
+	fast, err := Subscribe(nil, 4, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer Unsubscribe(fast)
+	slow, err := Subscribe(&Filter{Types: []string{Alert}}, 2, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer Unsubscribe(slow)
+	if _, err := Subscribe(nil, 1, 2); err != ErrTooMany {
+		t.Fatalf("third subscriber: %v", err)
+	}
+
+	Publish(&Event{Type: StreamOpen})
+	for i := 0; i < 3; i++ {
+		Publish(&Event{Type: Alert})
+	}
+
+	if len(fast.C) != 4 {
+		t.Errorf("fast subscriber got %d events", len(fast.C))
+	}
+	if first := <-fast.C; first.Type != StreamOpen || first.Seq == 0 {
+		t.Errorf("first event %+v", first)
+	}
+	if len(slow.C) != 2 {
+		t.Errorf("slow subscriber got %d events", len(slow.C))
+	}
+	select {
+	case <-slow.Overflow():
+	default:
+		t.Error("slow subscriber not overflowed")
+	}
+	select {
+	case <-fast.Overflow():
+		t.Error("fast subscriber overflowed")
+	default:
+	}
+}
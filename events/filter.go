@@ -0,0 +1,291 @@
+package events
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Filter selects events, all the non-empty fields and the expression must
+// match.
+//
+// The expression is made of clauses like field op value, joined by && and
+// ||, && binding tighter, e.g.
+//
+//	type==http && status>=500 || type==conn_failure && port==443
+//
+// The operators are ==, !=, <, <=, >, >= and ~ for contains. ip and port
+// match either side of the connection. rtt, latency and duration are in µs,
+// or a duration like 200ms. A clause on a field the event lacks does not
+// match.
+type Filter struct {
+	Types []string // event types, all of them if empty
+	Iface string
+	IP    string // client or server ip
+	Port  int    // client or server port
+
+	expr [][]clause // ORed groups of ANDed clauses
+}
+
+type clause struct {
+	field string
+	op    string
+	value string
+	num   float64
+	isNum bool
+}
+
+// operators, longest first so that >= is not read as >.
+var operators = []string{"==", "!=", ">=", "<=", "=", ">", "<", "~"}
+
+// durationFields are in µs.
+var durationFields = map[string]bool{"rtt": true, "latency": true, "duration": true}
+
+var fields = map[string]bool{
+	"type": true, "iface": true, "id": true, "ip": true, "port": true,
+	"srcIp": true, "srcPort": true, "dstIp": true, "dstPort": true,
+	"reason": true, "dpi": true, "bytes": true, "rtt": true, "duration": true,
+	"method": true, "host": true, "url": true, "status": true, "latency": true,
+}
+
+// SetExpr parses the expression of f, an empty one matches every event.
+func (f *Filter) SetExpr(expr string) error {
+	f.expr = nil
+	if strings.TrimSpace(expr) == "" {
+		return nil
+	}
+
+	for _, group := range strings.Split(expr, "||") {
+		var clauses []clause
+		for _, s := range strings.Split(group, "&&") {
+			c, err := parseClause(strings.TrimSpace(s))
+			if err != nil {
+				return err
+			}
+			clauses = append(clauses, c)
+		}
+		f.expr = append(f.expr, clauses)
+	}
+	return nil
+}
+
+func parseClause(s string) (clause, error) {
+	var c clause
+	if i := strings.IndexAny(s, "=!<>~"); i > 0 {
+		for _, op := range operators {
+			if strings.HasPrefix(s[i:], op) {
+				c.field = strings.TrimSpace(s[:i])
+				c.op = op
+				c.value = strings.TrimSpace(s[i+len(op):])
+				break
+			}
+		}
+	}
+	if c.op == "" || c.value == "" {
+		return c, fmt.Errorf("bad clause %q, want field op value", s)
+	}
+	c.value = unquote(c.value)
+	if c.op == "=" {
+		c.op = "=="
+	}
+	if !fields[c.field] {
+		return c, fmt.Errorf("unknown field %q", c.field)
+	}
+
+	if d, err := time.ParseDuration(c.value); err == nil && durationFields[c.field] {
+		c.num, c.isNum = float64(d.Nanoseconds()/1000), true
+	} else if n, err := strconv.ParseFloat(c.value, 64); err == nil {
+		c.num, c.isNum = n, true
+	}
+	return c, nil
+}
+
+func unquote(s string) string {
+	if len(s) >= 2 && (s[0] == '"' || s[0] == '\'') && s[len(s)-1] == s[0] {
+		return s[1 : len(s)-1]
+	}
+	return s
+}
+
+// Match reports whether e is selected by f.
+func (f *Filter) Match(e *Event) bool {
+	if len(f.Types) > 0 {
+		found := false
+		for _, t := range f.Types {
+			if t == e.Type {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+
+	switch {
+	case f.Iface != "" && e.Iface != f.Iface:
+		return false
+	case f.IP != "" && e.SrcIP != f.IP && e.DstIP != f.IP:
+		return false
+	case f.Port != 0 && e.SrcPort != f.Port && e.DstPort != f.Port:
+		return false
+	}
+
+	if len(f.expr) == 0 {
+		return true
+	}
+	for _, group := range f.expr {
+		matched := true
+		for i := range group {
+			if !group[i].match(e) {
+				matched = false
+				break
+			}
+		}
+		if matched {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *clause) match(e *Event) bool {
+	values := fieldValues(e, c.field)
+	if len(values) == 0 {
+		return false
+	}
+
+	// != must hold for both sides of ip and port, the other operators for
+	// either side
+	if c.op == "!=" {
+		for _, v := range values {
+			if c.compare(v) == 0 {
+				return false
+			}
+		}
+		return true
+	}
+	for _, v := range values {
+		if c.test(v) {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *clause) test(v string) bool {
+	if c.op == "~" {
+		return strings.Contains(v, c.value)
+	}
+
+	cmp := c.compare(v)
+	switch c.op {
+	case "==":
+		return cmp == 0
+	case "<":
+		return cmp < 0
+	case "<=":
+		return cmp <= 0
+	case ">":
+		return cmp > 0
+	case ">=":
+		return cmp >= 0
+	}
+	return false
+}
+
+// compare compares v to the value of the clause, as numbers if both are.
+func (c *clause) compare(v string) int {
+	if c.isNum {
+		if n, err := strconv.ParseFloat(v, 64); err == nil {
+			switch {
+			case n < c.num:
+				return -1
+			case n > c.num:
+				return 1
+			}
+			return 0
+		}
+	}
+	return strings.Compare(v, c.value)
+}
+
+// fieldValues returns the values of field in e, none if e lacks it.
+func fieldValues(e *Event, field string) []string {
+	one := func(s string) []string {
+		if s == "" {
+			return nil
+		}
+		return []string{s}
+	}
+	itoa := func(n int64) []string { return []string{strconv.FormatInt(n, 10)} }
+
+	switch field {
+	case "type":
+		return one(e.Type)
+	case "iface":
+		return one(e.Iface)
+	case "id":
+		if e.ID != 0 {
+			return itoa(e.ID)
+		}
+	case "ip":
+		if e.SrcIP != "" {
+			return []string{e.SrcIP, e.DstIP}
+		}
+	case "port":
+		if e.SrcIP != "" {
+			return []string{strconv.Itoa(e.SrcPort), strconv.Itoa(e.DstPort)}
+		}
+	case "srcIp":
+		return one(e.SrcIP)
+	case "dstIp":
+		return one(e.DstIP)
+	case "srcPort":
+		if e.SrcIP != "" {
+			return itoa(int64(e.SrcPort))
+		}
+	case "dstPort":
+		if e.SrcIP != "" {
+			return itoa(int64(e.DstPort))
+		}
+	case "reason":
+		return one(e.Reason)
+	}
+
+	if r := e.Flow; r != nil {
+		switch field {
+		case "dpi":
+			return one(r.DPIType)
+		case "bytes":
+			return itoa(r.TxBytes + r.RxBytes)
+		case "rtt":
+			if r.RTT != nil {
+				return itoa(r.RTT.Avg)
+			}
+		case "duration":
+			return itoa(r.Duration().Nanoseconds() / 1000)
+		case "status":
+			if r.HTTPStatus != 0 {
+				return itoa(int64(r.HTTPStatus))
+			}
+		}
+	}
+
+	if r := e.HTTP; r != nil {
+		switch field {
+		case "method":
+			return one(r.Method)
+		case "host":
+			return one(r.Host)
+		case "url":
+			return one(r.URL)
+		case "status":
+			return itoa(int64(r.Status))
+		case "latency":
+			return itoa(r.Latency)
+		}
+	}
+	return nil
+}
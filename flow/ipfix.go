@@ -0,0 +1,412 @@
+package flow
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/liuxp0827/Tcppass/common/json"
+	"github.com/liuxp0827/Tcppass/common/log"
+	"net"
+	"time"
+)
+
+const (
+	ipfixVersion     = 10
+	ipfixHeaderLen   = 16
+	ipfixSetHeader   = 4
+	ipfixTemplateSet = 2
+
+	templateIPv4 = 256
+	templateIPv6 = 257
+
+	// reversePEN qualifies the reverse direction of a biflow, RFC 5103.
+	reversePEN = 29305
+	// documentationPEN is the enterprise number reserved for documentation,
+	// RFC 5612, to be replaced by the one of the deployment.
+	documentationPEN = 32473
+)
+
+// IANA information elements.
+const (
+	ieOctetDeltaCount          = 1
+	iePacketDeltaCount         = 2
+	ieProtocolIdentifier       = 4
+	ieSourceTransportPort      = 7
+	ieSourceIPv4Address        = 8
+	ieDestinationTransportPort = 11
+	ieDestinationIPv4Address   = 12
+	ieSourceIPv6Address        = 27
+	ieDestinationIPv6Address   = 28
+	ieFlowEndReason            = 136
+	ieFlowID                   = 148
+	ieFlowStartMilliseconds    = 152
+	ieFlowEndMilliseconds      = 153
+)
+
+// Enterprise-specific information elements of Tcppass, the RTTs are in µs
+// and 0 when unknown.
+const (
+	ieRTTMin               = 1
+	ieRTTAvg               = 2
+	ieRTTMax               = 3
+	ieRTTJitter            = 4
+	ieRetransOctets        = 5
+	ieReverseRetransOctets = 6
+	ieHTTPStatus           = 7
+	ieLostOctets           = 8
+)
+
+// flowEndReason values.
+const (
+	endIdleTimeout   = 1
+	endActiveTimeout = 2
+	endOfFlow        = 3
+	endForced        = 4
+)
+
+type ipfixField struct {
+	id     uint16
+	length uint16
+	pen    uint32 // 0 for an IANA element
+}
+
+// ipfixWriter implements Sink.
+// It exports the flow records as IPFIX (RFC 7011) messages over UDP or TCP.
+// The HTTP transactions are not exported, the last status of a stream is an
+// element of its flow record.
+type ipfixWriter struct {
+	Network string `json:"network"` // udp or tcp
+	Addr    string `json:"addr"`    // collector host:port
+	Domain  uint32 `json:"domain"`  // observation domain ID
+	PEN     uint32 `json:"pen"`     // private enterprise number of the Tcppass elements
+	MTU     int    `json:"mtu"`     // maximum size of a message
+
+	// Resend the templates every TemplateRefresh seconds over UDP
+	TemplateRefresh int `json:"templateRefresh"`
+
+	conn         net.Conn
+	seq          uint32 // data records sent
+	templateSent time.Time
+	templates    map[uint16][]ipfixField
+
+	sets    map[uint16][]byte // data records waiting for the next message
+	order   []uint16
+	size    int
+	records uint32
+}
+
+func newIPFIXWriter() Sink {
+	return &ipfixWriter{
+		Network:         "udp",
+		PEN:             documentationPEN,
+		MTU:             1400,
+		TemplateRefresh: 600,
+	}
+}
+
+// Init ipfix sink with json config.
+// config like:
+//
+//	{
+//	"network":"udp",
+//	"addr":"10.0.0.1:4739",
+//	"domain":1,
+//	"pen":32473,
+//	"mtu":1400,
+//	"templateRefresh":600
+//	}
+func (w *ipfixWriter) Init(config string) error {
+	if len(config) > 0 {
+		if err := json.Unmarshal([]byte(config), w); err != nil {
+			return err
+		}
+	}
+	if len(w.Addr) == 0 {
+		return errors.New("config must have addr")
+	}
+	if w.Network != "udp" && w.Network != "tcp" {
+		return fmt.Errorf("unknown network %q", w.Network)
+	}
+	if w.MTU < 512 {
+		w.MTU = 512
+	}
+
+	if _, _, err := net.SplitHostPort(w.Addr); err != nil {
+		return err
+	}
+
+	w.templates = ipfixTemplates(w.PEN)
+	w.sets = make(map[uint16][]byte)
+	if err := w.dial(); err != nil {
+		// the collector may come up later, write dials again
+		log.Warnf("ipfix collector %s: %v", w.Addr, err)
+	}
+	return nil
+}
+
+func ipfixTemplates(pen uint32) map[uint16][]ipfixField {
+	common := []ipfixField{
+		{ieSourceTransportPort, 2, 0},
+		{ieDestinationTransportPort, 2, 0},
+		{ieProtocolIdentifier, 1, 0},
+		{ieFlowID, 8, 0},
+		{ieFlowStartMilliseconds, 8, 0},
+		{ieFlowEndMilliseconds, 8, 0},
+		{ieFlowEndReason, 1, 0},
+		{ieOctetDeltaCount, 8, 0},
+		{iePacketDeltaCount, 8, 0},
+		{ieOctetDeltaCount, 8, reversePEN},
+		{iePacketDeltaCount, 8, reversePEN},
+		{ieRTTMin, 4, pen},
+		{ieRTTAvg, 4, pen},
+		{ieRTTMax, 4, pen},
+		{ieRTTJitter, 4, pen},
+		{ieRetransOctets, 8, pen},
+		{ieReverseRetransOctets, 8, pen},
+		{ieHTTPStatus, 2, pen},
+		{ieLostOctets, 8, pen},
+	}
+
+	v4 := append([]ipfixField{{ieSourceIPv4Address, 4, 0}, {ieDestinationIPv4Address, 4, 0}}, common...)
+	v6 := append([]ipfixField{{ieSourceIPv6Address, 16, 0}, {ieDestinationIPv6Address, 16, 0}}, common...)
+	return map[uint16][]ipfixField{templateIPv4: v4, templateIPv6: v6}
+}
+
+func (w *ipfixWriter) dial() error {
+	conn, err := net.DialTimeout(w.Network, w.Addr, 5*time.Second)
+	if err != nil {
+		return err
+	}
+	w.conn = conn
+	w.templateSent = time.Time{}
+	return nil
+}
+
+func (w *ipfixWriter) WriteFlow(r *FlowRecord) error {
+	id, rec := encodeIPFIX(r)
+	if rec == nil {
+		return fmt.Errorf("flow %d has no IP address", r.ID)
+	}
+
+	need := len(rec)
+	if _, ok := w.sets[id]; !ok {
+		need += ipfixSetHeader
+	}
+	if w.size > 0 && ipfixHeaderLen+w.size+need > w.MTU {
+		if err := w.send(); err != nil {
+			return err
+		}
+		need = len(rec) + ipfixSetHeader
+	}
+
+	if _, ok := w.sets[id]; !ok {
+		w.order = append(w.order, id)
+	}
+	w.sets[id] = append(w.sets[id], rec...)
+	w.size += need
+	w.records++
+	return nil
+}
+
+func (w *ipfixWriter) WriteHTTP(r *HTTPRecord) error {
+	return nil
+}
+
+// encodeIPFIX returns the template and the data record of r.
+func encodeIPFIX(r *FlowRecord) (uint16, []byte) {
+	src, dst := net.ParseIP(r.SrcIP), net.ParseIP(r.DstIP)
+	if src == nil || dst == nil {
+		return 0, nil
+	}
+
+	var id uint16
+	var b []byte
+	if src4, dst4 := src.To4(), dst.To4(); src4 != nil && dst4 != nil {
+		id = templateIPv4
+		b = append(append(b, src4...), dst4...)
+	} else {
+		id = templateIPv6
+		b = append(append(b, src.To16()...), dst.To16()...)
+	}
+
+	proto := uint8(6)
+	if r.Kind == KindUDP {
+		proto = 17
+	}
+
+	b = appendUint16(b, uint16(r.SrcPort))
+	b = appendUint16(b, uint16(r.DstPort))
+	b = append(b, proto)
+	b = appendUint64(b, uint64(r.ID))
+	b = appendUint64(b, uint64(r.FirstSeen.UnixNano()/int64(time.Millisecond)))
+	b = appendUint64(b, uint64(r.LastSeen.UnixNano()/int64(time.Millisecond)))
+	b = append(b, endReason(r))
+	b = appendUint64(b, uint64(r.TxBytes))
+	b = appendUint64(b, uint64(r.TxPackets))
+	b = appendUint64(b, uint64(r.RxBytes))
+	b = appendUint64(b, uint64(r.RxPackets))
+
+	var rtt RTTStats
+	if r.RTT != nil {
+		rtt = *r.RTT
+	}
+	b = appendUint32(b, microseconds32(rtt.Min))
+	b = appendUint32(b, microseconds32(rtt.Avg))
+	b = appendUint32(b, microseconds32(rtt.Max))
+	b = appendUint32(b, microseconds32(rtt.Jitter))
+	b = appendUint64(b, uint64(r.TxRetransBytes))
+	b = appendUint64(b, uint64(r.RxRetransBytes))
+	b = appendUint16(b, uint16(r.HTTPStatus))
+	b = appendUint64(b, uint64(r.CaptureLoss))
+	return id, b
+}
+
+func endReason(r *FlowRecord) uint8 {
+	if !r.Final {
+		return endActiveTimeout
+	}
+	switch r.CloseReason {
+	case "", "timeout":
+		return endIdleTimeout
+	case "fin", "rst", "reuse":
+		return endOfFlow
+	}
+	return endForced
+}
+
+func microseconds32(us int64) uint32 {
+	if us < 0 {
+		return 0
+	}
+	if us > 0xFFFFFFFF {
+		return 0xFFFFFFFF
+	}
+	return uint32(us)
+}
+
+// send writes the pending data records as one message, after the templates
+// if the collector has not got them yet.
+func (w *ipfixWriter) send() error {
+	if w.records == 0 {
+		return nil
+	}
+
+	msg := w.header(ipfixHeaderLen + w.size)
+	for _, id := range w.order {
+		msg = appendUint16(msg, id)
+		msg = appendUint16(msg, uint16(ipfixSetHeader+len(w.sets[id])))
+		msg = append(msg, w.sets[id]...)
+	}
+	records := w.records
+
+	for id := range w.sets {
+		delete(w.sets, id)
+	}
+	w.order = w.order[:0]
+	w.size = 0
+	w.records = 0
+
+	if err := w.sendTemplates(); err != nil {
+		return err
+	}
+	if err := w.write(msg); err != nil {
+		return err
+	}
+	w.seq += records
+	return nil
+}
+
+func (w *ipfixWriter) sendTemplates() error {
+	if w.conn != nil && !w.templateSent.IsZero() &&
+		(w.Network == "tcp" || time.Since(w.templateSent) < time.Duration(w.TemplateRefresh)*time.Second) {
+		return nil
+	}
+
+	var set []byte
+	for _, id := range []uint16{templateIPv4, templateIPv6} {
+		fields := w.templates[id]
+		set = appendUint16(set, id)
+		set = appendUint16(set, uint16(len(fields)))
+		for _, f := range fields {
+			if f.pen != 0 {
+				set = appendUint16(set, f.id|0x8000)
+				set = appendUint16(set, f.length)
+				set = appendUint32(set, f.pen)
+			} else {
+				set = appendUint16(set, f.id)
+				set = appendUint16(set, f.length)
+			}
+		}
+	}
+
+	msg := w.header(ipfixHeaderLen + ipfixSetHeader + len(set))
+	msg = appendUint16(msg, ipfixTemplateSet)
+	msg = appendUint16(msg, uint16(ipfixSetHeader+len(set)))
+	msg = append(msg, set...)
+
+	if err := w.write(msg); err != nil {
+		return err
+	}
+	w.templateSent = time.Now()
+	return nil
+}
+
+func (w *ipfixWriter) header(length int) []byte {
+	msg := make([]byte, 0, length)
+	msg = appendUint16(msg, ipfixVersion)
+	msg = appendUint16(msg, uint16(length))
+	msg = appendUint32(msg, uint32(time.Now().Unix()))
+	msg = appendUint32(msg, w.seq)
+	msg = appendUint32(msg, w.Domain)
+	return msg
+}
+
+// write sends msg, the connection is dialed again after a failure.
+func (w *ipfixWriter) write(msg []byte) error {
+	if w.conn == nil {
+		if err := w.dial(); err != nil {
+			return err
+		}
+	}
+
+	w.conn.SetWriteDeadline(time.Now().Add(5 * time.Second))
+	if _, err := w.conn.Write(msg); err != nil {
+		w.conn.Close()
+		w.conn = nil
+		return err
+	}
+	return nil
+}
+
+func appendUint16(b []byte, v uint16) []byte {
+	return append(b, byte(v>>8), byte(v))
+}
+
+func appendUint32(b []byte, v uint32) []byte {
+	return append(b, byte(v>>24), byte(v>>16), byte(v>>8), byte(v))
+}
+
+func appendUint64(b []byte, v uint64) []byte {
+	var buf [8]byte
+	binary.BigEndian.PutUint64(buf[:], v)
+	return append(b, buf[:]...)
+}
+
+// Destroy closes the connection to the collector.
+func (w *ipfixWriter) Destroy() {
+	if w.conn != nil {
+		w.conn.Close()
+		w.conn = nil
+	}
+}
+
+// Flush sends the pending records.
+func (w *ipfixWriter) Flush() {
+	if err := w.send(); err != nil {
+		log.Warnf("ipfix export to %s failed, %v", w.Addr, err)
+	}
+}
+
+func init() {
+	Register("ipfix", newIPFIXWriter)
+}
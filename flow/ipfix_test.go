@@ -0,0 +1,139 @@
+package flow
+
+import (
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+)
+
+// readIPFIX reads one message and returns its sets by set ID.
+func readIPFIX(t *testing.T, conn net.PacketConn) map[uint16][]byte {
+	buf := make([]byte, 65536)
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	n, _, err := conn.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg := buf[:n]
+	if v := binary.BigEndian.Uint16(msg); v != ipfixVersion {
+		t.Fatalf("version %d", v)
+	}
+	if l := int(binary.BigEndian.Uint16(msg[2:])); l != n {
+		t.Fatalf("message length %d, read %d", l, n)
+	}
+
+	sets := make(map[uint16][]byte)
+	for rest := msg[ipfixHeaderLen:]; len(rest) > 0; {
+		id, l := binary.BigEndian.Uint16(rest), int(binary.BigEndian.Uint16(rest[2:]))
+		sets[id] = rest[ipfixSetHeader:l]
+		rest = rest[l:]
+	}
+	return sets
+}
+
+// parseTemplates returns the fields of the templates of a template set.
+func parseTemplates(set []byte) map[uint16][]ipfixField {
+	templates := make(map[uint16][]ipfixField)
+	for len(set) > 0 {
+		id, count := binary.BigEndian.Uint16(set), int(binary.BigEndian.Uint16(set[2:]))
+		set = set[4:]
+		for i := 0; i < count; i++ {
+			f := ipfixField{id: binary.BigEndian.Uint16(set), length: binary.BigEndian.Uint16(set[2:])}
+			set = set[4:]
+			if f.id&0x8000 != 0 {
+				f.id &^= 0x8000
+				f.pen = binary.BigEndian.Uint32(set)
+				set = set[4:]
+			}
+			templates[id] = append(templates[id], f)
+		}
+	}
+	return templates
+}
+
+// field returns the value of the element id of pen in the data record rec.
+func field(fields []ipfixField, rec []byte, id uint16, pen uint32) uint64 {
+	for _, f := range fields {
+		if f.id == id && f.pen == pen {
+			var v uint64
+			for _, b := range rec[:f.length] {
+				v = v<<8 | uint64(b)
+			}
+			return v
+		}
+		rec = rec[f.length:]
+	}
+	return 0
+}
+
+func TestIPFIXExport(t *testing.T) {
+	collector, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer collector.Close()
+
+	w := newIPFIXWriter().(*ipfixWriter)
+	if err := w.Init(`{"addr":"` + collector.LocalAddr().String() + `","domain":7}`); err != nil {
+		t.Fatal(err)
+	}
+	defer w.Destroy()
+
+	start := time.Unix(1500000000, 0)
+	r := &FlowRecord{
+		Kind: KindTCP, ID: 42, SrcIP: "10.0.0.1", SrcPort: 40000, DstIP: "10.0.0.2", DstPort: 443,
+		FirstSeen: start, LastSeen: start.Add(time.Second), Final: true, CloseReason: "fin",
+		TxBytes: 1000, TxPackets: 10, RxBytes: 50000, RxPackets: 40, RxRetransBytes: 1460,
+		RTT: &RTTStats{Min: 800, Avg: 1200, Max: 3000}, HTTPStatus: 200,
+	}
+	if err := w.WriteFlow(r); err != nil {
+		t.Fatal(err)
+	}
+	w.Flush()
+
+	sets := readIPFIX(t, collector)
+	templates := parseTemplates(sets[ipfixTemplateSet])
+	if len(templates) != 2 {
+		t.Fatalf("got %d templates", len(templates))
+	}
+
+	sets = readIPFIX(t, collector)
+	rec, fields := sets[templateIPv4], templates[templateIPv4]
+	if rec == nil {
+		t.Fatal("no IPv4 data set")
+	}
+	checks := []struct {
+		id   uint16
+		pen  uint32
+		want uint64
+	}{
+		{ieSourceIPv4Address, 0, 0x0A000001},
+		{ieDestinationTransportPort, 0, 443},
+		{ieProtocolIdentifier, 0, 6},
+		{ieFlowID, 0, 42},
+		{ieFlowEndMilliseconds, 0, 1500000001000},
+		{ieFlowEndReason, 0, endOfFlow},
+		{ieOctetDeltaCount, 0, 1000},
+		{ieOctetDeltaCount, reversePEN, 50000},
+		{ieRTTAvg, documentationPEN, 1200},
+		{ieReverseRetransOctets, documentationPEN, 1460},
+		{ieHTTPStatus, documentationPEN, 200},
+	}
+	for _, c := range checks {
+		if got := field(fields, rec, c.id, c.pen); got != c.want {
+			t.Errorf("element %d/%d = %d, want %d", c.pen, c.id, got, c.want)
+		}
+	}
+
+	// the templates are sent again once the refresh interval elapsed
+	w.templateSent = time.Now().Add(-time.Hour)
+	w.WriteFlow(r)
+	w.Flush()
+	if sets := readIPFIX(t, collector); sets[ipfixTemplateSet] == nil {
+		t.Error("templates not refreshed")
+	}
+	if sets := readIPFIX(t, collector); sets[templateIPv4] == nil {
+		t.Error("no data after the templates")
+	}
+}
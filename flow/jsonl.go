@@ -0,0 +1,298 @@
+package flow
+
+import (
+	"bufio"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"github.com/liuxp0827/Tcppass/common/json"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// jsonlWriter implements Sink.
+// It writes one JSON object per record and line, and rotates the file by
+// size or daily like the file logger.
+type jsonlWriter struct {
+	sync.Mutex
+	Filename   string `json:"filename"`
+	file       *os.File
+	fileWriter *bufio.Writer
+
+	// Rotate at size
+	MaxSize        int `json:"maxsize"`
+	maxSizeCurSize int
+
+	// Rotate daily
+	Daily         bool  `json:"daily"`
+	MaxDays       int64 `json:"maxdays"`
+	dailyOpenDate int
+
+	Rotate bool `json:"rotate"`
+
+	// Gzip the rotated files
+	Compress bool `json:"compress"`
+
+	Perm os.FileMode `json:"perm"`
+}
+
+func newJSONLWriter() Sink {
+	return &jsonlWriter{
+		MaxSize: 1 << 30, //1024 MB
+		Daily:   true,
+		MaxDays: 7,
+		Rotate:  true,
+		Perm:    0660,
+	}
+}
+
+// Init jsonl sink with json config.
+// config like:
+//	{
+//	"filename":"flows/flows.jsonl",
+//	"maxsize":1<<30,
+//	"daily":true,
+//	"maxdays":15,
+//	"rotate":true,
+//	"compress":true,
+//	"perm":0600
+//	}
+func (w *jsonlWriter) Init(config string) error {
+	if len(config) > 0 {
+		if err := json.Unmarshal([]byte(config), w); err != nil {
+			return err
+		}
+	}
+	if len(w.Filename) == 0 {
+		return errors.New("config must have filename")
+	}
+	if dir := filepath.Dir(w.Filename); dir != "" {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return err
+		}
+	}
+	return w.startFile()
+}
+
+func (w *jsonlWriter) startFile() error {
+	file, err := os.OpenFile(w.Filename, os.O_WRONLY|os.O_APPEND|os.O_CREATE, w.Perm)
+	if err != nil {
+		return err
+	}
+	fInfo, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return fmt.Errorf("get stat err: %s", err)
+	}
+
+	w.file = file
+	w.fileWriter = bufio.NewWriterSize(file, 64*1024)
+	w.maxSizeCurSize = int(fInfo.Size())
+	w.dailyOpenDate = time.Now().Day()
+	return nil
+}
+
+func (w *jsonlWriter) needRotate(day int) bool {
+	return (w.MaxSize > 0 && w.maxSizeCurSize >= w.MaxSize) ||
+		(w.Daily && day != w.dailyOpenDate)
+}
+
+func (w *jsonlWriter) WriteFlow(r *FlowRecord) error {
+	return w.write(r)
+}
+
+func (w *jsonlWriter) WriteHTTP(r *HTTPRecord) error {
+	return w.write(r)
+}
+
+func (w *jsonlWriter) write(r interface{}) error {
+	line, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	w.Lock()
+	defer w.Unlock()
+
+	if w.Rotate && w.needRotate(time.Now().Day()) {
+		if err := w.doRotate(); err != nil {
+			fmt.Fprintf(os.Stderr, "jsonlWriter(%q): %s\n", w.Filename, err)
+		}
+	}
+
+	if w.fileWriter == nil {
+		return errors.New("file is not open")
+	}
+	n, err := w.fileWriter.Write(line)
+	w.maxSizeCurSize += n
+	return err
+}
+
+// doRotate moves the file to a name like xx.2013-01-01.001.jsonl and opens
+// a new one.
+func (w *jsonlWriter) doRotate() error {
+	if _, err := os.Lstat(w.Filename); err != nil {
+		return err
+	}
+
+	num := 1
+	fName := ""
+	suffix := filepath.Ext(w.Filename)
+	filenameOnly := strings.TrimSuffix(w.Filename, suffix)
+	if suffix == "" {
+		suffix = ".jsonl"
+	}
+	var err error
+	for ; err == nil && num <= 999; num++ {
+		fName = filenameOnly + fmt.Sprintf(".%s.%03d%s", time.Now().Format("2006-01-02"), num, suffix)
+		if _, err = os.Lstat(fName); err == nil {
+			continue
+		}
+		// 压缩后的文件也占用这个编号
+		_, err = os.Lstat(fName + ".gz")
+	}
+	if err == nil {
+		return fmt.Errorf("Rotate: Cannot find free number to rename %s", w.Filename)
+	}
+
+	w.fileWriter.Flush()
+	w.file.Close()
+	w.file, w.fileWriter = nil, nil
+
+	// even if the rename fails the records MUST go on to a new file
+	renameErr := os.Rename(w.Filename, fName)
+	startErr := w.startFile()
+	if renameErr == nil && w.Compress {
+		go compressFile(fName)
+	}
+	go w.deleteOld()
+
+	if startErr != nil {
+		return fmt.Errorf("Rotate StartFile: %s", startErr)
+	}
+	if renameErr != nil {
+		return fmt.Errorf("Rotate: %s", renameErr)
+	}
+	return nil
+}
+
+// compressFile replaces name by name.gz.
+func compressFile(name string) {
+	if err := gzipFile(name); err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to compress '%s', error: %v\n", name, err)
+		os.Remove(name + ".gz")
+		return
+	}
+	os.Remove(name)
+}
+
+func gzipFile(name string) error {
+	src, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	fInfo, err := src.Stat()
+	if err != nil {
+		return err
+	}
+	dst, err := os.OpenFile(name+".gz", os.O_WRONLY|os.O_CREATE|os.O_TRUNC, fInfo.Mode())
+	if err != nil {
+		return err
+	}
+
+	zw := gzip.NewWriter(dst)
+	if _, err = io.Copy(zw, src); err == nil {
+		err = zw.Close()
+	}
+	if cerr := dst.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// deleteOld removes the rotated files older than MaxDays, only the names
+// doRotate gives are considered.
+func (w *jsonlWriter) deleteOld() {
+	if w.MaxDays <= 0 {
+		return
+	}
+	dir := filepath.Dir(w.Filename)
+	base := filepath.Base(w.Filename)
+	filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return nil
+		}
+		if info.IsDir() {
+			if path != dir {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if info.ModTime().Unix() < time.Now().Unix()-60*60*24*w.MaxDays && rotatedName(base, info.Name()) {
+			os.Remove(path)
+		}
+		return nil
+	})
+}
+
+// rotatedName reports whether name is a rotated file of base, i.e.
+// <stem>.YYYY-MM-DD.NNN<ext> or the same with .gz.
+func rotatedName(base, name string) bool {
+	suffix := filepath.Ext(base)
+	stem := strings.TrimSuffix(base, suffix)
+	if suffix == "" {
+		suffix = ".jsonl"
+	}
+
+	name = strings.TrimSuffix(name, ".gz")
+	if len(name) < len(stem)+1+len(suffix) || !strings.HasPrefix(name, stem+".") || !strings.HasSuffix(name, suffix) {
+		return false
+	}
+	rest := name[len(stem)+1 : len(name)-len(suffix)]
+	if len(rest) != len("2006-01-02.001") || rest[10] != '.' {
+		return false
+	}
+	if _, err := time.Parse("2006-01-02", rest[:10]); err != nil {
+		return false
+	}
+	for _, c := range rest[11:] {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// Destroy flushes and closes the file.
+func (w *jsonlWriter) Destroy() {
+	w.Lock()
+	defer w.Unlock()
+
+	if w.file != nil {
+		w.fileWriter.Flush()
+		w.file.Close()
+		w.file, w.fileWriter = nil, nil
+	}
+}
+
+// Flush writes the buffered records and syncs the file to disk.
+func (w *jsonlWriter) Flush() {
+	w.Lock()
+	defer w.Unlock()
+
+	if w.file != nil {
+		w.fileWriter.Flush()
+		w.file.Sync()
+	}
+}
+
+func init() {
+	Register("jsonl", newJSONLWriter)
+}
@@ -0,0 +1,119 @@
+package flow
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+	"time"
+)
+
+func listDir(t *testing.T, dir string) []string {
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, info := range infos {
+		names = append(names, info.Name())
+	}
+	sort.Strings(names)
+	return names
+}
+
+func TestJSONLRotate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "jsonl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	today := time.Now().Format("2006-01-02")
+	name := filepath.Join(dir, "flows.jsonl")
+	// 001已被压缩过的文件占用
+	if err := ioutil.WriteFile(filepath.Join(dir, "flows."+today+".001.jsonl.gz"), nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	w := newJSONLWriter().(*jsonlWriter)
+	if err := w.Init(fmt.Sprintf(`{"filename":%q,"maxsize":100,"daily":false,"compress":true}`, name)); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		if err := w.WriteFlow(&FlowRecord{Kind: KindTCP, ID: int64(i + 1), SrcIP: "10.0.0.1", DstIP: "10.0.0.2"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	w.Destroy()
+
+	// 每条记录都超过100字节，写第2、3条前各轮转一次，压缩在后台进行
+	want := []string{"flows." + today + ".001.jsonl.gz", "flows." + today + ".002.jsonl.gz", "flows." + today + ".003.jsonl.gz", "flows.jsonl"}
+	var got []string
+	for deadline := time.Now().Add(2 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if got = listDir(t, dir); fmt.Sprint(got) == fmt.Sprint(want) {
+			break
+		}
+	}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Fatalf("files %q, want %q", got, want)
+	}
+
+	data, err := ioutil.ReadFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(data) == 0 || data[len(data)-1] != '\n' {
+		t.Errorf("current file %q", data)
+	}
+}
+
+func TestJSONLDeleteOld(t *testing.T) {
+	dir, err := ioutil.TempDir("", "jsonl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	old := time.Now().Add(-10 * 24 * time.Hour)
+	files := map[string]bool{ // name: deleted
+		"flows.jsonl":                    false,
+		"flows.2020-01-01.001.jsonl":     true,
+		"flows.2020-01-01.002.jsonl.gz":  true,
+		"flows.2020-01-01.001.jsonl.1":   false,
+		"flows.2020-01-01.1.jsonl":       false,
+		"flows.2020-13-01.001.jsonl":     false,
+		"flows.backup.jsonl":             false,
+		"flowsx.2020-01-01.001.jsonl":    false,
+		"flows.2020-01-01.001.csv":       false,
+		"sub/flows.2020-01-01.001.jsonl": false,
+	}
+	if err := os.Mkdir(filepath.Join(dir, "sub"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	for name := range files {
+		path := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(path, nil, 0600); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(path, old, old); err != nil {
+			t.Fatal(err)
+		}
+	}
+	recent := filepath.Join(dir, "flows.2030-01-01.001.jsonl")
+	if err := ioutil.WriteFile(recent, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	files["flows.2030-01-01.001.jsonl"] = false
+
+	w := &jsonlWriter{Filename: filepath.Join(dir, "flows.jsonl"), MaxDays: 7}
+	w.deleteOld()
+
+	for name, deleted := range files {
+		_, err := os.Stat(filepath.Join(dir, name))
+		if exists := err == nil; exists == deleted {
+			t.Errorf("%s: exists %v", name, exists)
+		}
+	}
+}
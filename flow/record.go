@@ -0,0 +1,135 @@
+// Package flow defines the structured records of the streams and the sinks
+// they are written to.
+package flow
+
+import (
+	"encoding/binary"
+	"github.com/google/gopacket"
+	"sync/atomic"
+	"time"
+)
+
+// Record kinds.
+const (
+	KindTCP  = "tcp"
+	KindHTTP = "http"
+	KindUDP  = "udp"
+)
+
+var lastID int64
+
+// NextID returns a new flow ID, the TCP streams and the UDP flows share them
+// so that the records of either kind never collide.
+func NextID() int64 {
+	return atomic.AddInt64(&lastID, 1)
+}
+
+// FlowRecord is the summary of a TCP stream or a UDP flow. Tx is the client
+// to server direction, Rx the server to client direction. An interim record
+// of a long-lived stream counts the interval from FirstSeen to LastSeen since
+// the previous record, without the retransmissions and the capture loss; the
+// final record counts the whole stream.
+type FlowRecord struct {
+	Kind      string    `json:"kind"`
+	ID        int64     `json:"id"`
+	Iface     string    `json:"iface"`
+	SrcIP     string    `json:"srcIp"`
+	SrcPort   int       `json:"srcPort"`
+	DstIP     string    `json:"dstIp"`
+	DstPort   int       `json:"dstPort"`
+	FirstSeen time.Time `json:"firstSeen"`
+	LastSeen  time.Time `json:"lastSeen"`
+	Final     bool      `json:"final"` // false for an interim record
+
+	TxBytes   int64 `json:"txBytes"`
+	TxPackets int64 `json:"txPackets"`
+	RxBytes   int64 `json:"rxBytes"`
+	RxPackets int64 `json:"rxPackets"`
+
+	TxRetransBytes int64 `json:"txRetransBytes,omitempty"`
+	RxRetransBytes int64 `json:"rxRetransBytes,omitempty"`
+	CaptureLoss    int64 `json:"captureLoss,omitempty"` // bytes missing from the capture
+
+	RTT *RTTStats `json:"rtt,omitempty"`
+
+	IdleTime   int64 `json:"idleTime,omitempty"`   // µs in the gaps of 1s or more between packets
+	ActiveTime int64 `json:"activeTime,omitempty"` // µs
+	Gaps       int64 `json:"gaps,omitempty"`       // gaps of 1s or more
+	LongestGap int64 `json:"longestGap,omitempty"` // µs
+	Keepalives int64 `json:"keepalives,omitempty"` // keepalive probes of both directions
+
+	DPIType       string `json:"dpiType,omitempty"`
+	HTTPStatus    int    `json:"httpStatus,omitempty"` // last HTTP response status
+	CloseReason   string `json:"closeReason,omitempty"`
+	Asymmetry     string `json:"asymmetry,omitempty"`
+	LowConfidence bool   `json:"lowConfidence,omitempty"`
+	SamplingRate  uint32 `json:"samplingRate,omitempty"`
+	Unanswered    bool   `json:"unanswered,omitempty"` // no SYN-ACK to the SYN of the client
+}
+
+// ConnFailure tells whether the client failed to connect: the server did not
+// answer its SYN before a RST or the timeout. A refused connection, answered
+// by a RST, is one; a capture seeing only the client cannot tell.
+func (r *FlowRecord) ConnFailure() bool {
+	return (r.CloseReason == "rst" || r.CloseReason == "timeout") && r.Unanswered && r.Asymmetry == ""
+}
+
+// RTTStats are the RTT samples of a stream in µs.
+type RTTStats struct {
+	Estimator string `json:"estimator"` // seq or ts
+	Count     int64  `json:"count"`
+	First     int64  `json:"first"`
+	Min       int64  `json:"min"`
+	Max       int64  `json:"max"`
+	Avg       int64  `json:"avg"`
+	P50       int64  `json:"p50"`
+	P90       int64  `json:"p90"`
+	P99       int64  `json:"p99"`
+	Jitter    int64  `json:"jitter"`
+}
+
+// HTTPRecord is one HTTP transaction of a stream.
+type HTTPRecord struct {
+	Kind    string    `json:"kind"`
+	FlowID  int64     `json:"flowId"`
+	Iface   string    `json:"iface"`
+	SrcIP   string    `json:"srcIp"`
+	SrcPort int       `json:"srcPort"`
+	DstIP   string    `json:"dstIp"`
+	DstPort int       `json:"dstPort"`
+	Time    time.Time `json:"time"` // time of the request
+	Method  string    `json:"method"`
+	Host    string    `json:"host"`
+	URL     string    `json:"url"`
+	Status  int       `json:"status"`
+	Latency int64     `json:"latency"` // µs from the request to the response
+}
+
+// Duration returns the time between the first and the last packet.
+func (r *FlowRecord) Duration() time.Duration {
+	return r.LastSeen.Sub(r.FirstSeen)
+}
+
+// Endpoints returns the addresses of the network and transport flows of the
+// client to server direction, the ports are 0 if transport has none.
+func Endpoints(net, transport gopacket.Flow) (srcIP string, srcPort int, dstIP string, dstPort int) {
+	return net.Src().String(), port(transport.Src()), net.Dst().String(), port(transport.Dst())
+}
+
+// SetEndpoints fills the addresses of the record from the network and
+// transport flows of the client to server direction.
+func (r *FlowRecord) SetEndpoints(net, transport gopacket.Flow) {
+	r.SrcIP, r.SrcPort, r.DstIP, r.DstPort = Endpoints(net, transport)
+}
+
+// SetEndpoints is FlowRecord.SetEndpoints for an HTTP transaction.
+func (r *HTTPRecord) SetEndpoints(net, transport gopacket.Flow) {
+	r.SrcIP, r.SrcPort, r.DstIP, r.DstPort = Endpoints(net, transport)
+}
+
+func port(e gopacket.Endpoint) int {
+	if raw := e.Raw(); len(raw) == 2 {
+		return int(binary.BigEndian.Uint16(raw))
+	}
+	return 0
+}
@@ -0,0 +1,285 @@
+package flow
+
+import (
+	"fmt"
+	. "github.com/liuxp0827/Tcppass/common/config"
+	"github.com/liuxp0827/Tcppass/common/log"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type sinkType func() Sink
+
+// Sink defines the behavior of an output of the flow records.
+type Sink interface {
+	Init(config string) error
+	WriteFlow(r *FlowRecord) error
+	WriteHTTP(r *HTTPRecord) error
+	Destroy()
+	Flush()
+}
+
+var adapters = make(map[string]sinkType)
+
+// Register makes a sink available by the provided name.
+// If Register is called twice with the same name or if sink is nil,
+// it panics.
+func Register(name string, sink sinkType) {
+	if sink == nil {
+		panic("flow: Register sink is nil")
+	}
+	if _, dup := adapters[name]; dup {
+		panic("flow: Register called twice for sink " + name)
+	}
+	adapters[name] = sink
+}
+
+// SinkStat counts the records of one configured sink.
+type SinkStat struct {
+	Name    string `json:"name"`
+	Written int64  `json:"written"`
+	Dropped int64  `json:"dropped"` // queue full
+	Failed  int64  `json:"failed"`  // write errors
+}
+
+// output runs one configured sink from its own goroutine, the records are
+// queued so that a slow sink never blocks the streams.
+type output struct {
+	Sink
+	name    string
+	kinds   map[string]bool
+	filter  *FlowFilter
+	records chan interface{}
+	exited  chan struct{}
+
+	written int64
+	dropped int64
+	failed  int64
+}
+
+var (
+	outputsMu sync.RWMutex
+	outputs   []*output
+)
+
+// SetSink creates a sink of the registered type of conf and adds it to the
+// outputs.
+func SetSink(conf *SinkConfig) error {
+	newSink, ok := adapters[conf.Type]
+	if !ok {
+		return fmt.Errorf("flow: unknown sink %q (forgotten Register?)", conf.Type)
+	}
+
+	sink := newSink()
+	if err := sink.Init(string(conf.Config)); err != nil {
+		return fmt.Errorf("flow: init sink %s: %v", conf.Type, err)
+	}
+
+	o := &output{
+		Sink:    sink,
+		filter:  conf.Filter,
+		records: make(chan interface{}, conf.Buffer),
+		exited:  make(chan struct{}),
+	}
+	if len(conf.Kinds) > 0 {
+		o.kinds = make(map[string]bool, len(conf.Kinds))
+		for _, kind := range conf.Kinds {
+			o.kinds[kind] = true
+		}
+	}
+
+	outputsMu.Lock()
+	o.name = fmt.Sprintf("%s#%d", conf.Type, len(outputs))
+	outputs = append(outputs, o)
+	outputsMu.Unlock()
+
+	go o.run()
+	log.Infof("flow sink %s started", o.name)
+	return nil
+}
+
+// Enabled reports whether any sink is configured.
+func Enabled() bool {
+	outputsMu.RLock()
+	defer outputsMu.RUnlock()
+	return len(outputs) > 0
+}
+
+// WriteFlow queues r to the sinks it matches.
+func WriteFlow(r *FlowRecord) {
+	outputsMu.RLock()
+	defer outputsMu.RUnlock()
+
+	for _, o := range outputs {
+		if o.accept(r.Kind) && matchFlow(o.filter, r) {
+			o.queue(r)
+		}
+	}
+}
+
+// WriteHTTP queues r to the sinks it matches.
+func WriteHTTP(r *HTTPRecord) {
+	outputsMu.RLock()
+	defer outputsMu.RUnlock()
+
+	for _, o := range outputs {
+		if o.accept(KindHTTP) && matchHTTP(o.filter, r) {
+			o.queue(r)
+		}
+	}
+}
+
+// Stats returns the counters of the configured sinks.
+func Stats() []SinkStat {
+	outputsMu.RLock()
+	defer outputsMu.RUnlock()
+
+	stats := make([]SinkStat, 0, len(outputs))
+	for _, o := range outputs {
+		stats = append(stats, SinkStat{
+			Name:    o.name,
+			Written: atomic.LoadInt64(&o.written),
+			Dropped: atomic.LoadInt64(&o.dropped),
+			Failed:  atomic.LoadInt64(&o.failed),
+		})
+	}
+	sort.Slice(stats, func(i, j int) bool { return stats[i].Name < stats[j].Name })
+	return stats
+}
+
+// Close writes the queued records, then flushes and destroys every sink.
+func Close() {
+	outputsMu.Lock()
+	closing := outputs
+	outputs = nil
+	outputsMu.Unlock()
+
+	for _, o := range closing {
+		close(o.records)
+		<-o.exited
+		o.Flush()
+		o.Destroy()
+	}
+}
+
+func (o *output) accept(kind string) bool {
+	return o.kinds == nil || o.kinds[kind]
+}
+
+func (o *output) queue(r interface{}) {
+	select {
+	case o.records <- r:
+	default:
+		if atomic.AddInt64(&o.dropped, 1)&0x3FF == 1 {
+			log.Warnf("flow sink %s queue is full, %d records dropped", o.name, atomic.LoadInt64(&o.dropped))
+		}
+	}
+}
+
+// flushInterval bounds how long a record stays buffered in a sink.
+const flushInterval = time.Second
+
+func (o *output) run() {
+	defer close(o.exited)
+
+	ticker := time.NewTicker(flushInterval)
+	defer ticker.Stop()
+
+	pending := false // records written since the last flush
+	for {
+		var r interface{}
+		select {
+		case record, ok := <-o.records:
+			if !ok {
+				return
+			}
+			r = record
+		case <-ticker.C:
+			if pending {
+				o.Flush()
+				pending = false
+			}
+			continue
+		}
+
+		var err error
+		switch r := r.(type) {
+		case *FlowRecord:
+			err = o.WriteFlow(r)
+		case *HTTPRecord:
+			err = o.WriteHTTP(r)
+		}
+
+		if err != nil {
+			if atomic.AddInt64(&o.failed, 1)&0x3FF == 1 {
+				log.Errorf("flow sink %s write failed, %v", o.name, err)
+			}
+			continue
+		}
+		atomic.AddInt64(&o.written, 1)
+		pending = true
+	}
+}
+
+func matchFlow(f *FlowFilter, r *FlowRecord) bool {
+	if f == nil {
+		return true
+	}
+	if len(f.Ports) > 0 && !containsInt(f.Ports, r.SrcPort) && !containsInt(f.Ports, r.DstPort) {
+		return false
+	}
+	if len(f.DPITypes) > 0 && !containsString(f.DPITypes, r.DPIType) {
+		return false
+	}
+	if len(f.CloseReasons) > 0 && !containsString(f.CloseReasons, r.CloseReason) {
+		return false
+	}
+	if f.MinBytes > 0 && r.TxBytes+r.RxBytes < f.MinBytes {
+		return false
+	}
+	if f.RTTAbove > 0 && (r.RTT == nil || r.RTT.Max < f.RTTAbove) {
+		return false
+	}
+	return true
+}
+
+// matchHTTP applies f to an HTTP transaction, which has no close reason nor
+// byte counts: a filter on them rejects it.
+func matchHTTP(f *FlowFilter, r *HTTPRecord) bool {
+	if f == nil {
+		return true
+	}
+	if len(f.CloseReasons) > 0 || f.MinBytes > 0 {
+		return false
+	}
+	if len(f.Ports) > 0 && !containsInt(f.Ports, r.SrcPort) && !containsInt(f.Ports, r.DstPort) {
+		return false
+	}
+	if len(f.DPITypes) > 0 && !containsString(f.DPITypes, KindHTTP) {
+		return false
+	}
+	if f.RTTAbove > 0 && r.Latency < f.RTTAbove {
+		return false
+	}
+	return true
+}
+
+func containsInt(values []int, v int) bool {
+	for _, value := range values {
+		if value == v {
+			return true
+		}
+	}
+	return false
+}
+
+func containsString(values []string, v string) bool {
+	for _, value := range values {
+		if value == v {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,99 @@
+package flow
+
+import (
+	. "github.com/liuxp0827/Tcppass/common/config"
+	"sync"
+	"testing"
+)
+
+type memorySink struct {
+	mu    sync.Mutex
+	flows []*FlowRecord
+	https []*HTTPRecord
+}
+
+var memorySinks []*memorySink
+
+func (m *memorySink) Init(config string) error { return nil }
+
+func (m *memorySink) WriteFlow(r *FlowRecord) error {
+	m.mu.Lock()
+	m.flows = append(m.flows, r)
+	m.mu.Unlock()
+	return nil
+}
+
+func (m *memorySink) WriteHTTP(r *HTTPRecord) error {
+	m.mu.Lock()
+	m.https = append(m.https, r)
+	m.mu.Unlock()
+	return nil
+}
+
+func (m *memorySink) Destroy() {}
+
+func (m *memorySink) Flush() {}
+
+func init() {
+	Register("memory", func() Sink {
+		m := &memorySink{}
+		memorySinks = append(memorySinks, m)
+		return m
+	})
+}
+
+func TestSinkFilter(t *testing.T) {
+	confs := []*SinkConfig{
+		{Type: "memory", Buffer: 16},
+		{Type: "memory", Buffer: 16, Kinds: []string{KindTCP}, Filter: &FlowFilter{Ports: []int{443}, MinBytes: 100}},
+	}
+	for _, conf := range confs {
+		if err := SetSink(conf); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := SetSink(&SinkConfig{Type: "missing"}); err == nil {
+		t.Fatal("unknown sink accepted")
+	}
+
+	WriteFlow(&FlowRecord{Kind: KindTCP, DstPort: 443, TxBytes: 200})
+	WriteFlow(&FlowRecord{Kind: KindTCP, DstPort: 443, TxBytes: 10})
+	WriteFlow(&FlowRecord{Kind: KindTCP, DstPort: 80, TxBytes: 200})
+	WriteHTTP(&HTTPRecord{Kind: KindHTTP, DstPort: 443})
+	Close()
+
+	all, filtered := memorySinks[0], memorySinks[1]
+	if len(all.flows) != 3 || len(all.https) != 1 {
+		t.Errorf("unfiltered sink got %d flows, %d http", len(all.flows), len(all.https))
+	}
+	if len(filtered.flows) != 1 || len(filtered.https) != 0 {
+		t.Errorf("filtered sink got %d flows, %d http", len(filtered.flows), len(filtered.https))
+	}
+	if Enabled() {
+		t.Error("sinks still enabled after Close")
+	}
+}
+
+func TestMatchHTTP(t *testing.T) {
+	r := &HTTPRecord{Kind: KindHTTP, SrcPort: 40000, DstPort: 80, Latency: 5000}
+	tests := []struct {
+		name   string
+		filter *FlowFilter
+		want   bool
+	}{
+		{"no filter", nil, true},
+		{"port", &FlowFilter{Ports: []int{80}}, true},
+		{"other port", &FlowFilter{Ports: []int{443}}, false},
+		{"dpi type", &FlowFilter{DPITypes: []string{KindHTTP}}, true},
+		{"other dpi type", &FlowFilter{DPITypes: []string{"unknown"}}, false},
+		{"latency", &FlowFilter{RTTAbove: 5000}, true},
+		{"latency below", &FlowFilter{RTTAbove: 6000}, false},
+		{"close reason", &FlowFilter{Ports: []int{80}, CloseReasons: []string{"fin"}}, false},
+		{"min bytes", &FlowFilter{Ports: []int{80}, MinBytes: 1}, false},
+	}
+	for _, test := range tests {
+		if got := matchHTTP(test.filter, r); got != test.want {
+			t.Errorf("%s: got %v, want %v", test.name, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,372 @@
+package flow
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"github.com/liuxp0827/Tcppass/common/json"
+	"github.com/liuxp0827/Tcppass/common/log"
+	_ "github.com/mattn/go-sqlite3"
+	"strings"
+	"time"
+)
+
+const sqliteSchema = `
+CREATE TABLE IF NOT EXISTS flows (
+	id INTEGER, kind TEXT, iface TEXT,
+	src_ip TEXT, src_port INTEGER, dst_ip TEXT, dst_port INTEGER,
+	first_seen INTEGER, last_seen INTEGER,
+	tx_bytes INTEGER, tx_packets INTEGER, rx_bytes INTEGER, rx_packets INTEGER,
+	tx_retrans_bytes INTEGER, rx_retrans_bytes INTEGER, capture_loss INTEGER,
+	rtt_estimator TEXT, rtt_count INTEGER, rtt_first INTEGER, rtt_min INTEGER, rtt_max INTEGER,
+	rtt_avg INTEGER, rtt_p50 INTEGER, rtt_p90 INTEGER, rtt_p99 INTEGER, rtt_jitter INTEGER,
+	dpi_type TEXT, http_status INTEGER, close_reason TEXT, asymmetry TEXT,
+	low_confidence INTEGER, sampling_rate INTEGER, final INTEGER DEFAULT 1
+);
+CREATE INDEX IF NOT EXISTS flows_last_seen ON flows (last_seen);
+CREATE INDEX IF NOT EXISTS flows_src ON flows (src_ip, src_port);
+CREATE INDEX IF NOT EXISTS flows_dst ON flows (dst_ip, dst_port);
+CREATE TABLE IF NOT EXISTS http (
+	flow_id INTEGER, iface TEXT,
+	src_ip TEXT, src_port INTEGER, dst_ip TEXT, dst_port INTEGER,
+	time INTEGER, method TEXT, host TEXT, url TEXT, status INTEGER, latency INTEGER
+);
+CREATE INDEX IF NOT EXISTS http_time ON http (time);
+`
+
+const flowColumns = `id, kind, iface, src_ip, src_port, dst_ip, dst_port, first_seen, last_seen,
+	tx_bytes, tx_packets, rx_bytes, rx_packets, tx_retrans_bytes, rx_retrans_bytes, capture_loss,
+	rtt_estimator, rtt_count, rtt_first, rtt_min, rtt_max, rtt_avg, rtt_p50, rtt_p90, rtt_p99, rtt_jitter,
+	dpi_type, http_status, close_reason, asymmetry, low_confidence, sampling_rate, final`
+
+const httpColumns = `flow_id, iface, src_ip, src_port, dst_ip, dst_port, time, method, host, url, status, latency`
+
+// sqliteWriter implements Sink.
+// It stores the flow records and HTTP transactions in a SQLite database,
+// the records are inserted by batch and the oldest are deleted beyond the
+// retention limits.
+type sqliteWriter struct {
+	Filename string `json:"filename"`
+	MaxDays  int    `json:"maxdays"` // days of records kept, 0 for no limit
+	MaxRows  int64  `json:"maxrows"` // records kept per table, 0 for no limit
+	Batch    int    `json:"batch"`   // records per transaction
+
+	db       *sql.DB
+	tx       *sql.Tx
+	flowStmt *sql.Stmt
+	httpStmt *sql.Stmt
+	pending  int
+	retained time.Time // last time the retention limits were applied
+}
+
+func newSQLiteWriter() Sink {
+	return &sqliteWriter{
+		MaxDays: 7,
+		MaxRows: 10000000,
+		Batch:   500,
+	}
+}
+
+// Init sqlite sink with json config.
+// config like:
+//
+//	{
+//	"filename":"flows.db",
+//	"maxdays":7,
+//	"maxrows":10000000,
+//	"batch":500
+//	}
+func (w *sqliteWriter) Init(config string) error {
+	if len(config) > 0 {
+		if err := json.Unmarshal([]byte(config), w); err != nil {
+			return err
+		}
+	}
+	if len(w.Filename) == 0 {
+		return errors.New("config must have filename")
+	}
+	if w.Batch <= 0 {
+		w.Batch = 1
+	}
+
+	db, err := OpenStore(w.Filename)
+	if err != nil {
+		return err
+	}
+	w.db = db
+	return nil
+}
+
+// OpenStore opens the SQLite database filename, creating its tables.
+func OpenStore(filename string) (*sql.DB, error) {
+	db, err := sql.Open("sqlite3", filename+"?_journal_mode=WAL&_busy_timeout=5000")
+	if err != nil {
+		return nil, err
+	}
+	db.SetMaxOpenConns(1)
+
+	if _, err = db.Exec(sqliteSchema); err != nil {
+		db.Close()
+		return nil, err
+	}
+	// 旧的数据库没有 final 列, 其中的记录都是最终记录
+	if _, err = db.Exec("ALTER TABLE flows ADD COLUMN final INTEGER DEFAULT 1"); err != nil && !strings.Contains(err.Error(), "duplicate column") {
+		db.Close()
+		return nil, err
+	}
+	return db, nil
+}
+
+func (w *sqliteWriter) begin() error {
+	if w.tx != nil {
+		return nil
+	}
+
+	tx, err := w.db.Begin()
+	if err != nil {
+		return err
+	}
+	w.tx = tx
+	if w.flowStmt, err = tx.Prepare("INSERT INTO flows (" + flowColumns + ") VALUES (" + placeholders(33) + ")"); err == nil {
+		w.httpStmt, err = tx.Prepare("INSERT INTO http (" + httpColumns + ") VALUES (" + placeholders(12) + ")")
+	}
+	if err != nil {
+		tx.Rollback()
+		w.tx = nil
+	}
+	return err
+}
+
+func placeholders(n int) string {
+	return strings.TrimSuffix(strings.Repeat("?,", n), ",")
+}
+
+func (w *sqliteWriter) WriteFlow(r *FlowRecord) error {
+	if err := w.begin(); err != nil {
+		return err
+	}
+
+	var rtt RTTStats
+	if r.RTT != nil {
+		rtt = *r.RTT
+	}
+	_, err := w.flowStmt.Exec(r.ID, r.Kind, r.Iface, r.SrcIP, r.SrcPort, r.DstIP, r.DstPort,
+		unixMicro(r.FirstSeen), unixMicro(r.LastSeen),
+		r.TxBytes, r.TxPackets, r.RxBytes, r.RxPackets, r.TxRetransBytes, r.RxRetransBytes, r.CaptureLoss,
+		rtt.Estimator, rtt.Count, rtt.First, rtt.Min, rtt.Max, rtt.Avg, rtt.P50, rtt.P90, rtt.P99, rtt.Jitter,
+		r.DPIType, r.HTTPStatus, r.CloseReason, r.Asymmetry, r.LowConfidence, r.SamplingRate, r.Final)
+	return w.written(err)
+}
+
+func (w *sqliteWriter) WriteHTTP(r *HTTPRecord) error {
+	if err := w.begin(); err != nil {
+		return err
+	}
+
+	_, err := w.httpStmt.Exec(r.FlowID, r.Iface, r.SrcIP, r.SrcPort, r.DstIP, r.DstPort,
+		unixMicro(r.Time), r.Method, r.Host, r.URL, r.Status, r.Latency)
+	return w.written(err)
+}
+
+func (w *sqliteWriter) written(err error) error {
+	if err != nil {
+		return err
+	}
+	if w.pending++; w.pending >= w.Batch {
+		return w.commit()
+	}
+	return nil
+}
+
+func (w *sqliteWriter) commit() error {
+	if w.tx == nil {
+		return nil
+	}
+
+	err := w.tx.Commit()
+	w.tx, w.flowStmt, w.httpStmt = nil, nil, nil
+	w.pending = 0
+	return err
+}
+
+// retain deletes the records beyond the retention limits.
+func (w *sqliteWriter) retain(now time.Time) error {
+	if w.MaxDays > 0 {
+		before := unixMicro(now.Add(-time.Duration(w.MaxDays) * 24 * time.Hour))
+		if _, err := w.db.Exec("DELETE FROM flows WHERE last_seen < ?", before); err != nil {
+			return err
+		}
+		if _, err := w.db.Exec("DELETE FROM http WHERE time < ?", before); err != nil {
+			return err
+		}
+	}
+
+	if w.MaxRows > 0 {
+		for _, table := range []string{"flows", "http"} {
+			if _, err := w.db.Exec("DELETE FROM "+table+" WHERE rowid <= (SELECT MAX(rowid) FROM "+table+") - ?", w.MaxRows); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Destroy commits the pending records and closes the database.
+func (w *sqliteWriter) Destroy() {
+	if err := w.commit(); err != nil {
+		log.Errorf("sqlite %s commit failed, %v", w.Filename, err)
+	}
+	w.db.Close()
+}
+
+// Flush commits the pending records, and applies the retention limits once
+// a minute.
+func (w *sqliteWriter) Flush() {
+	if err := w.commit(); err != nil {
+		log.Errorf("sqlite %s commit failed, %v", w.Filename, err)
+	}
+
+	if now := time.Now(); now.Sub(w.retained) >= time.Minute {
+		w.retained = now
+		if err := w.retain(now); err != nil {
+			log.Errorf("sqlite %s retention failed, %v", w.Filename, err)
+		}
+	}
+}
+
+// FlowQuery selects the stored records, all the non-empty fields must match.
+type FlowQuery struct {
+	From, To    time.Time // last seen, or time of the request
+	IP          string    // client or server ip
+	Port        int       // client or server port
+	DPIType     string
+	CloseReason string
+	RTTAbove    int64 // average rtt, or http latency, in µs
+	RTTBelow    int64
+	Limit       int // keeps the latest records
+}
+
+// where returns the WHERE clause of q and its arguments, given the columns of
+// the time and the rtt of the table. The DPI type and the close reason only
+// apply to the flows. The rows come latest first for the limit to keep the
+// latest ones.
+func (q *FlowQuery) where(timeColumn, rttColumn string, flows bool) (string, []interface{}) {
+	var conds []string
+	var args []interface{}
+
+	if !q.From.IsZero() {
+		conds, args = append(conds, timeColumn+" >= ?"), append(args, unixMicro(q.From))
+	}
+	if !q.To.IsZero() {
+		conds, args = append(conds, timeColumn+" < ?"), append(args, unixMicro(q.To))
+	}
+	if q.IP != "" {
+		conds, args = append(conds, "(src_ip = ? OR dst_ip = ?)"), append(args, q.IP, q.IP)
+	}
+	if q.Port > 0 {
+		conds, args = append(conds, "(src_port = ? OR dst_port = ?)"), append(args, q.Port, q.Port)
+	}
+	if q.RTTAbove > 0 {
+		conds, args = append(conds, rttColumn+" > ?"), append(args, q.RTTAbove)
+	}
+	if q.RTTBelow > 0 {
+		conds, args = append(conds, rttColumn+" < ?"), append(args, q.RTTBelow)
+	}
+	if flows && (q.RTTAbove > 0 || q.RTTBelow > 0) {
+		conds = append(conds, "rtt_count > 0")
+	}
+	if flows && q.DPIType != "" {
+		conds, args = append(conds, "dpi_type = ?"), append(args, q.DPIType)
+	}
+	if flows && q.CloseReason != "" {
+		conds, args = append(conds, "close_reason = ?"), append(args, q.CloseReason)
+	}
+
+	var where string
+	if len(conds) > 0 {
+		where = " WHERE " + strings.Join(conds, " AND ")
+	}
+	where += " ORDER BY " + timeColumn + " DESC"
+	if q.Limit > 0 {
+		where += fmt.Sprintf(" LIMIT %d", q.Limit)
+	}
+	return where, args
+}
+
+// QueryFlows returns the flow records of db matching q, by last seen.
+func QueryFlows(db *sql.DB, q *FlowQuery) ([]*FlowRecord, error) {
+	where, args := q.where("last_seen", "rtt_avg", true)
+	rows, err := db.Query("SELECT "+flowColumns+" FROM flows"+where, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var records []*FlowRecord
+	for rows.Next() {
+		r := &FlowRecord{}
+		var rtt RTTStats
+		var first, last int64
+		if err := rows.Scan(&r.ID, &r.Kind, &r.Iface, &r.SrcIP, &r.SrcPort, &r.DstIP, &r.DstPort, &first, &last,
+			&r.TxBytes, &r.TxPackets, &r.RxBytes, &r.RxPackets, &r.TxRetransBytes, &r.RxRetransBytes, &r.CaptureLoss,
+			&rtt.Estimator, &rtt.Count, &rtt.First, &rtt.Min, &rtt.Max, &rtt.Avg, &rtt.P50, &rtt.P90, &rtt.P99, &rtt.Jitter,
+			&r.DPIType, &r.HTTPStatus, &r.CloseReason, &r.Asymmetry, &r.LowConfidence, &r.SamplingRate, &r.Final); err != nil {
+			return nil, err
+		}
+		r.FirstSeen, r.LastSeen = fromUnixMicro(first), fromUnixMicro(last)
+		if rtt.Count > 0 {
+			r.RTT = &rtt
+		}
+		records = append(records, r)
+	}
+	for i, j := 0, len(records)-1; i < j; i, j = i+1, j-1 {
+		records[i], records[j] = records[j], records[i]
+	}
+	return records, rows.Err()
+}
+
+// QueryHTTP returns the HTTP transactions of db matching q, by time. The DPI
+// type and the close reason do not apply to them.
+func QueryHTTP(db *sql.DB, q *FlowQuery) ([]*HTTPRecord, error) {
+	where, args := q.where("time", "latency", false)
+
+	rows, err := db.Query("SELECT "+httpColumns+" FROM http"+where, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var records []*HTTPRecord
+	for rows.Next() {
+		r := &HTTPRecord{Kind: KindHTTP}
+		var ts int64
+		if err := rows.Scan(&r.FlowID, &r.Iface, &r.SrcIP, &r.SrcPort, &r.DstIP, &r.DstPort,
+			&ts, &r.Method, &r.Host, &r.URL, &r.Status, &r.Latency); err != nil {
+			return nil, err
+		}
+		r.Time = fromUnixMicro(ts)
+		records = append(records, r)
+	}
+	for i, j := 0, len(records)-1; i < j; i, j = i+1, j-1 {
+		records[i], records[j] = records[j], records[i]
+	}
+	return records, rows.Err()
+}
+
+func unixMicro(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.UnixNano() / 1000
+}
+
+func fromUnixMicro(us int64) time.Time {
+	if us == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, us*1000)
+}
+
+func init() {
+	Register("sqlite", newSQLiteWriter)
+}
@@ -0,0 +1,104 @@
+package flow
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestSQLiteQuery(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sqlite")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	filename := filepath.Join(dir, "flows.db")
+	w := newSQLiteWriter().(*sqliteWriter)
+	if err := w.Init(`{"filename":"` + filename + `","maxdays":0,"maxrows":2,"batch":2}`); err != nil {
+		t.Fatal(err)
+	}
+
+	start := time.Unix(1500000000, 0)
+	for i, rtt := range []int64{0, 800, 1500, 40000} {
+		r := &FlowRecord{Kind: KindTCP, ID: int64(i), SrcIP: "10.0.0.1", SrcPort: 40000 + i, DstIP: "10.0.0.2", DstPort: 80,
+			FirstSeen: start, LastSeen: start.Add(time.Duration(i) * time.Second), Final: i < 3, DPIType: "HTTP", CloseReason: "fin"}
+		if rtt > 0 {
+			r.RTT = &RTTStats{Estimator: "seq", Count: 1, Avg: rtt}
+		}
+		if err := w.WriteFlow(r); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 1; i <= 3; i++ {
+		w.WriteHTTP(&HTTPRecord{Kind: KindHTTP, FlowID: int64(i), SrcIP: "10.0.0.1", SrcPort: 40000 + i, DstIP: "10.0.0.2", DstPort: 80,
+			Time: start.Add(time.Duration(i) * time.Second), Method: "GET", Host: "example.com", URL: "/", Status: 200, Latency: int64(i) * 10000})
+	}
+	w.Flush()
+
+	db, err := OpenStore(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	// maxrows kept the last two flows
+	flows, err := QueryFlows(db, &FlowQuery{IP: "10.0.0.2", Port: 80})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(flows) != 2 || flows[0].ID != 2 || flows[1].ID != 3 {
+		t.Fatalf("flows %v", flows)
+	}
+	// 最后一条是中间记录
+	if !flows[0].Final || flows[1].Final {
+		t.Fatalf("final %v, %v", flows[0].Final, flows[1].Final)
+	}
+	if r := flows[1]; !r.LastSeen.Equal(start.Add(3*time.Second)) || r.RTT == nil || r.RTT.Avg != 40000 || r.DPIType != "HTTP" {
+		t.Fatalf("flow %+v", r)
+	}
+
+	flows, err = QueryFlows(db, &FlowQuery{RTTAbove: 1000, RTTBelow: 10000, CloseReason: "fin"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(flows) != 1 || flows[0].ID != 2 {
+		t.Fatalf("flows by rtt %v", flows)
+	}
+
+	flows, err = QueryFlows(db, &FlowQuery{From: start.Add(3 * time.Second), DPIType: "TLS"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(flows) != 0 {
+		t.Fatalf("flows by dpi type %v", flows)
+	}
+
+	https, err := QueryHTTP(db, &FlowQuery{RTTAbove: 20000, Port: 40003})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(https) != 1 || https[0].Host != "example.com" || !https[0].Time.Equal(start.Add(3*time.Second)) {
+		t.Fatalf("http %v", https)
+	}
+
+	// the limit keeps the latest records, still in time order
+	flows, err = QueryFlows(db, &FlowQuery{Limit: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(flows) != 1 || flows[0].ID != 3 {
+		t.Fatalf("latest flow %v", flows)
+	}
+	https, err = QueryHTTP(db, &FlowQuery{Limit: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(https) != 2 || https[0].FlowID != 2 || https[1].FlowID != 3 {
+		t.Fatalf("latest http %v", https)
+	}
+
+	w.Destroy()
+}
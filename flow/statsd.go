@@ -0,0 +1,323 @@
+package flow
+
+import (
+	"errors"
+	"fmt"
+	"github.com/liuxp0827/Tcppass/common/json"
+	"github.com/liuxp0827/Tcppass/common/log"
+	"github.com/liuxp0827/Tcppass/stat"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Tag formats of statsd.
+const (
+	tagsDogStatsD = "dogstatsd" // name:1|c|#tag:value
+	tagsInflux    = "influx"    // name,tag=value:1|c
+	tagsNone      = "none"
+)
+
+var (
+	gaugesMu sync.Mutex
+	gauges   = make(map[string]func() float64)
+)
+
+// SetGauge makes f the source of the gauge name pushed by the statsd sinks.
+func SetGauge(name string, f func() float64) {
+	gaugesMu.Lock()
+	gauges[name] = f
+	gaugesMu.Unlock()
+}
+
+// statsdWriter implements Sink.
+// It pushes metrics of the records to a statsd agent over UDP, and every
+// interval the traffic counters of the interfaces. The lines are batched in
+// packets of at most mtu bytes.
+type statsdWriter struct {
+	sync.Mutex
+	Addr      string            `json:"addr"`
+	Prefix    string            `json:"prefix"`
+	Tags      map[string]string `json:"tags"`      // added to every metric
+	TagFormat string            `json:"tagFormat"` // dogstatsd, influx or none
+	MTU       int               `json:"mtu"`
+	Interval  int               `json:"interval"` // seconds between pushes of the interface counters
+
+	conn    net.Conn
+	tags    []string // name, value pairs of Tags sorted by name
+	buf     []byte
+	last    map[string]int64 // counters of the last push
+	sendErr error            // first error since the last err call
+	done    chan struct{}
+	exited  chan struct{}
+}
+
+func newStatsdWriter() Sink {
+	return &statsdWriter{
+		Addr:      "127.0.0.1:8125",
+		Prefix:    "tcppass.",
+		TagFormat: tagsDogStatsD,
+		MTU:       1432,
+		Interval:  10,
+	}
+}
+
+// Init statsd sink with json config.
+// config like:
+//
+//	{
+//	"addr":"127.0.0.1:8125",
+//	"prefix":"tcppass.",
+//	"tags":{"env":"prod"},
+//	"tagFormat":"dogstatsd",
+//	"mtu":1432,
+//	"interval":10
+//	}
+func (w *statsdWriter) Init(config string) error {
+	if len(config) > 0 {
+		if err := json.Unmarshal([]byte(config), w); err != nil {
+			return err
+		}
+	}
+	if len(w.Addr) == 0 {
+		return errors.New("config must have addr")
+	}
+	switch w.TagFormat {
+	case tagsDogStatsD, tagsInflux, tagsNone:
+	default:
+		return fmt.Errorf("unknown tag format %q", w.TagFormat)
+	}
+	if w.MTU < 64 {
+		w.MTU = 64
+	}
+
+	for name, value := range w.Tags {
+		w.tags = append(w.tags, name, value)
+	}
+	w.tags = sortTags(w.tags)
+
+	conn, err := net.Dial("udp", w.Addr)
+	if err != nil {
+		return err
+	}
+	w.conn = conn
+	w.buf = make([]byte, 0, w.MTU)
+	w.last = make(map[string]int64)
+
+	w.done = make(chan struct{})
+	w.exited = make(chan struct{})
+	go w.run()
+	return nil
+}
+
+func (w *statsdWriter) WriteFlow(r *FlowRecord) error {
+	w.Lock()
+	defer w.Unlock()
+
+	tags := []string{"iface", r.Iface, "kind", r.Kind}
+	if r.CloseReason != "" {
+		tags = append(tags, "reason", r.CloseReason)
+	}
+	w.metric("flows.finished", "1", "c", tags)
+	w.metric("flows.bytes", strconv.FormatInt(r.TxBytes, 10), "c", append(tags[:4:4], "direction", "tx"))
+	w.metric("flows.bytes", strconv.FormatInt(r.RxBytes, 10), "c", append(tags[:4:4], "direction", "rx"))
+	w.metric("flows.duration", formatFloat(float64(r.Duration().Nanoseconds())/1e6), "ms", tags[:4])
+
+	if r.RTT != nil && r.RTT.Count > 0 {
+		w.metric("flows.rtt", formatFloat(float64(r.RTT.Avg)/1000), "ms", tags[:4])
+	}
+	return w.err()
+}
+
+func (w *statsdWriter) WriteHTTP(r *HTTPRecord) error {
+	w.Lock()
+	defer w.Unlock()
+
+	tags := []string{"iface", r.Iface, "host", r.Host, "status", strconv.Itoa(r.Status)}
+	w.metric("http.responses", "1", "c", tags)
+	w.metric("http.latency", formatFloat(float64(r.Latency)/1000), "ms", tags[:4])
+	return w.err()
+}
+
+// push sends the counters of the interfaces as deltas since the last push,
+// and the gauges.
+func (w *statsdWriter) push() {
+	w.Lock()
+	defer w.Unlock()
+
+	for _, s := range stat.All() {
+		tags := []string{"iface", s.Name()}
+		w.delta("packets", s.Name()+"/tx/packets", s.LoadTXPackets(), append(tags[:2:2], "direction", "tx"))
+		w.delta("packets", s.Name()+"/rx/packets", s.LoadRXPackets(), append(tags[:2:2], "direction", "rx"))
+		w.delta("bytes", s.Name()+"/tx/bytes", s.LoadTXBytes(), append(tags[:2:2], "direction", "tx"))
+		w.delta("bytes", s.Name()+"/rx/bytes", s.LoadRXBytes(), append(tags[:2:2], "direction", "rx"))
+		w.metric("capture.loss", formatFloat(s.CaptureLoss()), "g", tags)
+		w.metric("streams.asymmetric_ratio", formatFloat(s.AsymmetryRatio()), "g", tags)
+	}
+
+	gaugesMu.Lock()
+	names := make([]string, 0, len(gauges))
+	for name := range gauges {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		w.metric(name, formatFloat(gauges[name]()), "g", nil)
+	}
+	gaugesMu.Unlock()
+
+	w.send()
+}
+
+func (w *statsdWriter) delta(name, key string, v int64, tags []string) {
+	last, ok := w.last[key]
+	w.last[key] = v
+	if ok && v >= last {
+		v -= last
+	}
+	if v > 0 {
+		w.metric(name, strconv.FormatInt(v, 10), "c", tags)
+	}
+}
+
+// metric adds a line to the packet being batched, the packet is sent first
+// if the line would not fit.
+func (w *statsdWriter) metric(name, value, typ string, tags []string) {
+	if len(w.tags) > 0 {
+		tags = append(append([]string{}, w.tags...), tags...)
+	}
+
+	var line []byte
+	switch w.TagFormat {
+	case tagsInflux:
+		line = append(line, w.Prefix...)
+		line = append(line, name...)
+		for i := 0; i+1 < len(tags); i += 2 {
+			line = append(line, ',')
+			line = append(line, tagReplacer.Replace(tags[i])...)
+			line = append(line, '=')
+			line = append(line, tagReplacer.Replace(tags[i+1])...)
+		}
+		line = append(line, ':')
+		line = append(line, value...)
+		line = append(line, '|')
+		line = append(line, typ...)
+	case tagsDogStatsD:
+		line = append(line, w.Prefix...)
+		line = append(line, name...)
+		line = append(line, ':')
+		line = append(line, value...)
+		line = append(line, '|')
+		line = append(line, typ...)
+		for i := 0; i+1 < len(tags); i += 2 {
+			if i == 0 {
+				line = append(line, "|#"...)
+			} else {
+				line = append(line, ',')
+			}
+			line = append(line, tagReplacer.Replace(tags[i])...)
+			line = append(line, ':')
+			line = append(line, tagReplacer.Replace(tags[i+1])...)
+		}
+	default:
+		line = append(line, w.Prefix...)
+		line = append(line, name...)
+		line = append(line, ':')
+		line = append(line, value...)
+		line = append(line, '|')
+		line = append(line, typ...)
+	}
+
+	if len(w.buf) > 0 && len(w.buf)+1+len(line) > w.MTU {
+		w.send()
+	}
+	if len(w.buf) > 0 {
+		w.buf = append(w.buf, '\n')
+	}
+	w.buf = append(w.buf, line...)
+}
+
+// send writes the batched lines as one packet.
+func (w *statsdWriter) send() {
+	if len(w.buf) == 0 {
+		return
+	}
+	if _, err := w.conn.Write(w.buf); err != nil && w.sendErr == nil {
+		w.sendErr = err
+	}
+	w.buf = w.buf[:0]
+}
+
+// err returns and clears the error of the last packets sent.
+func (w *statsdWriter) err() error {
+	err := w.sendErr
+	w.sendErr = nil
+	return err
+}
+
+func (w *statsdWriter) run() {
+	defer close(w.exited)
+
+	if w.Interval <= 0 {
+		<-w.done
+		return
+	}
+
+	ticker := time.NewTicker(time.Duration(w.Interval) * time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			w.push()
+		case <-w.done:
+			return
+		}
+	}
+}
+
+// Destroy stops the pushes and closes the socket.
+func (w *statsdWriter) Destroy() {
+	close(w.done)
+	<-w.exited
+	w.conn.Close()
+}
+
+// Flush sends the batched lines.
+func (w *statsdWriter) Flush() {
+	w.Lock()
+	defer w.Unlock()
+
+	w.send()
+	if err := w.err(); err != nil {
+		log.Warnf("statsd push to %s failed, %v", w.Addr, err)
+	}
+}
+
+var tagReplacer = strings.NewReplacer(",", "_", "|", "_", ":", "_", "=", "_", " ", "_", "\n", "_", "#", "_")
+
+// sortTags sorts the name, value pairs of tags by name.
+func sortTags(tags []string) []string {
+	pairs := make([][2]string, 0, len(tags)/2)
+	for i := 0; i+1 < len(tags); i += 2 {
+		pairs = append(pairs, [2]string{tags[i], tags[i+1]})
+	}
+	sort.Slice(pairs, func(i, j int) bool { return pairs[i][0] < pairs[j][0] })
+
+	sorted := make([]string, 0, len(tags))
+	for _, p := range pairs {
+		sorted = append(sorted, p[0], p[1])
+	}
+	return sorted
+}
+
+// formatFloat formats a gauge, or a timing in ms, without exponent.
+func formatFloat(v float64) string {
+	return strconv.FormatFloat(v, 'f', -1, 64)
+}
+
+func init() {
+	Register("statsd", newStatsdWriter)
+}
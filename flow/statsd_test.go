@@ -0,0 +1,57 @@
+package flow
+
+import (
+	"net"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestStatsdBatching(t *testing.T) {
+	agent, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer agent.Close()
+
+	w := newStatsdWriter().(*statsdWriter)
+	if err := w.Init(`{"addr":"` + agent.LocalAddr().String() + `","tags":{"env":"test"},"mtu":200,"interval":0}`); err != nil {
+		t.Fatal(err)
+	}
+	defer w.Destroy()
+
+	start := time.Unix(1500000000, 0)
+	w.WriteFlow(&FlowRecord{Kind: KindTCP, Iface: "eth0", FirstSeen: start, LastSeen: start.Add(2 * time.Second),
+		Final: true, CloseReason: "fin", TxBytes: 100, RxBytes: 2000, RTT: &RTTStats{Count: 3, Avg: 1500}})
+	w.WriteHTTP(&HTTPRecord{Kind: KindHTTP, Iface: "eth0", Host: "example.com", Status: 200, Latency: 25000})
+	w.Flush()
+
+	var lines []string
+	buf := make([]byte, 65536)
+	for len(lines) < 7 {
+		agent.SetReadDeadline(time.Now().Add(2 * time.Second))
+		n, _, err := agent.ReadFrom(buf)
+		if err != nil {
+			t.Fatalf("got %d lines: %v", len(lines), err)
+		}
+		if n > 200 {
+			t.Errorf("packet of %d bytes above the mtu", n)
+		}
+		lines = append(lines, strings.Split(string(buf[:n]), "\n")...)
+	}
+	sort.Strings(lines)
+
+	want := []string{
+		"tcppass.flows.bytes:100|c|#env:test,iface:eth0,kind:tcp,direction:tx",
+		"tcppass.flows.bytes:2000|c|#env:test,iface:eth0,kind:tcp,direction:rx",
+		"tcppass.flows.duration:2000|ms|#env:test,iface:eth0,kind:tcp",
+		"tcppass.flows.finished:1|c|#env:test,iface:eth0,kind:tcp,reason:fin",
+		"tcppass.flows.rtt:1.5|ms|#env:test,iface:eth0,kind:tcp",
+		"tcppass.http.latency:25|ms|#env:test,iface:eth0,host:example.com",
+		"tcppass.http.responses:1|c|#env:test,iface:eth0,host:example.com,status:200",
+	}
+	if strings.Join(lines, "\n") != strings.Join(want, "\n") {
+		t.Errorf("got\n%s\nwant\n%s", strings.Join(lines, "\n"), strings.Join(want, "\n"))
+	}
+}
@@ -0,0 +1,121 @@
+package flow
+
+import (
+	"github.com/google/gopacket"
+	"github.com/liuxp0827/Tcppass/common/clock"
+	"github.com/liuxp0827/Tcppass/common/log"
+	"sync"
+	"time"
+)
+
+// maxUDPFlows bounds the UDP flows tracked at the same time.
+const maxUDPFlows = 1 << 16
+
+type udpKey struct {
+	iface          string
+	net, transport gopacket.Flow
+}
+
+// UDPTable tracks the UDP flows, a flow ends after timeout without packets
+// and is written to the sinks. The sender of the first packet is the client.
+type UDPTable struct {
+	mu      sync.Mutex
+	timeout time.Duration
+	flows   map[udpKey]*FlowRecord
+	dropped int64
+}
+
+// NewUDPTable creates the table and starts expiring its flows.
+func NewUDPTable(timeout time.Duration) *UDPTable {
+	t := &UDPTable{
+		timeout: timeout,
+		flows:   make(map[udpKey]*FlowRecord),
+	}
+	go t.run()
+	return t
+}
+
+// Add accounts a datagram of length payload bytes.
+func (t *UDPTable) Add(iface string, net, transport gopacket.Flow, length int, ts time.Time) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	k := udpKey{iface, net, transport}
+	if r, ok := t.flows[k]; ok {
+		r.TxBytes += int64(length)
+		r.TxPackets++
+		r.seen(ts)
+		return
+	}
+	if r, ok := t.flows[udpKey{iface, net.Reverse(), transport.Reverse()}]; ok {
+		r.RxBytes += int64(length)
+		r.RxPackets++
+		r.seen(ts)
+		return
+	}
+
+	if len(t.flows) >= maxUDPFlows {
+		if t.dropped++; t.dropped&0x3FF == 1 {
+			log.Warnf("too many UDP flows, %d datagrams of new flows ignored", t.dropped)
+		}
+		return
+	}
+
+	r := &FlowRecord{
+		Kind:      KindUDP,
+		ID:        NextID(),
+		Iface:     iface,
+		FirstSeen: ts,
+		LastSeen:  ts,
+		Final:     true,
+		TxBytes:   int64(length),
+		TxPackets: 1,
+	}
+	r.SetEndpoints(net, transport)
+	t.flows[k] = r
+}
+
+func (r *FlowRecord) seen(ts time.Time) {
+	if r.LastSeen.Before(ts) {
+		r.LastSeen = ts
+	}
+}
+
+// Expire writes the flows idle since before now - timeout.
+func (t *UDPTable) Expire(now time.Time) {
+	t.expire(now.Add(-t.timeout))
+}
+
+// Close writes all the flows.
+func (t *UDPTable) Close() {
+	t.expire(time.Time{})
+}
+
+func (t *UDPTable) expire(before time.Time) {
+	var expired []*FlowRecord
+
+	t.mu.Lock()
+	for k, r := range t.flows {
+		if before.IsZero() || r.LastSeen.Before(before) {
+			expired = append(expired, r)
+			delete(t.flows, k)
+		}
+	}
+	t.mu.Unlock()
+
+	for _, r := range expired {
+		WriteFlow(r)
+	}
+}
+
+func (t *UDPTable) run() {
+	interval := t.timeout / 4
+	if interval < time.Second {
+		interval = time.Second
+	}
+	ticker := clock.NewTicker(interval)
+	defer ticker.Stop()
+	for now := range ticker.C {
+		t.Expire(now)
+	}
+}
@@ -0,0 +1,72 @@
+package flow
+
+import (
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	. "github.com/liuxp0827/Tcppass/common/config"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestUDPTable(t *testing.T) {
+	n := len(memorySinks)
+	if err := SetSink(&SinkConfig{Type: "memory", Buffer: 16}); err != nil {
+		t.Fatal(err)
+	}
+	sink := memorySinks[n]
+
+	start := time.Unix(1500000000, 0)
+	table := NewUDPTable(time.Minute)
+	client, server := net.IP{10, 0, 0, 1}, net.IP{10, 0, 0, 53}
+	netFlow := gopacket.NewFlow(layers.EndpointIPv4, client, server)
+	dns := gopacket.NewFlow(layers.EndpointUDPPort, []byte{0x9c, 0x40}, []byte{0, 53})
+	ntp := gopacket.NewFlow(layers.EndpointUDPPort, []byte{0x9c, 0x41}, []byte{0, 123})
+
+	table.Add("eth0", netFlow, dns, 40, start)
+	table.Add("eth0", netFlow.Reverse(), dns.Reverse(), 120, start.Add(time.Millisecond))
+	table.Add("eth0", netFlow, dns, 40, start.Add(2*time.Second))
+	table.Add("eth1", netFlow, dns, 40, start) // 另一个接口上是另一个流
+	table.Add("eth0", netFlow, ntp, 48, start.Add(50*time.Second))
+
+	tcpID := NextID()
+	table.Expire(start.Add(70 * time.Second))
+	table.Add("eth0", netFlow, dns, 40, start.Add(80*time.Second))
+	table.Close()
+	Close()
+
+	if len(sink.flows) != 4 {
+		t.Fatalf("%d flows written", len(sink.flows))
+	}
+	var first, renewed *FlowRecord
+	ids := make(map[int64]bool)
+	for _, r := range sink.flows {
+		if ids[r.ID] || r.ID == tcpID {
+			t.Errorf("flow ID %d reused", r.ID)
+		}
+		ids[r.ID] = true
+		if r.Iface == "eth0" && r.DstPort == 53 {
+			if first == nil {
+				first = r
+			} else {
+				renewed = r
+			}
+		}
+	}
+
+	if first == nil || renewed == nil {
+		t.Fatalf("dns flows %+v %+v", first, renewed)
+	}
+	if first.Kind != KindUDP || first.SrcIP != "10.0.0.1" || first.SrcPort != 40000 || first.DstIP != "10.0.0.53" || !first.Final {
+		t.Errorf("first flow %+v", first)
+	}
+	if first.TxBytes != 80 || first.TxPackets != 2 || first.RxBytes != 120 || first.RxPackets != 1 {
+		t.Errorf("first flow tx %dB/%d, rx %dB/%d", first.TxBytes, first.TxPackets, first.RxBytes, first.RxPackets)
+	}
+	if !first.FirstSeen.Equal(start) || !first.LastSeen.Equal(start.Add(2*time.Second)) {
+		t.Errorf("first flow seen %s - %s", first.FirstSeen, first.LastSeen)
+	}
+	if renewed.TxPackets != 1 || renewed.ID <= first.ID {
+		t.Errorf("renewed flow %+v", renewed)
+	}
+}
@@ -5,20 +5,33 @@ import (
 	"github.com/google/gopacket"
 	"github.com/google/gopacket/layers"
 	"github.com/google/gopacket/pcap"
+	"github.com/liuxp0827/Tcppass/common/clock"
 	"github.com/liuxp0827/Tcppass/common/log"
 	"github.com/liuxp0827/Tcppass/tcpassembly"
 	"time"
 	"os"
 )
 
-func handle1(handle *pcap.Handle, assembler *tcpassembly.Assembler) {
+// packetHandle is a packet source with a known link type, a *pcap.Handle or
+// a *pcapgo.Reader.
+type packetHandle interface {
+	gopacket.PacketDataSource
+	LinkType() layers.LinkType
+}
+
+// handle1 feeds the packets of handle to assembler until done is closed. A
+// nil done means an offline capture, which exits the process at the end of
+// the file. After done the packets are drained until the caller closes
+// handle.
+func handle1(handle packetHandle, assembler *tcpassembly.Assembler, done <-chan struct{}) {
 
 	var packetSource *gopacket.PacketSource
 	packetSource = gopacket.NewPacketSource(handle, handle.LinkType())
 	packets := packetSource.Packets()
-	ticker := time.NewTicker(30 * time.Second)
+	ticker := clock.NewTicker(30 * time.Second)
 	defer ticker.Stop()
 	//var PacketsReceived, PacketsDropped, PacketsIfDropped int64
+	recorder := GetRecorder(assembler.Iface)
 
 	Dumper.SetFile("ppl.log", false)
 
@@ -27,10 +40,21 @@ func handle1(handle *pcap.Handle, assembler *tcpassembly.Assembler) {
 		case packet := <-packets:
 			if packet == nil {
 				log.Errorf("packet is nil")
+				if done != nil {
+					return
+				}
 				Dumper.DumpMap()
 				os.Exit(0)
 			}
 
+			if replay != nil {
+				replay.Advance(packet.Metadata().Timestamp)
+			}
+
+			if recorder != nil {
+				recorder.Add(packet.Metadata().CaptureInfo, packet.Data())
+			}
+
 			if packet.NetworkLayer() == nil || packet.TransportLayer() == nil {
 				continue
 			}
@@ -39,6 +63,9 @@ func handle1(handle *pcap.Handle, assembler *tcpassembly.Assembler) {
 			switch layerType {
 			case layers.LayerTypeTCP:
 				tcp := packet.TransportLayer().(*layers.TCP)
+				if tcp.RST && recorder != nil {
+					recorder.ObserveRST(packet.Metadata().Timestamp)
+				}
 				//if *VDump {
 				//	Dumper.Dump(packet)
 				//} else if *VVdump {
@@ -46,15 +73,36 @@ func handle1(handle *pcap.Handle, assembler *tcpassembly.Assembler) {
 				//} else {
 				//	Dumper.DumpTcp(packet.NetworkLayer().NetworkFlow(), tcp, packet.Metadata().Timestamp)
 				//}
-				assembler.Assemble(packet.NetworkLayer().NetworkFlow(), tcp, packet.Metadata().Timestamp)
+				assembler.AssembleWithContext(packet.NetworkLayer().NetworkFlow(), tcp, &tcpassembly.CaptureContext{
+					CaptureInfo: packet.Metadata().CaptureInfo,
+					Data:        packet.Data(),
+				})
 
 			case layers.LayerTypeUDP:
 				udp := packet.TransportLayer().(*layers.UDP)
+				if udpFlows != nil {
+					udpFlows.Add(assembler.Iface, packet.NetworkLayer().NetworkFlow(), udp.TransportFlow(),
+						len(udp.Payload), packet.Metadata().Timestamp)
+				}
 				Dumper.DumpPPLUDP(packet.NetworkLayer().NetworkFlow(), udp, packet.Metadata().Timestamp)
 			default:
 			}
 
+		case <-done:
+			// 调用者关闭handle后，PacketSource的goroutine才会关闭packets，
+			// 在此之前不能让它阻塞在已满的channel上
+			go func() {
+				for range packets {
+				}
+			}()
+			return
+
 		case <-ticker.C:
+			if h, ok := handle.(*pcap.Handle); ok && recorder != nil {
+				if stats, err := h.Stats(); err == nil {
+					recorder.ObserveDrops(int64(stats.PacketsDropped + stats.PacketsIfDropped))
+				}
+			}
 			//stats, _ := handle.Stats()
 			//log.Infof("[Pcap] %s increase Received %d, Dropped %d, IfDropped %d",
 			//	assembler.Iface, int64(stats.PacketsReceived)-PacketsReceived,
@@ -139,7 +187,7 @@ loop:
 			case layers.LayerTypeTCP:
 				if foundNetLayer {
 					//Dumper.DumpTcp(netFlow, &tcp, ci.Timestamp)
-					assembler.Assemble(netFlow, &tcp, ci.Timestamp)
+					assembler.AssembleWithContext(netFlow, &tcp, &tcpassembly.CaptureContext{CaptureInfo: ci, Data: data})
 				}
 				continue loop
 				//case layers.LayerTypeUDP:
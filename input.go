@@ -0,0 +1,208 @@
+package main
+
+import (
+	"fmt"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+	"github.com/liuxp0827/Tcppass/common/log"
+	"github.com/liuxp0827/Tcppass/tcpassembly"
+	"net"
+	"sync"
+	"time"
+)
+
+// listenPcap accepts pcap streams over TCP, as written by tcpdump -w -. Each
+// connection is assembled as a virtual interface named pcap/<remote addr>.
+func listenPcap(addr string, streamPool *tcpassembly.StreamPool) error {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("pcap listen %s: %v", addr, err)
+	}
+
+	log.Infof("accepting pcap streams on %s", addr)
+	go func() {
+		var delay time.Duration
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				if !temporary(err) {
+					log.Errorf("pcap accept on %s: %v, stop accepting", addr, err)
+					return
+				}
+				delay = backoff(delay)
+				log.Warnf("pcap accept on %s: %v, retry in %v", addr, err, delay)
+				time.Sleep(delay)
+				continue
+			}
+			delay = 0
+			go servePcap(conn, streamPool)
+		}
+	}()
+	return nil
+}
+
+func servePcap(conn net.Conn, streamPool *tcpassembly.StreamPool) {
+	defer conn.Close()
+
+	name := "pcap/" + conn.RemoteAddr().String()
+	reader, err := pcapgo.NewReader(conn)
+	if err != nil {
+		log.Errorf("%s: invalid pcap stream, %v", name, err)
+		return
+	}
+
+	assembler := tcpassembly.NewAssembler(name, streamPool)
+	assembler.LinkType = reader.LinkType()
+	defer assembler.Close()
+
+	log.Infof("%s: reading in packets, link type %s", name, reader.LinkType())
+	handle1(reader, assembler, make(chan struct{}))
+	log.Infof("%s: pcap stream closed", name)
+}
+
+// temporary reports whether err of a socket may go away on retry.
+func temporary(err error) bool {
+	ne, ok := err.(net.Error)
+	return ok && ne.Temporary()
+}
+
+// backoff doubles delay from 5ms up to a second.
+func backoff(delay time.Duration) time.Duration {
+	if delay == 0 {
+		return 5 * time.Millisecond
+	}
+	if delay *= 2; delay > time.Second {
+		delay = time.Second
+	}
+	return delay
+}
+
+// sflowCollector feeds the packet headers sampled by sFlow v5 agents into the
+// stream pool, with one virtual interface per agent named sflow/<agent ip>.
+type sflowCollector struct {
+	mu         sync.Mutex
+	streamPool *tcpassembly.StreamPool
+	assemblers map[string]*tcpassembly.Assembler
+}
+
+func listenSFlow(addr string, streamPool *tcpassembly.StreamPool) error {
+	conn, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		return fmt.Errorf("sflow listen %s: %v", addr, err)
+	}
+
+	c := &sflowCollector{
+		streamPool: streamPool,
+		assemblers: make(map[string]*tcpassembly.Assembler),
+	}
+
+	log.Infof("collecting sFlow datagrams on %s", addr)
+	go c.serve(conn)
+	return nil
+}
+
+// serve reads the datagrams until conn fails, it retries temporary errors
+// after a backoff.
+func (c *sflowCollector) serve(conn net.PacketConn) {
+	buf := make([]byte, 65536)
+	var delay time.Duration
+	for {
+		n, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			if !temporary(err) {
+				log.Errorf("sflow read: %v, stop collecting", err)
+				return
+			}
+			delay = backoff(delay)
+			log.Warnf("sflow read: %v, retry in %v", err, delay)
+			time.Sleep(delay)
+			continue
+		}
+		delay = 0
+
+		packet := gopacket.NewPacket(buf[:n], layers.LayerTypeSFlow, gopacket.Default)
+		layer := packet.Layer(layers.LayerTypeSFlow)
+		if layer == nil {
+			log.Debugf("sflow: invalid datagram, %v", packet.ErrorLayer())
+			continue
+		}
+		c.datagram(layer.(*layers.SFlowDatagram), time.Now())
+	}
+}
+
+func (c *sflowCollector) assembler(agent string) *tcpassembly.Assembler {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	a, ok := c.assemblers[agent]
+	if !ok {
+		a = tcpassembly.NewAssembler("sflow/"+agent, c.streamPool)
+		c.assemblers[agent] = a
+		log.Infof("sflow: new agent %s", agent)
+	}
+	return a
+}
+
+func (c *sflowCollector) datagram(d *layers.SFlowDatagram, ts time.Time) {
+	assembler := c.assembler(d.AgentAddress.String())
+
+	for _, sample := range d.FlowSamples {
+		for _, record := range sample.Records {
+			raw, ok := record.(layers.SFlowRawPacketFlowRecord)
+			if !ok || raw.Header == nil {
+				continue
+			}
+
+			header := raw.Header
+			if header.NetworkLayer() == nil || header.TransportLayer() == nil {
+				continue
+			}
+
+			tcp, ok := header.TransportLayer().(*layers.TCP)
+			if !ok {
+				continue
+			}
+
+			data := header.Data()
+			assembler.AssembleWithContext(header.NetworkLayer().NetworkFlow(), tcp, &tcpassembly.CaptureContext{
+				CaptureInfo: gopacket.CaptureInfo{
+					Timestamp:     ts,
+					CaptureLength: len(data),
+					Length:        int(raw.FrameLength),
+				},
+				Data:          data,
+				SamplingRate:  sample.SamplingRate,
+				PayloadLength: sampledPayload(&raw, tcp),
+			})
+		}
+	}
+}
+
+// sampledPayload returns the TCP payload length of the sampled frame, the
+// header of raw is truncated, usually to 128 bytes. The IP length is used if
+// set, it excludes the Ethernet padding, otherwise the frame length less the
+// headers.
+func sampledPayload(raw *layers.SFlowRawPacketFlowRecord, tcp *layers.TCP) int {
+	tcpHeader := int(tcp.DataOffset) * 4
+	n := -1
+	switch ip := raw.Header.NetworkLayer().(type) {
+	case *layers.IPv4:
+		if ip.Length > 0 {
+			n = int(ip.Length) - int(ip.IHL)*4 - tcpHeader
+		}
+	case *layers.IPv6:
+		if ip.Length > 0 {
+			// 扩展头在IPv6载荷中
+			n = int(ip.Length) - (len(ip.Payload) - len(tcp.Contents) - len(tcp.Payload)) - tcpHeader
+		}
+	}
+	if n < 0 {
+		headers := len(raw.Header.Data()) - len(tcp.Payload)
+		n = int(raw.FrameLength) - int(raw.PayloadRemoved) - headers
+	}
+	if n < len(tcp.Payload) {
+		return len(tcp.Payload)
+	}
+	return n
+}
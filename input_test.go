@@ -0,0 +1,105 @@
+package main
+
+import (
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/liuxp0827/Tcppass/flow"
+	"github.com/liuxp0827/Tcppass/tcpassembly"
+	"net"
+	"testing"
+	"time"
+)
+
+type closedRecords struct {
+	tcpassembly.NopHandler
+	records []*flow.FlowRecord
+}
+
+func (c *closedRecords) OnStreamClose(info *tcpassembly.StreamInfo, record *flow.FlowRecord) {
+	c.records = append(c.records, record)
+}
+
+// sampledFrame returns the sFlow record of a TCP frame with payload bytes,
+// its header truncated to 128 bytes like the agents do.
+func sampledFrame(t *testing.T, ipv6 bool, payload int) layers.SFlowRawPacketFlowRecord {
+	eth := &layers.Ethernet{SrcMAC: net.HardwareAddr{0, 1, 2, 3, 4, 5}, DstMAC: net.HardwareAddr{0, 1, 2, 3, 4, 6}}
+	tcp := &layers.TCP{SrcPort: 40000, DstPort: 80, Seq: 1000, Ack: 1, ACK: true, PSH: true, Window: 65535}
+	var ip gopacket.SerializableLayer
+	if ipv6 {
+		eth.EthernetType = layers.EthernetTypeIPv6
+		ip6 := &layers.IPv6{Version: 6, NextHeader: layers.IPProtocolTCP, HopLimit: 64, SrcIP: net.ParseIP("2001:db8::1"), DstIP: net.ParseIP("2001:db8::2")}
+		tcp.SetNetworkLayerForChecksum(ip6)
+		ip = ip6
+	} else {
+		eth.EthernetType = layers.EthernetTypeIPv4
+		ip4 := &layers.IPv4{Version: 4, TTL: 64, Protocol: layers.IPProtocolTCP, SrcIP: net.IP{10, 0, 0, 1}, DstIP: net.IP{10, 0, 0, 2}}
+		tcp.SetNetworkLayerForChecksum(ip4)
+		ip = ip4
+	}
+
+	buf := gopacket.NewSerializeBuffer()
+	opts := gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}
+	if err := gopacket.SerializeLayers(buf, opts, eth, ip, tcp, gopacket.Payload(make([]byte, payload))); err != nil {
+		t.Fatal(err)
+	}
+	frame := buf.Bytes()
+	if len(frame) < 60 {
+		frame = append(frame, make([]byte, 60-len(frame))...) // Ethernet padding
+	}
+	header := frame
+	if len(header) > 128 {
+		header = header[:128]
+	}
+	return layers.SFlowRawPacketFlowRecord{
+		FrameLength:    uint32(len(frame) + 4), // FCS
+		PayloadRemoved: 4,
+		HeaderLength:   uint32(len(header)),
+		Header:         gopacket.NewPacket(header, layers.LayerTypeEthernet, gopacket.Default),
+	}
+}
+
+func TestSampledPayload(t *testing.T) {
+	for _, test := range []struct {
+		ipv6    bool
+		payload int
+	}{
+		{false, 1400}, {true, 1400}, {false, 0}, {false, 10}, {true, 60},
+	} {
+		raw := sampledFrame(t, test.ipv6, test.payload)
+		tcp := raw.Header.TransportLayer().(*layers.TCP)
+		if got := sampledPayload(&raw, tcp); got != test.payload {
+			t.Errorf("ipv6 %v payload %d: sampled %d", test.ipv6, test.payload, got)
+		}
+	}
+
+	// 没有IP长度时（如TSO）由帧长减去各层头部得出
+	raw := sampledFrame(t, false, 1400)
+	raw.Header.NetworkLayer().(*layers.IPv4).Length = 0
+	if got := sampledPayload(&raw, raw.Header.TransportLayer().(*layers.TCP)); got != 1400 {
+		t.Errorf("payload from the frame length %d", got)
+	}
+}
+
+func TestSFlowTruncatedSample(t *testing.T) {
+	handler := &closedRecords{}
+	pool := tcpassembly.NewStreamPool(tcpassembly.PoolOptions{})
+	pool.SetHandler(handler)
+	c := &sflowCollector{streamPool: pool, assemblers: make(map[string]*tcpassembly.Assembler)}
+
+	c.datagram(&layers.SFlowDatagram{
+		AgentAddress: net.IP{10, 0, 0, 254},
+		FlowSamples: []layers.SFlowFlowSample{{
+			SamplingRate: 100,
+			Records:      []layers.SFlowRecord{sampledFrame(t, false, 1400)},
+		}},
+	}, time.Unix(1500000000, 0))
+	pool.Flush()
+
+	if len(handler.records) != 1 {
+		t.Fatalf("%d records", len(handler.records))
+	}
+	r := handler.records[0]
+	if r.TxBytes != 1400*100 || r.TxPackets != 100 || r.SamplingRate != 100 {
+		t.Errorf("tx %dB/%d at 1/%d", r.TxBytes, r.TxPackets, r.SamplingRate)
+	}
+}
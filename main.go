@@ -2,29 +2,55 @@ package main
 
 import (
 	"flag"
+	"fmt"
 	"github.com/google/gopacket/pcap"
 	"net/http"
 	_ "net/http/pprof"
+	"os"
+	"os/signal"
 	"runtime"
 	"github.com/liuxp0827/Tcppass/common/cache"
+	"github.com/liuxp0827/Tcppass/common/clock"
 	. "github.com/liuxp0827/Tcppass/common/config"
 	"github.com/liuxp0827/Tcppass/common/log"
 	. "github.com/liuxp0827/Tcppass/dump"
+	"github.com/liuxp0827/Tcppass/flow"
 	"github.com/liuxp0827/Tcppass/stat"
 	"github.com/liuxp0827/Tcppass/tcpassembly"
+	"syscall"
 	"time"
 )
 
 var conf = flag.String("config", "pass.json", "pass config file")
 var fname = flag.String("r", "", "Filename to read from, overrides -i")
+var speed = flag.Float64("speed", 0, "With -r, replay packets at their original timing scaled by speed, e.g. 10 for 10x")
+var jump = flag.Bool("jump", false, "With -r, jump between packet timestamps but fire timers in packet time")
+var timeoutRtt = flag.Int("t", 300000, "timeout for rtt, default 300000 ms")
+
+// replay is the packet time clock of -speed and -jump.
+var replay *clock.PacketClock
 
 const timeout time.Duration = time.Minute * 2
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "query" {
+		os.Exit(runQuery(os.Args[2:]))
+	}
+
 	flag.Parse()
 
 	if pcapfile := *fname; pcapfile != "" {
-		streamPool := tcpassembly.NewStreamPool()
+		if *speed > 0 || *jump {
+			if *jump {
+				*speed = 0
+			}
+			replay = clock.NewPacketClock(*speed)
+			clock.Set(replay)
+			stat.Services.Stat()
+			stat.Responses.Stat()
+		}
+
+		streamPool := tcpassembly.NewStreamPool(poolOptions())
 		InitOfflineCapture(pcapfile, streamPool)
 	} else {
 
@@ -35,8 +61,19 @@ func main() {
 
 		log.SetLevel(TConfig.Loglevel)
 
+		if len(TConfig.Syslog) > 0 {
+			if err = log.SetLogger("syslog", string(TConfig.Syslog)); err != nil {
+				log.Fatal(err)
+			}
+		}
+
 		stat.Stat(10)
 
+		stat.Services = stat.NewServiceStats("RTT", TConfig.Services.Window, TConfig.Services.Windows, TConfig.Services.Max)
+		stat.Services.Stat()
+		stat.Responses = stat.NewServiceStats("RESPONSE", TConfig.Services.Window, TConfig.Services.Windows, TConfig.Services.Max)
+		stat.Responses.Stat()
+
 		if logFile := *Log; logFile != "" {
 			log.Infof("Set Capture Log: %s", logFile)
 			Dumper.SetFile(logFile, false)
@@ -46,11 +83,42 @@ func main() {
 			cache.SetCacheLog(TConfig.CacheLog)
 		}
 
-		streamPool := tcpassembly.NewStreamPool()
+		streamPool := tcpassembly.NewStreamPool(poolOptions())
 
+		var handlers []tcpassembly.Handler
+		if h := initSinks(TConfig.Sinks, streamPool); h != nil {
+			handlers = append(handlers, h)
+			flow.SetGauge("streams.active", func() float64 { return float64(streamPool.Stats().Active) })
+		}
+		handlers = append(handlers, eventHandler{})
+		streamPool.SetHandler(tcpassembly.MultiHandler(handlers...))
+
+		if TConfig.Recorder.Enabled() {
+			go snapshotOnSignal()
+		}
+
+		captures = newCaptureManager(streamPool, TConfig.Interfaces)
 		for i := 0; i < len(TConfig.Interfaces); i++ {
-			go InitCapture(TConfig.Interfaces[i], streamPool)
+			if err = captures.Start(TConfig.Interfaces[i]); err != nil {
+				log.Fatal(err)
+			}
+		}
+
+		if TConfig.Inputs.Enabled() {
+			if addr := TConfig.Inputs.PcapListen; addr != "" {
+				if err = listenPcap(addr, streamPool); err != nil {
+					log.Fatal(err)
+				}
+			}
+
+			if addr := TConfig.Inputs.SFlowListen; addr != "" {
+				if err = listenSFlow(addr, streamPool); err != nil {
+					log.Fatal(err)
+				}
+			}
 		}
+
+		go reloadOnSignal(*conf)
 	}
 
 	httpPprof()
@@ -69,51 +137,86 @@ func InitOfflineCapture(pcapFile string, streamPool *tcpassembly.StreamPool) {
 
 	// Set up tcpassembly
 	assembler := tcpassembly.NewAssembler("offline", streamPool)
+	assembler.LinkType = handle.LinkType()
 
 	log.Info("reading in packets")
-	handle1(handle, assembler)
+	handle1(handle, assembler, nil)
 }
 
-func InitCapture(iface *NetworkIface, streamPool *tcpassembly.StreamPool) {
-	runtime.LockOSThread()
+// poolOptions configures the stream pool from the configuration and flags.
+func poolOptions() tcpassembly.PoolOptions {
+	return tcpassembly.PoolOptions{
+		RTTTimeout:    time.Duration(*timeoutRtt) * time.Millisecond,
+		ActiveTimeout: time.Duration(TConfig.ActiveTimeout) * time.Second,
+		StatInterval:  10,
+		Export:        TConfig.Export,
+	}
+}
 
-	var handle *pcap.Handle
-	log.Infof("starting capture on interface %s", iface.Name)
+// openCapture opens and activates a live handle on iface.
+func openCapture(iface *NetworkIface) (*pcap.Handle, error) {
 	inactive, err := pcap.NewInactiveHandle(iface.Name)
 	if err != nil {
-		log.Fatal("could not create: %v", err)
+		return nil, fmt.Errorf("could not create: %v", err)
 	}
 
 	defer inactive.CleanUp()
 
 	if err = inactive.SetBufferSize(iface.BufferSize * 1024 * 1024); err != nil {
-		log.Fatal("could not set buffersize: %v", err)
+		return nil, fmt.Errorf("could not set buffersize: %v", err)
 	} else if err = inactive.SetSnapLen(iface.Snaplen); err != nil {
-		log.Fatal("could not set snap length: %v", err)
+		return nil, fmt.Errorf("could not set snap length: %v", err)
 	} else if err = inactive.SetPromisc(iface.Promisc); err != nil {
-		log.Fatal("could not set promisc mode: %v", err)
+		return nil, fmt.Errorf("could not set promisc mode: %v", err)
 	} else if err = inactive.SetTimeout(pcap.BlockForever); err != nil {
-		log.Fatal("could not set timeout: %v", err)
+		return nil, fmt.Errorf("could not set timeout: %v", err)
 	}
 
-	if handle, err = inactive.Activate(); err != nil {
-		log.Fatal("PCAP Activate error:", err)
+	handle, err := inactive.Activate()
+	if err != nil {
+		return nil, fmt.Errorf("PCAP Activate error: %v", err)
 	}
 
-	defer handle.Close()
-
+	// 按接口的链路类型编译过滤器，不一定是以太网
 	if iface.BPFFilter != "" {
+		if _, err = handle.CompileBPFFilter(iface.BPFFilter); err != nil {
+			handle.Close()
+			return nil, fmt.Errorf("invalid BPF filter %q: %v", iface.BPFFilter, err)
+		}
 		if err = handle.SetBPFFilter(iface.BPFFilter); err != nil {
-			log.Fatalf("BPF %s filter error: %v", iface.BPFFilter, err)
+			handle.Close()
+			return nil, fmt.Errorf("BPF %s filter error: %v", iface.BPFFilter, err)
 		}
 	}
+	return handle, nil
+}
 
-	// Set up tcpassembly
-	assembler := tcpassembly.NewAssembler(iface.Name, streamPool)
-
-	log.Info("reading in packets")
-	handle1(handle, assembler)
+// snapshotOnSignal writes a flight recorder snapshot of every interface on
+// SIGUSR1.
+func snapshotOnSignal() {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, syscall.SIGUSR1)
+	for range c {
+		if _, err := SnapshotAll("", "signal"); err != nil {
+			log.Errorf("recorder snapshot failed, %v", err)
+		}
+	}
+}
 
+// reloadOnSignal reloads the configuration file on SIGHUP and applies its
+// interface list to the running captures.
+func reloadOnSignal(filename string) {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, syscall.SIGHUP)
+	for range c {
+		conf, err := LoadConfig(filename)
+		if err != nil {
+			log.Errorf("reload %s failed, %v", filename, err)
+			continue
+		}
+		log.Infof("reload %s", filename)
+		captures.Reload(conf.Interfaces)
+	}
 }
 
 func httpPprof() {
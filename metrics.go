@@ -0,0 +1,215 @@
+package main
+
+import (
+	"fmt"
+	. "github.com/liuxp0827/Tcppass/common/config"
+	"github.com/liuxp0827/Tcppass/flow"
+	"github.com/liuxp0827/Tcppass/metrics"
+	"github.com/liuxp0827/Tcppass/stat"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync/atomic"
+)
+
+// ifaceMetrics are the counters of one interface, or of all of them when
+// the interfaces are aggregated.
+type ifaceMetrics struct {
+	labels               metrics.Labels
+	txBytes, rxBytes     int64
+	txPackets, rxPackets int64
+	streams, asymmetric  int64
+	covered, missing     int64
+	closes               map[string]int64
+	statuses             map[string]int64
+}
+
+// serveMetrics writes the counters in the Prometheus text format, the label
+// values are bounded by the metrics section of the config.
+func serveMetrics(w http.ResponseWriter, r *http.Request) {
+	conf := TConfig.Metrics
+
+	w.Header().Set("Content-Type", metrics.ContentType)
+	mw := metrics.NewWriter(w)
+
+	ifaces := collectIfaces(conf)
+	writeIfaces(mw, ifaces)
+
+	if captures != nil {
+		status := captures.Status()
+		mw.Family("tcppass_capture_received_packets_total", metrics.Counter, "Packets received by the capture handle.")
+		for _, st := range status {
+			mw.Sample("tcppass_capture_received_packets_total", metrics.Labels{"iface", st.Name}, float64(st.PacketsReceived))
+		}
+		mw.Family("tcppass_capture_dropped_packets_total", metrics.Counter, "Packets dropped by the kernel or the interface.")
+		for _, st := range status {
+			mw.Sample("tcppass_capture_dropped_packets_total", metrics.Labels{"iface", st.Name, "where", "kernel"}, float64(st.PacketsDropped))
+			mw.Sample("tcppass_capture_dropped_packets_total", metrics.Labels{"iface", st.Name, "where", "interface"}, float64(st.PacketsIfDropped))
+		}
+		mw.Family("tcppass_capture_up", metrics.Gauge, "Whether the capture of the interface is running.")
+		for _, st := range status {
+			up := 0.0
+			if st.State == captureRunning {
+				up = 1
+			}
+			mw.Sample("tcppass_capture_up", metrics.Labels{"iface", st.Name}, up)
+		}
+
+		pool := captures.pool.Stats()
+		mw.Family("tcppass_streams_active", metrics.Gauge, "Streams not finished yet.")
+		mw.Sample("tcppass_streams_active", nil, float64(pool.Active))
+		mw.Family("tcppass_streams_created_total", metrics.Counter, "Streams created.")
+		mw.Sample("tcppass_streams_created_total", nil, float64(pool.Created))
+		mw.Family("tcppass_export_dropped_total", metrics.Counter, "Finished streams not written to pcap, the export queue was full.")
+		mw.Sample("tcppass_export_dropped_total", nil, float64(pool.ExportDropped))
+	}
+
+	writeServices(mw, conf, "tcppass_service_rtt_seconds", "RTT of the streams per server ip:port.", stat.Services)
+	writeServices(mw, conf, "tcppass_service_response_seconds", "Server think time of the request/response turns per server ip:port.", stat.Responses)
+
+	if sinks := flow.Stats(); len(sinks) > 0 {
+		mw.Family("tcppass_sink_records_total", metrics.Counter, "Records handed to the flow sinks by result.")
+		for _, sink := range sinks {
+			labels := metrics.Labels{"sink", sink.Name}
+			mw.Sample("tcppass_sink_records_total", labels.With("result", "written"), float64(sink.Written))
+			mw.Sample("tcppass_sink_records_total", labels.With("result", "dropped"), float64(sink.Dropped))
+			mw.Sample("tcppass_sink_records_total", labels.With("result", "failed"), float64(sink.Failed))
+		}
+	}
+
+	mw.Flush()
+}
+
+func collectIfaces(conf *MetricsConfig) []*ifaceMetrics {
+	var ifaces []*ifaceMetrics
+	for _, s := range stat.All() {
+		if conf.AggregateIfaces && len(ifaces) > 0 {
+			ifaces[0].add(s, conf)
+			continue
+		}
+
+		m := &ifaceMetrics{
+			closes:   make(map[string]int64),
+			statuses: make(map[string]int64),
+		}
+		if !conf.AggregateIfaces {
+			m.labels = metrics.Labels{"iface", s.Name()}
+		}
+		m.add(s, conf)
+		ifaces = append(ifaces, m)
+	}
+	return ifaces
+}
+
+func (m *ifaceMetrics) add(s *stat.Stats, conf *MetricsConfig) {
+	m.txBytes += s.LoadTXBytes()
+	m.rxBytes += s.LoadRXBytes()
+	m.txPackets += s.LoadTXPackets()
+	m.rxPackets += s.LoadRXPackets()
+	m.streams += atomic.LoadInt64(&s.Streams)
+	m.asymmetric += atomic.LoadInt64(&s.Asymmetric)
+	m.covered += atomic.LoadInt64(&s.Covered)
+	m.missing += atomic.LoadInt64(&s.Missing)
+
+	for reason, n := range s.Closes() {
+		m.closes[reason] += n
+	}
+	for status, n := range s.HTTPStatuses() {
+		label := strconv.Itoa(status)
+		if conf.HTTPStatusClass {
+			label = fmt.Sprintf("%dxx", status/100)
+		}
+		m.statuses[label] += n
+	}
+}
+
+func writeIfaces(mw *metrics.Writer, ifaces []*ifaceMetrics) {
+	mw.Family("tcppass_packets_total", metrics.Counter, "Packets of the streams by direction.")
+	for _, m := range ifaces {
+		mw.Sample("tcppass_packets_total", m.labels.With("direction", "tx"), float64(m.txPackets))
+		mw.Sample("tcppass_packets_total", m.labels.With("direction", "rx"), float64(m.rxPackets))
+	}
+	mw.Family("tcppass_bytes_total", metrics.Counter, "Payload bytes of the streams by direction.")
+	for _, m := range ifaces {
+		mw.Sample("tcppass_bytes_total", m.labels.With("direction", "tx"), float64(m.txBytes))
+		mw.Sample("tcppass_bytes_total", m.labels.With("direction", "rx"), float64(m.rxBytes))
+	}
+	mw.Family("tcppass_streams_finished_total", metrics.Counter, "Finished streams.")
+	for _, m := range ifaces {
+		mw.Sample("tcppass_streams_finished_total", m.labels, float64(m.streams))
+	}
+	mw.Family("tcppass_streams_asymmetric_total", metrics.Counter, "Finished streams with one direction missing in part or whole.")
+	for _, m := range ifaces {
+		mw.Sample("tcppass_streams_asymmetric_total", m.labels, float64(m.asymmetric))
+	}
+	mw.Family("tcppass_stream_closes_total", metrics.Counter, "Finished streams by close reason.")
+	for _, m := range ifaces {
+		for _, reason := range sortedKeys(m.closes) {
+			mw.Sample("tcppass_stream_closes_total", m.labels.With("reason", reason), float64(m.closes[reason]))
+		}
+	}
+	mw.Family("tcppass_sequence_covered_bytes_total", metrics.Counter, "Sequence space covered by the finished streams.")
+	for _, m := range ifaces {
+		mw.Sample("tcppass_sequence_covered_bytes_total", m.labels, float64(m.covered))
+	}
+	mw.Family("tcppass_capture_missing_bytes_total", metrics.Counter, "Bytes of the covered sequence space missing from the capture.")
+	for _, m := range ifaces {
+		mw.Sample("tcppass_capture_missing_bytes_total", m.labels, float64(m.missing))
+	}
+	mw.Family("tcppass_http_responses_total", metrics.Counter, "HTTP responses by status.")
+	for _, m := range ifaces {
+		for _, status := range sortedKeys(m.statuses) {
+			mw.Sample("tcppass_http_responses_total", m.labels.With("status", status), float64(m.statuses[status]))
+		}
+	}
+}
+
+// writeServices writes the histograms of the configured services, or of the
+// busiest ones when none are configured.
+func writeServices(mw *metrics.Writer, conf *MetricsConfig, name, help string, services *stat.ServiceStats) {
+	type service struct {
+		name string
+		hist stat.Histogram
+	}
+
+	var selected []service
+	if len(conf.Services) > 0 {
+		for _, name := range conf.Services {
+			selected = append(selected, service{name, services.Total(name)})
+		}
+	} else {
+		for _, name := range services.Services() {
+			if h := services.Total(name); h.Count() > 0 {
+				selected = append(selected, service{name, h})
+			}
+		}
+		sort.SliceStable(selected, func(i, j int) bool { return selected[i].hist.Count() > selected[j].hist.Count() })
+		if len(selected) > conf.MaxServices {
+			selected = selected[:conf.MaxServices]
+		}
+		sort.Slice(selected, func(i, j int) bool { return selected[i].name < selected[j].name })
+	}
+
+	if len(selected) == 0 {
+		return
+	}
+
+	bounds := make([]float64, len(conf.RTTBuckets))
+	for i, ms := range conf.RTTBuckets {
+		bounds[i] = ms / 1000
+	}
+
+	mw.Family(name, metrics.Histogram, help)
+	for _, s := range selected {
+		mw.Histogram(name, metrics.Labels{"service", s.name}, &s.hist, bounds, 1e-6)
+	}
+}
+
+func sortedKeys(m map[string]int64) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,121 @@
+// Package metrics writes metrics in the Prometheus text exposition format.
+package metrics
+
+import (
+	"bufio"
+	"github.com/liuxp0827/Tcppass/stat"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// ContentType is the media type of the text format.
+const ContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+// Metric types.
+const (
+	Counter   = "counter"
+	Gauge     = "gauge"
+	Histogram = "histogram"
+)
+
+// Labels are the name and value pairs of a sample, in order.
+type Labels []string
+
+// With returns a copy of l with the pair name, value appended.
+func (l Labels) With(name, value string) Labels {
+	labels := make(Labels, len(l), len(l)+2)
+	copy(labels, l)
+	return append(labels, name, value)
+}
+
+// Writer writes the metric families one after the other, the samples of a
+// family must follow its Family call.
+type Writer struct {
+	w   *bufio.Writer
+	err error
+}
+
+func NewWriter(w io.Writer) *Writer {
+	return &Writer{w: bufio.NewWriter(w)}
+}
+
+// Family starts the metric family name of type typ.
+func (w *Writer) Family(name, typ, help string) {
+	w.write("# HELP " + name + " " + helpReplacer.Replace(help) + "\n")
+	w.write("# TYPE " + name + " " + typ + "\n")
+}
+
+// Sample writes one sample of the current family.
+func (w *Writer) Sample(name string, labels Labels, v float64) {
+	w.write(name)
+	if len(labels) > 0 {
+		w.write("{")
+		for i := 0; i+1 < len(labels); i += 2 {
+			if i > 0 {
+				w.write(",")
+			}
+			w.write(labels[i] + `="` + labelReplacer.Replace(labels[i+1]) + `"`)
+		}
+		w.write("}")
+	}
+	w.write(" " + formatFloat(v) + "\n")
+}
+
+// Histogram writes h as the samples of a histogram family. The values of h
+// are multiplied by scale, µs to seconds for an RTT, and counted in the
+// buckets of the upper bounds; a bucket of h that straddles a bound is
+// counted above it.
+func (w *Writer) Histogram(name string, labels Labels, h *stat.Histogram, bounds []float64, scale float64) {
+	counts := make([]int64, len(bounds))
+	h.Buckets(func(upper, count int64) {
+		v := float64(upper) * scale
+		for i, bound := range bounds {
+			if v <= bound {
+				counts[i] += count
+				return
+			}
+		}
+	})
+
+	var cumulative int64
+	for i, bound := range bounds {
+		cumulative += counts[i]
+		w.Sample(name+"_bucket", labels.With("le", formatFloat(bound)), float64(cumulative))
+	}
+	w.Sample(name+"_bucket", labels.With("le", "+Inf"), float64(h.Count()))
+	w.Sample(name+"_sum", labels, h.Sum()*scale)
+	w.Sample(name+"_count", labels, float64(h.Count()))
+}
+
+// Flush writes out the buffered samples and returns the first error.
+func (w *Writer) Flush() error {
+	if w.err == nil {
+		w.err = w.w.Flush()
+	}
+	return w.err
+}
+
+func (w *Writer) write(s string) {
+	if w.err == nil {
+		_, w.err = w.w.WriteString(s)
+	}
+}
+
+var (
+	helpReplacer  = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+	labelReplacer = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+)
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
@@ -0,0 +1,52 @@
+package metrics
+
+import (
+	"bytes"
+	"github.com/liuxp0827/Tcppass/stat"
+	"strings"
+	"testing"
+)
+
+func TestSampleEscaping(t *testing.T) {
+	var buf bytes.Buffer
+	w := NewWriter(&buf)
+	w.Family("requests_total", Counter, "Requests.\nAll of them.")
+	w.Sample("requests_total", Labels{"path", `/a"b\c`}, 3)
+	w.Sample("requests_total", nil, 0.5)
+	if err := w.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	want := "# HELP requests_total Requests.\\nAll of them.\n" +
+		"# TYPE requests_total counter\n" +
+		"requests_total{path=\"/a\\\"b\\\\c\"} 3\n" +
+		"requests_total 0.5\n"
+	if buf.String() != want {
+		t.Errorf("got\n%s\nwant\n%s", buf.String(), want)
+	}
+}
+
+func TestHistogram(t *testing.T) {
+	var h stat.Histogram
+	for _, us := range []int64{500, 900, 1500, 8000, 400000} {
+		h.Observe(us)
+	}
+
+	var buf bytes.Buffer
+	w := NewWriter(&buf)
+	w.Histogram("rtt_seconds", Labels{"service", "10.0.0.1:80"}, &h, []float64{0.001, 0.01, 0.1}, 1e-6)
+	w.Flush()
+
+	for _, line := range []string{
+		`rtt_seconds_bucket{service="10.0.0.1:80",le="0.001"} 2`,
+		`rtt_seconds_bucket{service="10.0.0.1:80",le="0.01"} 4`,
+		`rtt_seconds_bucket{service="10.0.0.1:80",le="0.1"} 4`,
+		`rtt_seconds_bucket{service="10.0.0.1:80",le="+Inf"} 5`,
+		`rtt_seconds_sum{service="10.0.0.1:80"} 0.4109`,
+		`rtt_seconds_count{service="10.0.0.1:80"} 5`,
+	} {
+		if !strings.Contains(buf.String(), line+"\n") {
+			t.Errorf("missing %q in\n%s", line, buf.String())
+		}
+	}
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"encoding/csv"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/liuxp0827/Tcppass/common/json"
+	"github.com/liuxp0827/Tcppass/flow"
+	"io"
+	"os"
+	"strconv"
+	"text/tabwriter"
+	"time"
+)
+
+// runQuery runs `tcppass query`, it prints the records of the database of a
+// sqlite sink and returns the exit code.
+func runQuery(args []string) int {
+	fs := flag.NewFlagSet("query", flag.ContinueOnError)
+	db := fs.String("db", "flows.db", "SQLite database of the sqlite sink")
+	from := fs.String("from", "", "Records since, RFC 3339 time or duration before now like 1h")
+	to := fs.String("to", "", "Records until, RFC 3339 time or duration before now")
+	ip := fs.String("ip", "", "Client or server ip")
+	port := fs.Int("port", 0, "Client or server port")
+	dpi := fs.String("dpi", "", "DPI type of the flows")
+	reason := fs.String("reason", "", "Close reason of the flows")
+	rttAbove := fs.Duration("rtt-above", 0, "Average rtt of the flows, or latency of the HTTP transactions, above")
+	rttBelow := fs.Duration("rtt-below", 0, "Average rtt of the flows, or latency of the HTTP transactions, below")
+	httpRecords := fs.Bool("http", false, "Query the HTTP transactions instead of the flows")
+	format := fs.String("format", "table", "Output format: table, csv or json")
+	limit := fs.Int("limit", 1000, "Maximum records, the latest ones are kept, 0 for no limit")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+
+	q := &flow.FlowQuery{
+		IP:          *ip,
+		Port:        *port,
+		DPIType:     *dpi,
+		CloseReason: *reason,
+		RTTAbove:    rttAbove.Nanoseconds() / 1000,
+		RTTBelow:    rttBelow.Nanoseconds() / 1000,
+		Limit:       *limit,
+	}
+	var err error
+	now := time.Now()
+	if q.From, err = parseQueryTime(*from, now); err != nil {
+		fmt.Fprintf(os.Stderr, "query: -from: %v\n", err)
+		return 2
+	}
+	if q.To, err = parseQueryTime(*to, now); err != nil {
+		fmt.Fprintf(os.Stderr, "query: -to: %v\n", err)
+		return 2
+	}
+
+	var write func(io.Writer, [][]string) error
+	switch *format {
+	case "table":
+		write = writeTable
+	case "csv":
+		write = writeCSV
+	case "json":
+	default:
+		fmt.Fprintf(os.Stderr, "query: unknown format %q\n", *format)
+		return 2
+	}
+
+	if _, err := os.Stat(*db); err != nil {
+		fmt.Fprintf(os.Stderr, "query: %v\n", err)
+		return 1
+	}
+	store, err := flow.OpenStore(*db)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "query: %v\n", err)
+		return 1
+	}
+	defer store.Close()
+
+	var records interface{}
+	var rows [][]string
+	if *httpRecords {
+		var rs []*flow.HTTPRecord
+		if rs, err = flow.QueryHTTP(store, q); err == nil {
+			records, rows = rs, httpRows(rs)
+		}
+	} else {
+		var rs []*flow.FlowRecord
+		if rs, err = flow.QueryFlows(store, q); err == nil {
+			records, rows = rs, flowRows(rs)
+		}
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "query: %v\n", err)
+		return 1
+	}
+
+	if write == nil {
+		err = writeJSONLines(os.Stdout, records)
+	} else {
+		err = write(os.Stdout, rows)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "query: %v\n", err)
+		return 1
+	}
+	return 0
+}
+
+// parseQueryTime parses an RFC 3339 time, or a duration before now.
+func parseQueryTime(s string, now time.Time) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, nil
+	}
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil || d < 0 {
+		return time.Time{}, errors.New("want an RFC 3339 time or a duration like 30m")
+	}
+	return now.Add(-d), nil
+}
+
+const queryTimeFormat = "2006-01-02 15:04:05.000"
+
+func flowRows(records []*flow.FlowRecord) [][]string {
+	rows := [][]string{{"ID", "KIND", "IFACE", "CLIENT", "SERVER", "FIRST SEEN", "DURATION",
+		"TX BYTES", "RX BYTES", "RTT", "DPI", "STATUS", "REASON"}}
+	for _, r := range records {
+		var rtt, status string
+		if r.RTT != nil {
+			rtt = (time.Duration(r.RTT.Avg) * time.Microsecond).String()
+		}
+		if r.HTTPStatus != 0 {
+			status = strconv.Itoa(r.HTTPStatus)
+		}
+		rows = append(rows, []string{
+			strconv.FormatInt(r.ID, 10), r.Kind, r.Iface,
+			hostPort(r.SrcIP, r.SrcPort), hostPort(r.DstIP, r.DstPort),
+			r.FirstSeen.Format(queryTimeFormat), r.Duration().String(),
+			strconv.FormatInt(r.TxBytes, 10), strconv.FormatInt(r.RxBytes, 10),
+			rtt, r.DPIType, status, r.CloseReason,
+		})
+	}
+	return rows
+}
+
+func httpRows(records []*flow.HTTPRecord) [][]string {
+	rows := [][]string{{"FLOW", "IFACE", "CLIENT", "SERVER", "TIME", "METHOD", "HOST", "URL", "STATUS", "LATENCY"}}
+	for _, r := range records {
+		rows = append(rows, []string{
+			strconv.FormatInt(r.FlowID, 10), r.Iface,
+			hostPort(r.SrcIP, r.SrcPort), hostPort(r.DstIP, r.DstPort),
+			r.Time.Format(queryTimeFormat), r.Method, r.Host, r.URL,
+			strconv.Itoa(r.Status), (time.Duration(r.Latency) * time.Microsecond).String(),
+		})
+	}
+	return rows
+}
+
+func hostPort(ip string, port int) string {
+	if ip == "" {
+		return ""
+	}
+	return fmt.Sprintf("%s:%d", ip, port)
+}
+
+func writeTable(w io.Writer, rows [][]string) error {
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	for _, row := range rows {
+		for i, field := range row {
+			if i > 0 {
+				fmt.Fprint(tw, "\t")
+			}
+			if field == "" {
+				field = "-"
+			}
+			fmt.Fprint(tw, field)
+		}
+		fmt.Fprint(tw, "\n")
+	}
+	return tw.Flush()
+}
+
+func writeCSV(w io.Writer, rows [][]string) error {
+	cw := csv.NewWriter(w)
+	cw.WriteAll(rows)
+	return cw.Error()
+}
+
+// writeJSONLines writes the records one JSON object per line.
+func writeJSONLines(w io.Writer, records interface{}) error {
+	var lines [][]byte
+	switch rs := records.(type) {
+	case []*flow.FlowRecord:
+		for _, r := range rs {
+			line, err := json.Marshal(r)
+			if err != nil {
+				return err
+			}
+			lines = append(lines, line)
+		}
+	case []*flow.HTTPRecord:
+		for _, r := range rs {
+			line, err := json.Marshal(r)
+			if err != nil {
+				return err
+			}
+			lines = append(lines, line)
+		}
+	}
+
+	for _, line := range lines {
+		if _, err := w.Write(append(line, '\n')); err != nil {
+			return err
+		}
+	}
+	return nil
+}
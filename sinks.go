@@ -0,0 +1,65 @@
+package main
+
+import (
+	. "github.com/liuxp0827/Tcppass/common/config"
+	"github.com/liuxp0827/Tcppass/common/log"
+	"github.com/liuxp0827/Tcppass/flow"
+	"github.com/liuxp0827/Tcppass/tcpassembly"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+// udpFlows tracks the UDP flows for the sinks, nil without sinks.
+var udpFlows *flow.UDPTable
+
+// sinkHandler writes the records of the streams to the flow sinks.
+type sinkHandler struct {
+	tcpassembly.NopHandler
+}
+
+func (sinkHandler) OnTransaction(info *tcpassembly.StreamInfo, record *flow.HTTPRecord) {
+	flow.WriteHTTP(record)
+}
+
+func (sinkHandler) OnInterim(info *tcpassembly.StreamInfo, record *flow.FlowRecord) {
+	flow.WriteFlow(record)
+}
+
+func (sinkHandler) OnStreamClose(info *tcpassembly.StreamInfo, record *flow.FlowRecord) {
+	flow.WriteFlow(record)
+}
+
+// initSinks starts the configured flow sinks, it returns the handler feeding
+// them with the streams of pool or nil if none could be started.
+func initSinks(sinks []*SinkConfig, pool *tcpassembly.StreamPool) tcpassembly.Handler {
+	for _, conf := range sinks {
+		if err := flow.SetSink(conf); err != nil {
+			log.Errorf("%v", err)
+		}
+	}
+
+	if !flow.Enabled() {
+		return nil
+	}
+
+	udpFlows = flow.NewUDPTable(2 * time.Minute)
+
+	go closeOnSignal(pool)
+	return sinkHandler{}
+}
+
+// closeOnSignal writes out the records of the open streams and flows and the
+// queued records before exiting on SIGINT or SIGTERM.
+func closeOnSignal(pool *tcpassembly.StreamPool) {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, syscall.SIGINT, syscall.SIGTERM)
+	sig := <-c
+	log.Infof("%v received, close the flow sinks", sig)
+	// 先结束所有stream，它们的记录才能写入sink
+	pool.Flush()
+	udpFlows.Close()
+	flow.Close()
+	os.Exit(0)
+}
@@ -0,0 +1,200 @@
+package stat
+
+import (
+	"fmt"
+	"math"
+	"math/bits"
+)
+
+// subBuckets is the number of buckets per power of two, the relative error of
+// a quantile is at most 1/subBuckets.
+const subBucketBits = 3
+const subBuckets = 1 << subBucketBits
+
+// Histogram is a compact log-linear histogram of non negative values, such
+// as RTTs in µs. Two histograms can be merged without losing precision.
+type Histogram struct {
+	counts []uint32
+	count  int64
+	sum    float64
+	sumSq  float64
+	min    int64
+	max    int64
+}
+
+func bucketOf(v int64) int {
+	if v < subBuckets {
+		return int(v)
+	}
+	exp := bits.Len64(uint64(v)) - subBucketBits - 1
+	return (exp+1)*subBuckets + int(v>>uint(exp)) - subBuckets
+}
+
+// bucketRange returns the smallest and largest value of bucket i.
+func bucketRange(i int) (int64, int64) {
+	if i < subBuckets {
+		return int64(i), int64(i)
+	}
+	exp := uint(i/subBuckets - 1)
+	low := int64(i%subBuckets+subBuckets) << exp
+	return low, low + (1 << exp) - 1
+}
+
+func (h *Histogram) Observe(v int64) {
+	if v < 0 {
+		v = 0
+	}
+
+	i := bucketOf(v)
+	if i >= len(h.counts) {
+		counts := make([]uint32, i+1)
+		copy(counts, h.counts)
+		h.counts = counts
+	}
+	h.counts[i]++
+
+	if h.count == 0 || v < h.min {
+		h.min = v
+	}
+	if h.count == 0 || v > h.max {
+		h.max = v
+	}
+	h.count++
+	h.sum += float64(v)
+	h.sumSq += float64(v) * float64(v)
+}
+
+// Merge adds the samples of o to h.
+func (h *Histogram) Merge(o *Histogram) {
+	if o == nil || o.count == 0 {
+		return
+	}
+
+	if len(o.counts) > len(h.counts) {
+		counts := make([]uint32, len(o.counts))
+		copy(counts, h.counts)
+		h.counts = counts
+	}
+	for i, c := range o.counts {
+		h.counts[i] += c
+	}
+
+	if h.count == 0 || o.min < h.min {
+		h.min = o.min
+	}
+	if h.count == 0 || o.max > h.max {
+		h.max = o.max
+	}
+	h.count += o.count
+	h.sum += o.sum
+	h.sumSq += o.sumSq
+}
+
+func (h *Histogram) Reset() {
+	h.counts = h.counts[:0]
+	h.count = 0
+	h.sum = 0
+	h.sumSq = 0
+	h.min = 0
+	h.max = 0
+}
+
+func (h *Histogram) Count() int64 {
+	return h.count
+}
+
+func (h *Histogram) Sum() float64 {
+	return h.sum
+}
+
+func (h *Histogram) Min() int64 {
+	return h.min
+}
+
+func (h *Histogram) Max() int64 {
+	return h.max
+}
+
+func (h *Histogram) Mean() float64 {
+	if h.count == 0 {
+		return 0
+	}
+	return h.sum / float64(h.count)
+}
+
+// StdDev returns the standard deviation of the samples, the jitter of an RTT
+// histogram.
+func (h *Histogram) StdDev() float64 {
+	if h.count < 2 {
+		return 0
+	}
+	mean := h.Mean()
+	variance := h.sumSq/float64(h.count) - mean*mean
+	if variance < 0 {
+		return 0
+	}
+	return math.Sqrt(variance)
+}
+
+// Quantile returns an estimate of the q quantile, 0 <= q <= 1.
+func (h *Histogram) Quantile(q float64) int64 {
+	if h.count == 0 {
+		return 0
+	}
+
+	rank := int64(math.Ceil(q * float64(h.count)))
+	if rank <= 1 {
+		return h.min
+	}
+	if rank >= h.count {
+		return h.max
+	}
+
+	var seen int64
+	for i, c := range h.counts {
+		seen += int64(c)
+		if seen >= rank {
+			low, high := bucketRange(i)
+			v := low + (high-low)/2
+			if v < h.min {
+				v = h.min
+			}
+			if v > h.max {
+				v = h.max
+			}
+			return v
+		}
+	}
+	return h.max
+}
+
+// Buckets calls f with the upper bound and count of every non empty bucket,
+// in increasing order.
+func (h *Histogram) Buckets(f func(upper int64, count int64)) {
+	for i, c := range h.counts {
+		if c > 0 {
+			_, high := bucketRange(i)
+			f(high, int64(c))
+		}
+	}
+}
+
+// String formats the quantiles and jitter of a histogram of µs.
+func (h *Histogram) String() string {
+	if h.count == 0 {
+		return "-1"
+	}
+	return fmt.Sprintf("p50:%s/p90:%s/p99:%s/jitter:%s",
+		Microseconds(h.Quantile(0.5)), Microseconds(h.Quantile(0.9)),
+		Microseconds(h.Quantile(0.99)), Microseconds(int64(h.StdDev())))
+}
+
+// Microseconds formats a duration in µs with the unit of its magnitude.
+func Microseconds(us int64) string {
+	if us < 5000 {
+		return fmt.Sprintf("%d(µs)", us)
+	} else if us < 5*1000*1000 {
+		return fmt.Sprintf("%d(ms)", us/1000)
+	}
+	return fmt.Sprintf("%d(s)", us/(1000*1000))
+}
@@ -0,0 +1,72 @@
+package stat
+
+import (
+	"math"
+	"testing"
+)
+
+func TestHistogramQuantile(t *testing.T) {
+	var h Histogram
+	for v := int64(1); v <= 10000; v++ {
+		h.Observe(v)
+	}
+
+	if h.Count() != 10000 || h.Min() != 1 || h.Max() != 10000 {
+		t.Fatalf("count/min/max = %d/%d/%d", h.Count(), h.Min(), h.Max())
+	}
+
+	for _, q := range []float64{0.5, 0.9, 0.99} {
+		want := q * 10000
+		got := float64(h.Quantile(q))
+		if math.Abs(got-want)/want > 1.0/subBuckets {
+			t.Errorf("quantile %v = %v, want %v", q, got, want)
+		}
+	}
+
+	if h.Quantile(0) != 1 || h.Quantile(1) != 10000 {
+		t.Errorf("quantile 0/1 = %d/%d", h.Quantile(0), h.Quantile(1))
+	}
+}
+
+func TestHistogramMerge(t *testing.T) {
+	var a, b, all Histogram
+	for v := int64(0); v < 1000; v++ {
+		a.Observe(v * 3)
+		b.Observe(v*7 + 100000)
+		all.Observe(v * 3)
+		all.Observe(v*7 + 100000)
+	}
+
+	a.Merge(&b)
+	if a.Count() != all.Count() || a.Min() != all.Min() || a.Max() != all.Max() {
+		t.Fatalf("merged count/min/max = %d/%d/%d, want %d/%d/%d",
+			a.Count(), a.Min(), a.Max(), all.Count(), all.Min(), all.Max())
+	}
+
+	for _, q := range []float64{0.1, 0.5, 0.9, 0.99} {
+		if a.Quantile(q) != all.Quantile(q) {
+			t.Errorf("quantile %v = %d, want %d", q, a.Quantile(q), all.Quantile(q))
+		}
+	}
+
+	if math.Abs(a.StdDev()-all.StdDev()) > 1e-6 {
+		t.Errorf("stddev = %v, want %v", a.StdDev(), all.StdDev())
+	}
+}
+
+func TestHistogramStdDev(t *testing.T) {
+	var h Histogram
+	for i := 0; i < 100; i++ {
+		h.Observe(1000)
+	}
+	if h.StdDev() != 0 {
+		t.Errorf("stddev of a constant = %v", h.StdDev())
+	}
+
+	h.Reset()
+	h.Observe(900)
+	h.Observe(1100)
+	if h.Mean() != 1000 || h.StdDev() != 100 {
+		t.Errorf("mean/stddev = %v/%v, want 1000/100", h.Mean(), h.StdDev())
+	}
+}
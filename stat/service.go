@@ -0,0 +1,196 @@
+package stat
+
+import (
+	"github.com/liuxp0827/Tcppass/common/clock"
+	"github.com/liuxp0827/Tcppass/common/log"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Services aggregates the RTT of the streams per server ip:port.
+var Services = NewServiceStats("RTT", 60, 5, 1000)
+
+// Responses aggregates the server think time of the request/response turns
+// per server ip:port.
+var Responses = NewServiceStats("RESPONSE", 60, 5, 1000)
+
+// ServiceStats keeps one histogram of a metric in µs per service and per
+// window, the last windows are merged to report the rolling distribution of a
+// service.
+type ServiceStats struct {
+	mu       sync.Mutex
+	metric   string
+	window   time.Duration
+	windows  int
+	max      int
+	dropped  int64
+	services map[string]*serviceWindows
+}
+
+type serviceWindows struct {
+	start []time.Time
+	hists []Histogram
+	total Histogram // every sample since the service is tracked
+}
+
+// NewServiceStats creates the aggregation of metric in windows windows of
+// window seconds, tracking at most max services.
+func NewServiceStats(metric string, window, windows, max int) *ServiceStats {
+	if window <= 0 {
+		window = 60
+	}
+	if windows <= 0 {
+		windows = 1
+	}
+	return &ServiceStats{
+		metric:   metric,
+		window:   time.Duration(window) * time.Second,
+		windows:  windows,
+		max:      max,
+		services: make(map[string]*serviceWindows),
+	}
+}
+
+// Add merges h into the window of service that contains ts. Samples older
+// than the rolling windows are ignored, as are new services once max of them
+// are tracked.
+func (s *ServiceStats) Add(service string, ts time.Time, h *Histogram) {
+	if h == nil || h.Count() == 0 {
+		return
+	}
+
+	start := ts.Truncate(s.window)
+	i := int(start.Unix()/int64(s.window/time.Second)) % s.windows
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	w, ok := s.services[service]
+	if !ok {
+		if s.max > 0 && len(s.services) >= s.max {
+			s.dropped++
+			return
+		}
+		w = &serviceWindows{
+			start: make([]time.Time, s.windows),
+			hists: make([]Histogram, s.windows),
+		}
+		s.services[service] = w
+	}
+
+	w.total.Merge(h)
+	if start.Before(w.start[i]) {
+		return
+	}
+	if !start.Equal(w.start[i]) {
+		w.start[i] = start
+		w.hists[i].Reset()
+	}
+	w.hists[i].Merge(h)
+}
+
+// Get returns the histogram of service over the last n windows before now,
+// the window in progress included.
+func (s *ServiceStats) Get(service string, now time.Time, n int) Histogram {
+	var h Histogram
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if w, ok := s.services[service]; ok {
+		s.merge(w, now, n, &h)
+	}
+	return h
+}
+
+func (s *ServiceStats) merge(w *serviceWindows, now time.Time, n int, h *Histogram) {
+	oldest := now.Truncate(s.window).Add(-time.Duration(n-1) * s.window)
+	for i := range w.hists {
+		if !w.start[i].Before(oldest) && !w.start[i].After(now) {
+			h.Merge(&w.hists[i])
+		}
+	}
+}
+
+// Total returns the histogram of every sample of service since it is tracked,
+// it starts over once the service is forgotten.
+func (s *ServiceStats) Total(service string) Histogram {
+	var h Histogram
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if w, ok := s.services[service]; ok {
+		h.Merge(&w.total)
+	}
+	return h
+}
+
+// Services returns the names of the tracked services.
+func (s *ServiceStats) Services() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	names := make([]string, 0, len(s.services))
+	for name := range s.services {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Report logs, for every service, the window that just ended next to the
+// whole rolling period, so that a tail can be told from a shift of the mean.
+// Services without samples in the rolling period are forgotten.
+func (s *ServiceStats) Report(now time.Time) {
+	last := now.Add(-s.window)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	names := make([]string, 0, len(s.services))
+	for name, w := range s.services {
+		var rolling Histogram
+		s.merge(w, now, s.windows, &rolling)
+		if rolling.Count() == 0 {
+			delete(s.services, name)
+			continue
+		}
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		w := s.services[name]
+
+		var recent, rolling Histogram
+		s.merge(w, last, 1, &recent)
+		s.merge(w, last, s.windows, &rolling)
+		if recent.Count() == 0 {
+			continue
+		}
+
+		log.Alertf("[%s SERVICE] %s last %v[avg:%s %s|%d], last %v[avg:%s %s|%d]",
+			name, s.metric,
+			s.window, Microseconds(int64(recent.Mean())), recent.String(), recent.Count(),
+			s.window*time.Duration(s.windows), Microseconds(int64(rolling.Mean())), rolling.String(), rolling.Count(),
+		)
+	}
+
+	if s.dropped > 0 {
+		log.Warnf("[SERVICE] %s of %d streams of untracked services ignored, max is %d", s.metric, s.dropped, s.max)
+		s.dropped = 0
+	}
+}
+
+// Stat reports the services at the end of every window.
+func (s *ServiceStats) Stat() {
+	go func() {
+		ticker := clock.NewTicker(s.window)
+		defer ticker.Stop()
+		for now := range ticker.C {
+			s.Report(now)
+		}
+	}()
+}
@@ -2,8 +2,11 @@ package stat
 
 import (
 	"fmt"
+	"github.com/liuxp0827/Tcppass/common/clock"
 	"github.com/liuxp0827/Tcppass/common/log"
 	"runtime"
+	"sort"
+	"sync"
 	"sync/atomic"
 	"time"
 )
@@ -16,27 +19,68 @@ var RXPackets int64 = 0
 type Stats struct {
 	name      string
 	interval  int
+	done      chan struct{}
 	TXBytes   int64
 	RXBytes   int64
 	TXPackets int64
 	RXPackets int64
+
+	Streams    int64 // finished streams
+	Asymmetric int64 // finished streams with one direction missing in part or whole
+	Covered    int64 // sequence space covered by the finished streams
+	Missing    int64 // bytes of that space missing from the capture
+
+	mu       sync.Mutex
+	closes   map[string]int64 // finished streams by close reason
+	statuses map[int]int64    // HTTP responses by status
 }
 
+var (
+	allMu sync.Mutex
+	all   []*Stats
+)
+
+// NewStats creates the counters of iface, logged every interval seconds if
+// interval is positive.
 func NewStats(iface string, interval int) *Stats {
 	stat := Stats{
 		name:     iface,
 		interval: interval,
+		done:     make(chan struct{}),
+		closes:   make(map[string]int64),
+		statuses: make(map[int]int64),
+	}
+	if interval > 0 {
+		go stat.Stat()
 	}
-	go stat.Stat()
+
+	allMu.Lock()
+	all = append(all, &stat)
+	allMu.Unlock()
 	return &stat
 }
 
+// All returns the stats of the interfaces being captured, by name.
+func All() []*Stats {
+	allMu.Lock()
+	stats := make([]*Stats, len(all))
+	copy(stats, all)
+	allMu.Unlock()
+
+	sort.SliceStable(stats, func(i, j int) bool { return stats[i].name < stats[j].name })
+	return stats
+}
+
+func (s *Stats) Name() string {
+	return s.name
+}
+
 func (s *Stats) Stat() {
 	go func() {
-		ticker := time.NewTicker(time.Duration(s.interval) * time.Second)
+		ticker := clock.NewTicker(time.Duration(s.interval) * time.Second)
 		defer ticker.Stop()
-		var txBytes, txPackets, rxBytes, rxPackets int64
-		var oldtxBytes, oldtxPackets, oldrxBytes, oldrxPackets int64
+		var txBytes, txPackets, rxBytes, rxPackets, streams, asymmetric, covered, missing int64
+		var oldtxBytes, oldtxPackets, oldrxBytes, oldrxPackets, oldstreams, oldasymmetric, oldcovered, oldmissing int64
 
 		for {
 			select {
@@ -55,15 +99,54 @@ func (s *Stats) Stat() {
 					rxPackets-oldrxPackets,
 				)
 
+				streams = atomic.LoadInt64(&s.Streams)
+				asymmetric = atomic.LoadInt64(&s.Asymmetric)
+				covered = atomic.LoadInt64(&s.Covered)
+				missing = atomic.LoadInt64(&s.Missing)
+				if streams > oldstreams {
+					var loss float64
+					if covered > oldcovered {
+						loss = float64(missing-oldmissing) * 100 / float64(covered-oldcovered)
+					}
+					log.Alertf("[%s STAT] finished Streams[%d], Asymmetric[%d](%.1f%%), CaptureLoss[%s](%.2f%%)",
+						s.name,
+						streams-oldstreams,
+						asymmetric-oldasymmetric,
+						float64(asymmetric-oldasymmetric)*100/float64(streams-oldstreams),
+						bytes(missing-oldmissing),
+						loss,
+					)
+				}
+
+				oldstreams = streams
+				oldasymmetric = asymmetric
+				oldcovered = covered
+				oldmissing = missing
 				oldtxBytes = txBytes
 				oldtxPackets = txPackets
 				oldrxBytes = rxBytes
 				oldrxPackets = rxPackets
+			case <-s.done:
+				return
 			}
 		}
 	}()
 }
 
+// Close stops the periodic report.
+func (s *Stats) Close() {
+	close(s.done)
+
+	allMu.Lock()
+	for i, stat := range all {
+		if stat == s {
+			all = append(all[:i], all[i+1:]...)
+			break
+		}
+	}
+	allMu.Unlock()
+}
+
 func (s *Stats) AddTXBytes(bytes int64) {
 	atomic.AddInt64(&(s.TXBytes), bytes)
 }
@@ -80,6 +163,80 @@ func (s *Stats) AddRXPackets(packets int64) {
 	atomic.AddInt64(&(s.RXPackets), packets)
 }
 
+// AddStream counts a finished stream, asymmetric if the capture missed one of
+// its directions.
+func (s *Stats) AddStream(asymmetric bool) {
+	atomic.AddInt64(&(s.Streams), 1)
+	if asymmetric {
+		atomic.AddInt64(&(s.Asymmetric), 1)
+	}
+}
+
+// AddCoverage counts the sequence space covered by a finished stream and the
+// bytes of it the capture missed.
+func (s *Stats) AddCoverage(covered, missing int64) {
+	atomic.AddInt64(&(s.Covered), covered)
+	atomic.AddInt64(&(s.Missing), missing)
+}
+
+// AddClose counts a finished stream by its close reason.
+func (s *Stats) AddClose(reason string) {
+	s.mu.Lock()
+	s.closes[reason]++
+	s.mu.Unlock()
+}
+
+// AddHTTPStatus counts an HTTP response by its status.
+func (s *Stats) AddHTTPStatus(status int) {
+	s.mu.Lock()
+	s.statuses[status]++
+	s.mu.Unlock()
+}
+
+// Closes returns the finished streams by close reason.
+func (s *Stats) Closes() map[string]int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	closes := make(map[string]int64, len(s.closes))
+	for reason, n := range s.closes {
+		closes[reason] = n
+	}
+	return closes
+}
+
+// HTTPStatuses returns the HTTP responses by status.
+func (s *Stats) HTTPStatuses() map[int]int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	statuses := make(map[int]int64, len(s.statuses))
+	for status, n := range s.statuses {
+		statuses[status] = n
+	}
+	return statuses
+}
+
+// CaptureLoss returns the share of the sequence space of the finished streams
+// that the capture missed.
+func (s *Stats) CaptureLoss() float64 {
+	covered := atomic.LoadInt64(&(s.Covered))
+	if covered == 0 {
+		return 0
+	}
+	return float64(atomic.LoadInt64(&(s.Missing))) / float64(covered)
+}
+
+// AsymmetryRatio returns the share of the finished streams that were
+// asymmetric, a high ratio hints at a misplaced capture point.
+func (s *Stats) AsymmetryRatio() float64 {
+	streams := atomic.LoadInt64(&(s.Streams))
+	if streams == 0 {
+		return 0
+	}
+	return float64(atomic.LoadInt64(&(s.Asymmetric))) / float64(streams)
+}
+
 func (s *Stats) LoadTXBytes() int64 {
 	return atomic.LoadInt64(&(s.TXBytes))
 }
@@ -0,0 +1,278 @@
+package main
+
+import (
+	"fmt"
+	"github.com/liuxp0827/Tcppass/common/clock"
+	"github.com/liuxp0827/Tcppass/tcpassembly"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// streamEntry is an active stream in the list of /streams.
+type streamEntry struct {
+	ID         int64     `json:"id"`
+	Iface      string    `json:"iface"`
+	Client     string    `json:"client"`
+	Server     string    `json:"server"`
+	FirstSeen  time.Time `json:"firstSeen"`
+	LastSeen   time.Time `json:"lastSeen"`
+	Age        float64   `json:"age"`  // seconds since the first packet
+	Idle       float64   `json:"idle"` // seconds since the last packet
+	TxBytes    int64     `json:"txBytes"`
+	TxPackets  int64     `json:"txPackets"`
+	RxBytes    int64     `json:"rxBytes"`
+	RxPackets  int64     `json:"rxPackets"`
+	RTT        int64     `json:"rtt,omitempty"` // average in µs
+	DPIType    string    `json:"dpiType"`
+	HTTPStatus int       `json:"httpStatus,omitempty"`
+	Asymmetry  string    `json:"asymmetry,omitempty"`
+}
+
+func newStreamEntry(snap *tcpassembly.StreamSnapshot, now time.Time) *streamEntry {
+	r := snap.Record
+	e := &streamEntry{
+		ID:         r.ID,
+		Iface:      r.Iface,
+		Client:     net.JoinHostPort(r.SrcIP, strconv.Itoa(r.SrcPort)),
+		Server:     net.JoinHostPort(r.DstIP, strconv.Itoa(r.DstPort)),
+		FirstSeen:  r.FirstSeen,
+		LastSeen:   r.LastSeen,
+		Age:        now.Sub(r.FirstSeen).Seconds(),
+		Idle:       now.Sub(r.LastSeen).Seconds(),
+		TxBytes:    r.TxBytes,
+		TxPackets:  r.TxPackets,
+		RxBytes:    r.RxBytes,
+		RxPackets:  r.RxPackets,
+		DPIType:    r.DPIType,
+		HTTPStatus: r.HTTPStatus,
+		Asymmetry:  r.Asymmetry,
+	}
+	if r.RTT != nil {
+		e.RTT = r.RTT.Avg
+	}
+	return e
+}
+
+// streamFilter selects the streams of /streams, all the non-empty fields
+// must match.
+type streamFilter struct {
+	ip       string // client or server ip
+	port     int    // client or server port
+	iface    string
+	minAge   time.Duration
+	maxAge   time.Duration
+	minBytes int64 // both directions
+}
+
+func parseStreamFilter(r *http.Request) (*streamFilter, error) {
+	f := &streamFilter{
+		ip:    r.FormValue("ip"),
+		iface: r.FormValue("iface"),
+	}
+
+	var err error
+	if v := r.FormValue("port"); v != "" {
+		if f.port, err = strconv.Atoi(v); err != nil {
+			return nil, fmt.Errorf("bad port %q", v)
+		}
+	}
+	if v := r.FormValue("minAge"); v != "" {
+		if f.minAge, err = time.ParseDuration(v); err != nil {
+			return nil, fmt.Errorf("bad minAge %q", v)
+		}
+	}
+	if v := r.FormValue("maxAge"); v != "" {
+		if f.maxAge, err = time.ParseDuration(v); err != nil {
+			return nil, fmt.Errorf("bad maxAge %q", v)
+		}
+	}
+	if v := r.FormValue("minBytes"); v != "" {
+		if f.minBytes, err = strconv.ParseInt(v, 10, 64); err != nil {
+			return nil, fmt.Errorf("bad minBytes %q", v)
+		}
+	}
+	return f, nil
+}
+
+func (f *streamFilter) match(e *streamEntry, snap *tcpassembly.StreamSnapshot) bool {
+	r := snap.Record
+	age := time.Duration(e.Age * float64(time.Second))
+	switch {
+	case f.ip != "" && r.SrcIP != f.ip && r.DstIP != f.ip:
+	case f.port != 0 && r.SrcPort != f.port && r.DstPort != f.port:
+	case f.iface != "" && r.Iface != f.iface:
+	case f.minAge > 0 && age < f.minAge:
+	case f.maxAge > 0 && age > f.maxAge:
+	case f.minBytes > 0 && r.TxBytes+r.RxBytes < f.minBytes:
+	default:
+		return true
+	}
+	return false
+}
+
+// streamOrders are the sort keys of /streams.
+var streamOrders = map[string]func(a, b *streamEntry) bool{
+	"id":    func(a, b *streamEntry) bool { return a.ID < b.ID },
+	"age":   func(a, b *streamEntry) bool { return a.Age < b.Age },
+	"idle":  func(a, b *streamEntry) bool { return a.Idle < b.Idle },
+	"bytes": func(a, b *streamEntry) bool { return a.TxBytes+a.RxBytes < b.TxBytes+b.RxBytes },
+	"rtt":   func(a, b *streamEntry) bool { return a.RTT < b.RTT },
+}
+
+// streamPage sorts the streams of /streams and keeps the first of them.
+type streamPage struct {
+	less  func(a, b *streamEntry) bool
+	desc  bool
+	limit int // 0 for all the streams
+}
+
+// parseStreamPage reads sort (bytes by default), order desc or asc and limit
+// (100 by default).
+func parseStreamPage(r *http.Request) (*streamPage, error) {
+	sortKey := r.FormValue("sort")
+	if sortKey == "" {
+		sortKey = "bytes"
+	}
+	less, ok := streamOrders[sortKey]
+	if !ok {
+		return nil, fmt.Errorf("unknown sort %q", sortKey)
+	}
+
+	p := &streamPage{less: less, limit: 100}
+	switch order := r.FormValue("order"); order {
+	case "", "desc":
+		p.desc = true
+	case "asc":
+	default:
+		return nil, fmt.Errorf("unknown order %q", order)
+	}
+
+	if v := r.FormValue("limit"); v != "" {
+		limit, err := strconv.Atoi(v)
+		if err != nil || limit < 0 {
+			return nil, fmt.Errorf("bad limit %q", v)
+		}
+		p.limit = limit
+	}
+	return p, nil
+}
+
+// apply sorts entries and returns the first limit of them.
+func (p *streamPage) apply(entries []*streamEntry) []*streamEntry {
+	sort.SliceStable(entries, func(i, j int) bool {
+		if p.desc {
+			return p.less(entries[j], entries[i])
+		}
+		return p.less(entries[i], entries[j])
+	})
+
+	if p.limit > 0 && len(entries) > p.limit {
+		entries = entries[:p.limit]
+	}
+	return entries
+}
+
+// streamsList reports the active streams matching the filter, sorted and
+// limited as parseStreamPage reads.
+func streamsList(w http.ResponseWriter, r *http.Request) {
+	if captures == nil {
+		writeError(w, http.StatusServiceUnavailable, fmt.Errorf("no live capture"))
+		return
+	}
+
+	filter, err := parseStreamFilter(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	page, err := parseStreamPage(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	now := clock.Now()
+	var entries []*streamEntry
+	for _, snap := range captures.pool.Snapshots() {
+		if e := newStreamEntry(snap, now); filter.match(e, snap) {
+			entries = append(entries, e)
+		}
+	}
+
+	total := len(entries)
+	entries = page.apply(entries)
+	if entries == nil {
+		entries = []*streamEntry{}
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"total":   total,
+		"streams": entries,
+	})
+}
+
+// streamsDetail reports the state of the active stream id.
+func streamsDetail(w http.ResponseWriter, r *http.Request) {
+	if captures == nil {
+		writeError(w, http.StatusServiceUnavailable, fmt.Errorf("no live capture"))
+		return
+	}
+
+	id, err := strconv.ParseInt(r.FormValue("id"), 10, 64)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("bad stream id %q", r.FormValue("id")))
+		return
+	}
+
+	snap := captures.pool.Snapshot(id)
+	if snap == nil {
+		writeError(w, http.StatusNotFound, fmt.Errorf("no active stream %d", id))
+		return
+	}
+	writeJSON(w, http.StatusOK, snap)
+}
+
+// streamSummary is the report of /streams/summary.
+type streamSummary struct {
+	tcpassembly.PoolStats
+	TxBytes         int64          `json:"txBytes"`
+	RxBytes         int64          `json:"rxBytes"`
+	PendingRequests int            `json:"pendingRequests"`
+	OldestAge       float64        `json:"oldestAge"` // seconds
+	ByIface         map[string]int `json:"byIface"`
+	ByDPIType       map[string]int `json:"byDpiType"`
+}
+
+// streamsSummary reports the counters of the pool and the active streams by
+// interface and DPI type.
+func streamsSummary(w http.ResponseWriter, r *http.Request) {
+	if captures == nil {
+		writeError(w, http.StatusServiceUnavailable, fmt.Errorf("no live capture"))
+		return
+	}
+
+	sum := &streamSummary{
+		PoolStats: captures.pool.Stats(),
+		ByIface:   make(map[string]int),
+		ByDPIType: make(map[string]int),
+	}
+
+	now := clock.Now()
+	for _, snap := range captures.pool.Snapshots() {
+		r := snap.Record
+		sum.TxBytes += r.TxBytes
+		sum.RxBytes += r.RxBytes
+		if snap.PendingRequest {
+			sum.PendingRequests++
+		}
+		if age := now.Sub(r.FirstSeen).Seconds(); age > sum.OldestAge {
+			sum.OldestAge = age
+		}
+		sum.ByIface[r.Iface]++
+		sum.ByDPIType[r.DPIType]++
+	}
+	writeJSON(w, http.StatusOK, sum)
+}
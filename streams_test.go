@@ -0,0 +1,114 @@
+package main
+
+import (
+	"github.com/liuxp0827/Tcppass/flow"
+	"github.com/liuxp0827/Tcppass/tcpassembly"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestStreamFilter(t *testing.T) {
+	now := time.Unix(1500000000, 0)
+	snap := func(id int64, iface, server string, port int, age time.Duration, bytes int64) *tcpassembly.StreamSnapshot {
+		return &tcpassembly.StreamSnapshot{Record: &flow.FlowRecord{ID: id, Iface: iface, SrcIP: "10.0.0.1", SrcPort: 40000,
+			DstIP: server, DstPort: port, FirstSeen: now.Add(-age), LastSeen: now, TxBytes: bytes / 2, RxBytes: bytes - bytes/2}}
+	}
+	snaps := []*tcpassembly.StreamSnapshot{
+		snap(1, "eth0", "10.0.0.2", 443, 10*time.Second, 5000),
+		snap(2, "eth0", "10.0.0.3", 80, 2*time.Minute, 100),
+		snap(3, "eth1", "10.0.0.2", 80, time.Hour, 1<<20),
+	}
+
+	tests := []struct {
+		query string
+		want  []int64
+	}{
+		{"", []int64{1, 2, 3}},
+		{"ip=10.0.0.2", []int64{1, 3}},
+		{"ip=10.0.0.1&port=80", []int64{2, 3}},
+		{"port=40000&iface=eth0", []int64{1, 2}},
+		{"minAge=1m", []int64{2, 3}},
+		{"minAge=1m&maxAge=10m", []int64{2}},
+		{"minBytes=5000", []int64{1, 3}},
+		{"iface=eth2", nil},
+	}
+	for _, test := range tests {
+		f, err := parseStreamFilter(httptest.NewRequest("GET", "/streams?"+test.query, nil))
+		if err != nil {
+			t.Fatalf("%q: %v", test.query, err)
+		}
+		var got []int64
+		for _, snap := range snaps {
+			if f.match(newStreamEntry(snap, now), snap) {
+				got = append(got, snap.Record.ID)
+			}
+		}
+		if len(got) != len(test.want) {
+			t.Errorf("%q matched %v, want %v", test.query, got, test.want)
+			continue
+		}
+		for i := range got {
+			if got[i] != test.want[i] {
+				t.Errorf("%q matched %v, want %v", test.query, got, test.want)
+				break
+			}
+		}
+	}
+
+	for _, query := range []string{"port=http", "minAge=10", "maxAge=x", "minBytes=1k"} {
+		if _, err := parseStreamFilter(httptest.NewRequest("GET", "/streams?"+query, nil)); err == nil {
+			t.Errorf("%q accepted", query)
+		}
+	}
+}
+
+func TestStreamPage(t *testing.T) {
+	entries := func() []*streamEntry {
+		return []*streamEntry{
+			{ID: 1, Age: 10, Idle: 1, TxBytes: 300, RTT: 900},
+			{ID: 2, Age: 30, Idle: 5, TxBytes: 100, RTT: 100},
+			{ID: 3, Age: 20, Idle: 3, TxBytes: 50, RxBytes: 400, RTT: 500},
+		}
+	}
+
+	tests := []struct {
+		query string
+		want  []int64
+	}{
+		{"", []int64{3, 1, 2}}, // bytes desc
+		{"order=asc", []int64{2, 1, 3}},
+		{"sort=age&limit=2", []int64{2, 3}},
+		{"sort=idle&order=asc&limit=1", []int64{1}},
+		{"sort=rtt&order=desc", []int64{1, 3, 2}},
+		{"sort=id&limit=0", []int64{3, 2, 1}},
+		{"sort=id&order=asc&limit=10", []int64{1, 2, 3}},
+	}
+	for _, test := range tests {
+		p, err := parseStreamPage(httptest.NewRequest("GET", "/streams?"+test.query, nil))
+		if err != nil {
+			t.Fatalf("%q: %v", test.query, err)
+		}
+		got := p.apply(entries())
+		ok := len(got) == len(test.want)
+		for i := 0; ok && i < len(got); i++ {
+			ok = got[i].ID == test.want[i]
+		}
+		if !ok {
+			ids := make([]int64, len(got))
+			for i, e := range got {
+				ids[i] = e.ID
+			}
+			t.Errorf("%q listed %v, want %v", test.query, ids, test.want)
+		}
+	}
+
+	if p, _ := parseStreamPage(httptest.NewRequest("GET", "/streams", nil)); p == nil || p.limit != 100 {
+		t.Errorf("default page %+v", p)
+	}
+	for _, query := range []string{"sort=name", "order=up", "limit=-1", "limit=ten"} {
+		if _, err := parseStreamPage(httptest.NewRequest("GET", "/streams?"+query, nil)); err == nil {
+			t.Errorf("%q accepted", query)
+		}
+	}
+}
@@ -23,9 +23,9 @@ type Sequence int64
 // wrapping the uint32 space.
 func (s Sequence) Difference(t Sequence) int {
 	if s > uint32Max-uint32Max/4 && t < uint32Max/4 {
-		t += uint32Max
+		t += uint32Max + 1
 	} else if t > uint32Max-uint32Max/4 && s < uint32Max/4 {
-		s += uint32Max
+		s += uint32Max + 1
 	}
 	return int(t - s)
 }
@@ -41,4 +41,20 @@ type Reassembly struct {
 	Bytes []byte
 	Seen  time.Time
 	End   bool
+	SYN   bool
+	FIN   bool
+	ACK   bool
+}
+
+// Next returns the sequence number following the segment, SYN and FIN each
+// take one sequence number.
+func (r *Reassembly) Next() Sequence {
+	next := r.Seq.Add(len(r.Bytes))
+	if r.SYN {
+		next = next.Add(1)
+	}
+	if r.FIN {
+		next = next.Add(1)
+	}
+	return next
 }
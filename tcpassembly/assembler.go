@@ -9,34 +9,69 @@ import (
 
 type Assembler struct {
 	Iface      string
+	LinkType   layers.LinkType // link type of the raw packets, used by pcap export
 	stat       *stat.Stats
 	streamPool *StreamPool
 }
 
+// CaptureContext carries what the capture source knows about a packet beyond
+// its decoded TCP layer.
+type CaptureContext struct {
+	CaptureInfo  gopacket.CaptureInfo
+	Data         []byte // raw packet, may be nil
+	SamplingRate uint32 // 1 in SamplingRate packets was captured, 0 if not sampled
+
+	// PayloadLength is the TCP payload length of the segment on the wire
+	// when the capture truncated it, like the headers sampled by sFlow. 0
+	// means len(tcp.Payload).
+	PayloadLength int
+}
+
 func NewAssembler(Iface string, pool *StreamPool) *Assembler {
 	pool.mu.Lock()
 	pool.users++
 	pool.mu.Unlock()
-	stat := stat.NewStats(Iface, 10)
+	stat := stat.NewStats(Iface, pool.statInterval)
 	return &Assembler{
 		Iface:      Iface,
+		LinkType:   layers.LinkTypeEthernet,
 		stat:       stat,
 		streamPool: pool,
 	}
 }
 
+// Close releases the assembler, the streams it created are left to the pool.
+func (a *Assembler) Close() {
+	a.streamPool.mu.Lock()
+	a.streamPool.users--
+	a.streamPool.mu.Unlock()
+	a.stat.Close()
+}
+
 func (a *Assembler) Assemble(netFlow gopacket.Flow, tcp *layers.TCP, ts time.Time) {
+	a.AssembleWithContext(netFlow, tcp, &CaptureContext{CaptureInfo: gopacket.CaptureInfo{Timestamp: ts}})
+}
+
+func (a *Assembler) AssembleWithContext(netFlow gopacket.Flow, tcp *layers.TCP, ctx *CaptureContext) {
 	key := key{netFlow, tcp.TransportFlow()}
 	end := tcp.FIN || tcp.RST
+	ts := ctx.CaptureInfo.Timestamp
+
+	// 服务端的SYN-ACK也可以创建stream，非对称路由时可能只能看到这个方向
+	noCreate, create := end || (!tcp.SYN && !tcp.PSH && len(tcp.LayerPayload()) == 0), tcp.SYN
+	if ctx.SamplingRate > 1 {
+		// 采样的流量很少包含握手包，任意包都可以创建stream
+		noCreate, create = false, true
+	}
 
-	_stream := a.streamPool.getStream(key, a.stat, end || (!tcp.SYN && !tcp.PSH && len(tcp.LayerPayload()) == 0), tcp.SYN && !tcp.ACK, ts)
+	_stream := a.streamPool.getStream(key, a, noCreate, create, tcp, ts)
 
 	if _stream == nil {
 		//log.Errorf("key %s, Seq: %d, Ack: %d, FIN: %v, %s", key, tcp.Seq, tcp.Ack, tcp.FIN || tcp.RST, ts.Format("2006-01-02 15:04:05.999999"))
 		return
 	}
 	//log.Debugf("flow 111 key %s, Seq: %d, Ack: %d", key, tcp.Seq, tcp.Ack)
-	_stream.handle(key, tcp, ts)
+	_stream.handle(key, tcp, ctx)
 }
 
 func (a *Assembler) FlushOlderThan(t time.Time) time.Duration {
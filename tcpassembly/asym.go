@@ -0,0 +1,43 @@
+package tcpassembly
+
+// asymmetry tells which part of a stream the capture point did not see.
+type asymmetry int
+
+const (
+	asymNone    asymmetry = iota
+	asymC2SOnly           // no packet of the server, though the client acknowledged some
+	asymS2COnly           // no packet of the client
+	asymPartial           // the ACKs cover more data than was captured
+)
+
+var asymmetryNames = []string{"", "c2s-only", "s2c-only", "partial"}
+
+func (a asymmetry) String() string {
+	return asymmetryNames[a]
+}
+
+// asymmetry classifies the stream, routing that sends the two directions
+// through different paths leaves one of them out of the capture. Sampled
+// streams miss packets of both sides anyway and are not classified.
+func (s *stream) asymmetry() asymmetry {
+	switch {
+	case s.samplingRate > 1:
+		return asymNone
+	case s.c2s.Packets > 0 && s.s2c.Packets == 0 && s.c2s.ackSeen:
+		// 客户端只发送了SYN时服务端确实没有响应，不是抓包的问题
+		return asymC2SOnly
+	case s.c2s.Packets == 0 && s.s2c.Packets > 0:
+		return asymS2COnly
+	case s.c2s.inflight.ackedUnseen > s.c2s.Bytes || s.s2c.inflight.ackedUnseen > s.s2c.Bytes:
+		return asymPartial
+	}
+	return asymNone
+}
+
+// AsymStat flags a stream only partly seen by the capture.
+func (s *stream) AsymStat() string {
+	if a := s.asymmetry(); a != asymNone {
+		return " ASYM[" + a.String() + "]"
+	}
+	return ""
+}
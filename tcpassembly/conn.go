@@ -31,10 +31,19 @@ type conn struct {
 	cli2srv   bool
 	closed    bool // 已经关闭
 	waitClose bool // 收到FIN，RST 等待关闭
+	ackSeen   bool // 发送过ACK，即收到过对方的包
+	synSeen   bool // 发送过SYN，服务端即SYN-ACK
 
 	streamType int
 	dpiTotal   int
 
+	tsSeen  bool          // 发送过timestamps选项
+	tsvals  cache.TSCache // 本方向发送的TSval
+	TsRTT   rttStat       // 抓包点到本方向发送端的RTT，由timestamps得出
+	tsDelta rttStat       // 上次输出记录以来的TsRTT
+
+	inflight flightStat // 本方向发送数据的在途字节
+
 	Bytes      int64 // total bytes seen on this stream.
 	Packets    int64 // total packets seen on this stream.
 	OldBytes   int64 // old total bytes seen on this stream.
@@ -42,22 +51,33 @@ type conn struct {
 }
 
 func (s *stream) newConn(k key, cli2srv bool) *conn {
-	return &conn{
+	c := &conn{
 		key:        k,
 		s:          s,
 		cli2srv:    cli2srv,
 		streamType: dpi.UNKNOWN,
 	}
+	c.TsRTT.reset()
+	c.tsDelta.reset()
+	c.inflight.reset()
+	return c
 }
 
 func (c *conn) reset(k key, cli2srv bool) {
 	c.key = k
 	c.closed = false
 	c.waitClose = false
+	c.ackSeen = false
+	c.synSeen = false
 	c.streamType = dpi.UNKNOWN
 	c.dpiTotal = 0
 
 	c.cli2srv = cli2srv
+	c.tsSeen = false
+	c.tsvals.Reset()
+	c.TsRTT.reset()
+	c.tsDelta.reset()
+	c.inflight.reset()
 	c.Bytes = 0
 	c.Packets = 0
 	c.OldBytes = 0
@@ -71,7 +91,9 @@ func (c *conn) close() {
 	c.s.close(false)
 }
 
-func (c *conn) handle(tcp layers.TCP, ts time.Time) {
+// handle accounts a segment whose payload is length bytes on the wire, more
+// than len(tcp.Payload) if the capture truncated it.
+func (c *conn) handle(tcp layers.TCP, length int, ts time.Time) {
 	end := tcp.FIN || tcp.RST
 	if c.closed {
 		log.Warnf("conn %s is closed, seq:%d, ack:%d, len:%d, ts:%s",
@@ -81,6 +103,16 @@ func (c *conn) handle(tcp layers.TCP, ts time.Time) {
 
 	finish := false
 
+	if tcp.RST {
+		c.s.rst = true
+	}
+	if tcp.ACK {
+		c.ackSeen = true
+	}
+	if tcp.SYN {
+		c.synSeen = true
+	}
+
 	if end {
 		// 如果有两个方向的流，且同时都已经收到FIN或RST，则关闭
 		c.waitClose = true
@@ -95,76 +127,86 @@ func (c *conn) handle(tcp layers.TCP, ts time.Time) {
 		return
 	}
 
+	if c.s.samplingRate <= 1 {
+		c.timestamps(&tcp, ts)
+		if n, gap := c.flight(&tcp); n > 0 {
+			c.s.turn(c, n, ts)
+			if h := c.s.pool.handler; h != nil {
+				dir := ServerToClient
+				if c.cli2srv {
+					dir = ClientToServer
+				}
+				h.OnData(&c.s.info, dir, tcp.Payload[len(tcp.Payload)-n:], gap, ts)
+			}
+		}
+	}
+
 	c.stat(&Reassembly{
 		Seq:   seq,
 		Ack:   ack,
 		Bytes: bytes,
 		Seen:  ts,
 		End:   end,
-	})
+		SYN:   tcp.SYN,
+		FIN:   tcp.FIN,
+		ACK:   tcp.ACK,
+	}, length)
 
 	if finish {
 		c.close()
 	}
 }
 
-func (c *conn) stat(ret *Reassembly) {
+func (c *conn) stat(ret *Reassembly, length int) {
 	var value *cache.RTTCacheValue
 	var ok bool
 	var err error
 
-	bytes := int64(len(ret.Bytes))
+	// 采样流量按采样率放大
+	scale := int64(1)
+	if c.s.samplingRate > 1 {
+		scale = int64(c.s.samplingRate)
+	}
+
+	bytes := int64(length) * scale
 	c.Bytes += bytes
-	c.Packets += 1
+	c.Packets += scale
 
 	var rcKey cache.RTTCacheKey
 	if c.cli2srv { // client 2 server
 
-		if len(ret.Bytes) > 0 {
-			rcKey = cache.RTTCacheKey{c.key[0], c.key[1], ret.Seq + Sequence(len(ret.Bytes))}
-		} else {
-			rcKey = cache.RTTCacheKey{c.key[0], c.key[1], ret.Seq + 1}
+		// 只记录占用序列号的包，重传的包不参与RTT采样
+		if next := ret.Next(); next != ret.Seq && scale == 1 {
+			rcKey = cache.RTTCacheKey{c.key[0], c.key[1], next}
+			_, err = c.s.RttCache.Push(rcKey, ret.Seen)
 		}
-		_, err = c.s.RttCache.Push(rcKey, ret.Seen)
 
 		if err != nil {
-			log.Errorf("stream %s RttCache %v Push %s failed, %v", c.s.key, &(c.s.RttCache), rcKey, err)
+			log.Errorf("stream [%s] RttCache %v Push %s failed, %v", c.s.key, &(c.s.RttCache), rcKey, err)
 			return
 		}
 
 		c.s.stat.AddTXBytes(bytes)
-		c.s.stat.AddTXPackets(1)
+		c.s.stat.AddTXPackets(scale)
 
 	} else { // server 2 client
-		rcKey = cache.RTTCacheKey{c.key[0].Reverse(), c.key[1].Reverse(), ret.Ack}
-		value, ok, err = c.s.RttCache.Pull(rcKey)
+		if ret.ACK {
+			rcKey = cache.RTTCacheKey{c.key[0].Reverse(), c.key[1].Reverse(), ret.Ack}
+			value, ok, err = c.s.RttCache.Pull(rcKey)
+		}
 		if err != nil {
-			log.Errorf("stream %s RttCache %v Pull %s failed, %v", c.s.key, &(c.s.RttCache), rcKey, err)
+			log.Errorf("stream [%s] RttCache %v Pull %s failed, %v", c.s.key, &(c.s.RttCache), rcKey, err)
 			return
 		}
 
 		c.s.stat.AddRXBytes(bytes)
-		c.s.stat.AddRXPackets(1)
+		c.s.stat.AddRXPackets(scale)
 
 		if ok /*&& !ret.End*/ {
-			c.s.RttCount++
 			rtt := ret.Seen.Sub(value.Seen)
-			rttt := rtt.Nanoseconds() / (1000)
-			if rttt < 0 {
-				return
-			}
-
-			if c.s.RttCount == 1 {
-				c.s.SYNRTT = rttt
-			}
-
-			if rttt < c.s.MinRTT {
-				c.s.MinRTT = rttt
-			}
-			if rttt > c.s.MaxRTT {
-				c.s.MaxRTT = rttt
+			if rttt := rtt.Nanoseconds() / (1000); rttt >= 0 {
+				c.s.addRTTSample(estimatorSeq, c, rttt)
 			}
-			c.s.TotalRTT += rttt
 		}
 	}
 
@@ -0,0 +1,75 @@
+package tcpassembly
+
+import (
+	. "github.com/liuxp0827/Tcppass/common/config"
+	"github.com/liuxp0827/Tcppass/dpi"
+	"strconv"
+)
+
+type closeReason int
+
+const (
+	closeFIN closeReason = iota
+	closeRST
+	closeTimeout
+	closeReuse
+)
+
+var closeReasonNames = []string{"fin", "rst", "timeout", "reuse"}
+
+func (r closeReason) String() string {
+	return closeReasonNames[r]
+}
+
+func (r closeReason) finishString() string {
+	switch r {
+	case closeRST:
+		return "RST FINISH"
+	case closeTimeout:
+		return "TIMEOUT FINISH"
+	case closeReuse:
+		return "REUSE FINISH"
+	}
+	return "FINISH"
+}
+
+// matchExport reports whether the finished stream s should be written to a
+// pcap file according to the export rules.
+func matchExport(export *ExportConfig, s *stream) bool {
+	for _, rule := range export.Rules {
+		if matchRule(rule, s) {
+			return true
+		}
+	}
+	return false
+}
+
+func matchRule(rule *ExportRule, s *stream) bool {
+	if rule.CloseReason != "" && rule.CloseReason != s.closeReason.String() {
+		return false
+	}
+
+	if _, rtt := s.rtt(); rule.RTTAbove > 0 && (rtt.Count == 0 || rtt.Max <= rule.RTTAbove) {
+		return false
+	}
+
+	if rule.DPIType != "" && dpi.ParseType(rule.DPIType) != s.StreamType {
+		return false
+	}
+
+	if rule.StatusAbove > 0 && (s.Resp == nil || s.Resp.StatusCode <= rule.StatusAbove) {
+		return false
+	}
+
+	if len(rule.Ports) > 0 {
+		src, _ := strconv.Atoi(s.key[1].Src().String())
+		dst, _ := strconv.Atoi(s.key[1].Dst().String())
+		for _, port := range rule.Ports {
+			if port == src || port == dst {
+				return true
+			}
+		}
+		return false
+	}
+	return true
+}
@@ -0,0 +1,84 @@
+package tcpassembly
+
+import (
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	. "github.com/liuxp0827/Tcppass/common/config"
+	"github.com/liuxp0827/Tcppass/dpi"
+	"github.com/liuxp0827/Tcppass/httpassembly"
+	"net"
+	"net/http"
+	"testing"
+)
+
+func TestMatchRule(t *testing.T) {
+	s := &stream{
+		key: key{
+			gopacket.NewFlow(layers.EndpointIPv4, net.IP{10, 0, 0, 1}, net.IP{10, 0, 0, 2}),
+			gopacket.NewFlow(layers.EndpointTCPPort, []byte{0x9c, 0x40}, []byte{0, 80}),
+		},
+		c2s:         &conn{},
+		s2c:         &conn{},
+		closeReason: closeRST,
+		StreamType:  dpi.HTTP,
+		Resp:        &httpassembly.HTTPResponse{Response: &http.Response{StatusCode: 503}},
+	}
+	s.SeqRTT.reset()
+	s.SeqRTT.add(1000)
+	s.SeqRTT.add(30000)
+
+	tests := []struct {
+		name string
+		rule ExportRule
+		want bool
+	}{
+		{"empty rule", ExportRule{}, true},
+		{"close reason", ExportRule{CloseReason: "rst"}, true},
+		{"other close reason", ExportRule{CloseReason: "fin"}, false},
+		{"rtt above", ExportRule{RTTAbove: 29999}, true},
+		{"rtt equal", ExportRule{RTTAbove: 30000}, false},
+		{"dpi type", ExportRule{DPIType: "http"}, true},
+		{"other dpi type", ExportRule{DPIType: "unknown"}, false},
+		{"status above", ExportRule{StatusAbove: 499}, true},
+		{"status equal", ExportRule{StatusAbove: 503}, false},
+		{"server port", ExportRule{Ports: []int{443, 80}}, true},
+		{"client port", ExportRule{Ports: []int{40000}}, true},
+		{"other port", ExportRule{Ports: []int{443}}, false},
+		{"all fields", ExportRule{CloseReason: "rst", RTTAbove: 10000, DPIType: "http", StatusAbove: 499, Ports: []int{80}}, true},
+		{"one field fails", ExportRule{CloseReason: "rst", RTTAbove: 10000, DPIType: "http", StatusAbove: 499, Ports: []int{8080}}, false},
+	}
+	for _, test := range tests {
+		if got := matchRule(&test.rule, s); got != test.want {
+			t.Errorf("%s: got %v, want %v", test.name, got, test.want)
+		}
+	}
+
+	// 没有RTT样本或响应时，相应的条件不满足
+	plain := &stream{key: s.key, c2s: &conn{}, s2c: &conn{}, closeReason: closeFIN}
+	plain.SeqRTT.reset()
+	for _, rule := range []ExportRule{{RTTAbove: 1}, {StatusAbove: 1}} {
+		if matchRule(&rule, plain) {
+			t.Errorf("rule %+v matched a stream without samples", rule)
+		}
+	}
+}
+
+func TestMatchExport(t *testing.T) {
+	s := &stream{c2s: &conn{}, s2c: &conn{}, closeReason: closeTimeout}
+	s.SeqRTT.reset()
+
+	tests := []struct {
+		name  string
+		rules []*ExportRule
+		want  bool
+	}{
+		{"no rules", nil, false},
+		{"one matches", []*ExportRule{{CloseReason: "rst"}, {CloseReason: "timeout"}}, true},
+		{"none matches", []*ExportRule{{CloseReason: "rst"}, {RTTAbove: 1000}}, false},
+	}
+	for _, test := range tests {
+		if got := matchExport(&ExportConfig{Rules: test.rules}, s); got != test.want {
+			t.Errorf("%s: got %v, want %v", test.name, got, test.want)
+		}
+	}
+}
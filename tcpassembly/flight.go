@@ -0,0 +1,273 @@
+package tcpassembly
+
+import (
+	"encoding/binary"
+	"fmt"
+	"github.com/google/gopacket/layers"
+	. "github.com/liuxp0827/Tcppass/tcp"
+)
+
+// bulkBytes is the data a direction must carry before its transfer is
+// classified.
+const bulkBytes = 256 * 1024
+
+const defaultMSS = 1460
+
+// flightLimit tells what held back the sender of a bulk transfer.
+type flightLimit string
+
+const (
+	limitNone    = flightLimit("")
+	limitRwnd    = flightLimit("rwnd-limited")    // the receiver window was full
+	limitApp     = flightLimit("app-limited")     // the sender often had nothing to send
+	limitNetwork = flightLimit("network-limited") // neither, the congestion window was
+)
+
+// flightStat estimates the bytes in flight of the data sent by one direction
+// from its sequence numbers and the ACKs of the other direction. The in
+// flight bytes are those of the capture point, a round ends when the data in
+// flight at its start is acknowledged and its largest flight is taken as the
+// congestion window of the sender.
+type flightStat struct {
+	started bool
+	start   Sequence // first sequence seen
+	una     Sequence // oldest unacknowledged sequence
+	nxt     Sequence // next sequence to send
+	synSeen bool
+	wscale  int // window scale shift of the SYN, -1 without the option
+	mss     int
+	rwnd    int64 // last window advertised by the receiver, 0 if unknown
+
+	MaxInFlight, TotalInFlight, Samples int64
+
+	roundEnd Sequence
+	roundMax int64
+
+	MaxCwnd, TotalCwnd, Rounds int64
+
+	dataPackets int64
+	rwndLimited int64 // data sent with the receiver window full
+	pipeEmpty   int64 // data sent with nothing in flight
+	ackedUnseen int64 // data acknowledged but never captured
+	keepalives  int64 // keepalive probes sent
+
+	holes seqHoles // 序列号空间中没有抓到的部分
+}
+
+func (f *flightStat) reset() {
+	holes := f.holes
+	holes.reset()
+	*f = flightStat{wscale: -1, mss: defaultMSS, holes: holes}
+}
+
+func (f *flightStat) sample(flight int64) {
+	f.Samples++
+	f.TotalInFlight += flight
+	if flight > f.MaxInFlight {
+		f.MaxInFlight = flight
+	}
+	if flight > f.roundMax {
+		f.roundMax = flight
+	}
+}
+
+func (f *flightStat) endRound() {
+	if f.roundMax > 0 {
+		f.Rounds++
+		f.TotalCwnd += f.roundMax
+		if f.roundMax > f.MaxCwnd {
+			f.MaxCwnd = f.roundMax
+		}
+	}
+	f.roundEnd = f.nxt
+	f.roundMax = int64(f.una.Difference(f.nxt))
+}
+
+func (f *flightStat) avgInFlight() int64 {
+	if f.Samples == 0 {
+		return 0
+	}
+	return f.TotalInFlight / f.Samples
+}
+
+func (f *flightStat) avgCwnd() int64 {
+	if f.Rounds == 0 {
+		return f.roundMax
+	}
+	return f.TotalCwnd / f.Rounds
+}
+
+// limit classifies the transfer of a direction that carried bytes.
+func (f *flightStat) limit(bytes int64) flightLimit {
+	if bytes < bulkBytes || f.dataPackets == 0 {
+		return limitNone
+	}
+	if f.rwndLimited*2 > f.dataPackets {
+		return limitRwnd
+	}
+	if f.pipeEmpty*5 > f.dataPackets {
+		return limitApp
+	}
+	return limitNetwork
+}
+
+// synOptions returns the window scale shift and the MSS announced by a SYN.
+func synOptions(tcp *layers.TCP) (wscale, mss int) {
+	wscale, mss = -1, defaultMSS
+	for _, opt := range tcp.Options {
+		switch {
+		case opt.OptionType == layers.TCPOptionKindWindowScale && len(opt.OptionData) == 1:
+			wscale = int(opt.OptionData[0])
+			if wscale > 14 {
+				wscale = 14
+			}
+		case opt.OptionType == layers.TCPOptionKindMSS && len(opt.OptionData) == 2:
+			if v := int(binary.BigEndian.Uint16(opt.OptionData)); v > 0 {
+				mss = v
+			}
+		}
+	}
+	return
+}
+
+// keepalive reports whether a segment is a keepalive probe: at most
+// one byte below the next sequence, sent only to get an ACK back.
+func (f *flightStat) keepalive(seq Sequence, payload int, syn, fin bool) bool {
+	return f.started && !syn && !fin && payload <= 1 && seq == f.nxt.Add(-1)
+}
+
+// flight accounts the data sent by c and the ACK it carries for the data of
+// the reverse direction. It returns the payload bytes that were not sent
+// before and the bytes skipped just before them.
+func (c *conn) flight(tcp *layers.TCP) (n, gap int) {
+	f, r := &c.inflight, &c.reverse.inflight
+
+	if tcp.SYN {
+		f.synSeen = true
+		f.wscale, f.mss = synOptions(tcp)
+	}
+
+	seq := Sequence(tcp.Seq)
+	if f.keepalive(seq, len(tcp.Payload), tcp.SYN, tcp.FIN) && !tcp.RST {
+		f.keepalives++
+	}
+
+	ret := Reassembly{Seq: seq, Bytes: tcp.Payload, SYN: tcp.SYN, FIN: tcp.FIN}
+	if next := ret.Next(); next != seq {
+		if !f.started {
+			f.started = true
+			f.start, f.una, f.nxt, f.roundEnd = seq, seq, seq, next
+		}
+
+		if gap = f.nxt.Difference(seq); gap > 0 {
+			f.holes.open(f.nxt, seq)
+		} else if len(tcp.Payload) > 0 {
+			end := seq.Add(len(tcp.Payload))
+			if f.nxt.Difference(end) > 0 {
+				end = f.nxt
+			}
+			f.holes.fill(seq, end)
+		}
+
+		if len(tcp.Payload) > 0 {
+			flight := int64(f.una.Difference(f.nxt))
+			f.dataPackets++
+			if flight == 0 && f.dataPackets > 1 {
+				f.pipeEmpty++
+			}
+			if f.rwnd > 0 && flight+int64(len(tcp.Payload))+int64(f.mss) > f.rwnd {
+				f.rwndLimited++
+			}
+		}
+
+		if gap < 0 {
+			gap = 0
+		}
+
+		if len(tcp.Payload) > 0 {
+			if n = f.nxt.Difference(seq.Add(len(tcp.Payload))); n > len(tcp.Payload) {
+				n = len(tcp.Payload)
+			} else if n < 0 {
+				n = 0
+			}
+		}
+
+		if f.nxt.Difference(next) > 0 {
+			f.nxt = next
+		}
+		f.sample(int64(f.una.Difference(f.nxt)))
+	}
+
+	if !tcp.ACK {
+		return
+	}
+
+	if r.started {
+		ack := Sequence(tcp.Ack)
+		if r.una.Difference(ack) > 0 {
+			r.una = ack
+			if unseen := r.nxt.Difference(ack); unseen > 0 {
+				r.ackedUnseen += int64(unseen)
+				r.holes.open(r.nxt, ack)
+				r.nxt = ack
+			}
+			if r.roundEnd.Difference(ack) >= 0 {
+				r.endRound()
+			}
+		}
+	}
+
+	// 窗口扩大因子只有在双方的SYN中都出现时才生效，未见到SYN时窗口未知
+	if !tcp.SYN && f.synSeen && r.synSeen {
+		shift := uint(0)
+		if f.wscale >= 0 && r.wscale >= 0 {
+			shift = uint(f.wscale)
+		}
+		r.rwnd = int64(tcp.Window) << shift
+	}
+	return
+}
+
+// pathRTT returns the average RTT between the two ends in µs, or -1.
+func (s *stream) pathRTT() int64 {
+	if est, rtt := s.rtt(); est == estimatorTS {
+		if s.c2s.TsRTT.Count > 0 {
+			return rtt.avg() + s.c2s.TsRTT.avg()
+		}
+		return rtt.avg()
+	}
+	return s.SeqRTT.avg()
+}
+
+// FlightStat reports the bytes in flight, the congestion window, the
+// bandwidth-delay product and the limit of each direction that sent data.
+func (s *stream) FlightStat() string {
+	if s.c2s.inflight.dataPackets == 0 && s.s2c.inflight.dataPackets == 0 {
+		return ""
+	}
+
+	duration := s.lastSeen.Sub(s.firstSeen).Nanoseconds() / 1000
+	rtt := s.pathRTT()
+
+	return fmt.Sprintf(" FLIGHT[tx:%s, rx:%s]",
+		s.c2s.flightString(duration, rtt), s.s2c.flightString(duration, rtt))
+}
+
+func (c *conn) flightString(duration, rtt int64) string {
+	f := &c.inflight
+	if f.dataPackets == 0 {
+		return "-1"
+	}
+
+	bdp := "-1"
+	if duration > 0 && rtt > 0 {
+		bdp = byteSize(c.Bytes * rtt / duration)
+	}
+
+	str := fmt.Sprintf("max:%s/avg:%s/cwnd:%s/bdp:%s",
+		byteSize(f.MaxInFlight), byteSize(f.avgInFlight()), byteSize(f.avgCwnd()), bdp)
+	if limit := f.limit(c.Bytes); limit != limitNone {
+		str += " " + string(limit)
+	}
+	return str
+}
@@ -0,0 +1,185 @@
+package tcpassembly
+
+import (
+	"github.com/google/gopacket/layers"
+	"testing"
+)
+
+type segment struct {
+	server   bool
+	flags    string
+	seq, ack uint32
+	len      int
+	window   uint16
+	wscale   int // window scale option of a SYN, 0 without
+}
+
+// newConns returns the client and the server side of a stream.
+func newConns() (client, server *conn) {
+	client, server = &conn{}, &conn{}
+	client.reverse, server.reverse = server, client
+	client.inflight.reset()
+	server.inflight.reset()
+	return
+}
+
+// send feeds the segments to the flight accounting, it returns the new and
+// the skipped bytes of the client.
+func send(client, server *conn, segments []segment) (n, gap int) {
+	for _, seg := range segments {
+		tcp := &layers.TCP{Seq: seg.seq, Ack: seg.ack, Window: seg.window}
+		tcp.Payload = make([]byte, seg.len)
+		for _, f := range seg.flags {
+			switch f {
+			case 'S':
+				tcp.SYN = true
+			case 'A':
+				tcp.ACK = true
+			case 'F':
+				tcp.FIN = true
+			case 'R':
+				tcp.RST = true
+			}
+		}
+		if seg.wscale > 0 {
+			tcp.Options = append(tcp.Options, layers.TCPOption{OptionType: layers.TCPOptionKindWindowScale, OptionLength: 3, OptionData: []byte{byte(seg.wscale)}})
+		}
+
+		if seg.server {
+			server.flight(tcp)
+			continue
+		}
+		segN, segGap := client.flight(tcp)
+		n += segN
+		gap += segGap
+	}
+	return
+}
+
+// handshake opens a stream with the client ISN isn and the server ISN 5000.
+func handshake(isn uint32) []segment {
+	return []segment{
+		{flags: "S", seq: isn},
+		{server: true, flags: "SA", seq: 5000, ack: isn + 1, window: 65535},
+		{flags: "A", seq: isn + 1, ack: 5001, window: 65535},
+	}
+}
+
+func data(seq uint32, n int) segment {
+	return segment{flags: "A", seq: seq, ack: 5001, len: n, window: 65535}
+}
+
+func ack(seq uint32) segment {
+	return segment{server: true, flags: "A", seq: 5001, ack: seq, window: 65535}
+}
+
+func TestFlight(t *testing.T) {
+	// 第二个包跨越序列号回绕，之后的包先于它到达
+	wrap := uint32(0xFFFFFC00)
+
+	// n为新数据的字节数，乱序或重传填补的空洞不计入
+	tests := []struct {
+		name     string
+		isn      uint32
+		segments []segment
+
+		n, gap                   int
+		maxInFlight, maxCwnd     int64
+		rounds                   int64
+		missing, retrans, probes int64
+	}{
+		{"in flight", 1000, []segment{data(1001, 1000), data(2001, 1000), data(3001, 1000), ack(4001)},
+			3000, 0, 3000, 3000, 2, 0, 0, 0},
+		{"retransmission", 1000, []segment{data(1001, 1000), data(2001, 1000), data(1001, 1000)},
+			2000, 0, 2000, 1, 1, 0, 1000, 0},
+		{"out of order", 1000, []segment{data(1001, 1000), data(3001, 1000), data(2001, 1000)},
+			2000, 1000, 3000, 1, 1, 0, 1000, 0},
+		{"unfilled hole", 1000, []segment{data(1001, 1000), data(3001, 1000), ack(4001)},
+			2000, 1000, 3000, 3000, 2, 1000, 0, 0},
+		{"acked unseen", 1000, []segment{data(1001, 1000), ack(3001)},
+			1000, 0, 1000, 1000, 2, 1000, 0, 0},
+		{"wraparound", wrap, []segment{data(wrap+1, 1000), data(wrap+2001, 100), data(wrap+1001, 1000), ack(wrap + 2101)},
+			1100, 1000, 2100, 2100, 2, 0, 1000, 0},
+		{"keepalive", 1000, []segment{data(1001, 1000), ack(2001), data(2000, 1), data(2000, 0)},
+			1000, 0, 1000, 1000, 2, 0, 1, 2},
+	}
+	for _, test := range tests {
+		client, server := newConns()
+		n, gap := send(client, server, append(handshake(test.isn), test.segments...))
+		f := &client.inflight
+		if n != test.n || gap != test.gap {
+			t.Errorf("%s: new %d, gap %d, want %d, %d", test.name, n, gap, test.n, test.gap)
+		}
+		if f.MaxInFlight != test.maxInFlight || f.MaxCwnd != test.maxCwnd || f.Rounds != test.rounds {
+			t.Errorf("%s: in flight %d, cwnd %d, rounds %d", test.name, f.MaxInFlight, f.MaxCwnd, f.Rounds)
+		}
+		if f.holes.missing() != test.missing || f.holes.retrans != test.retrans || f.keepalives != test.probes {
+			t.Errorf("%s: missing %d, retrans %d, keepalives %d", test.name, f.holes.missing(), f.holes.retrans, f.keepalives)
+		}
+	}
+}
+
+func TestFlightWindow(t *testing.T) {
+	tests := []struct {
+		name           string
+		client, server int // window scale of the SYNs
+		syn            bool
+		want           int64
+	}{
+		{"scaled", 7, 8, true, 512 << 8},
+		{"client without scale", 0, 8, true, 512},
+		{"no syn", 7, 8, false, 0},
+	}
+	for _, test := range tests {
+		client, server := newConns()
+		var segments []segment
+		if test.syn {
+			segments = []segment{
+				{flags: "S", seq: 1000, wscale: test.client},
+				{server: true, flags: "SA", seq: 5000, ack: 1001, window: 65535, wscale: test.server},
+			}
+		}
+		segments = append(segments, data(1001, 1000), segment{server: true, flags: "A", seq: 5001, ack: 2001, window: 512})
+		send(client, server, segments)
+		if rwnd := client.inflight.rwnd; rwnd != test.want {
+			t.Errorf("%s: rwnd %d, want %d", test.name, rwnd, test.want)
+		}
+	}
+}
+
+func TestFlightLimit(t *testing.T) {
+	tests := []struct {
+		name                                string
+		bytes                               int64
+		dataPackets, rwndLimited, pipeEmpty int64
+		want                                flightLimit
+	}{
+		{"short transfer", bulkBytes - 1, 100, 100, 0, limitNone},
+		{"no data", bulkBytes, 0, 0, 0, limitNone},
+		{"receiver window", bulkBytes, 100, 51, 50, limitRwnd},
+		{"application", bulkBytes, 100, 50, 21, limitApp},
+		{"network", bulkBytes, 100, 50, 20, limitNetwork},
+	}
+	for _, test := range tests {
+		f := &flightStat{dataPackets: test.dataPackets, rwndLimited: test.rwndLimited, pipeEmpty: test.pipeEmpty}
+		if got := f.limit(test.bytes); got != test.want {
+			t.Errorf("%s: %q, want %q", test.name, got, test.want)
+		}
+	}
+}
+
+func TestFlightString(t *testing.T) {
+	c := &conn{Bytes: 1000000}
+	c.inflight = flightStat{MaxInFlight: 20000, TotalInFlight: 100000, Samples: 10, TotalCwnd: 40000, Rounds: 2, dataPackets: 100}
+
+	// BDP为吞吐量乘以RTT：1MB/s * 10ms
+	if got := c.flightString(1000000, 10000); got != "max:19KB/avg:9KB/cwnd:19KB/bdp:9KB network-limited" {
+		t.Errorf("flight %q", got)
+	}
+	if got := c.flightString(1000000, -1); got != "max:19KB/avg:9KB/cwnd:19KB/bdp:-1 network-limited" {
+		t.Errorf("flight without rtt %q", got)
+	}
+	if got := (&conn{}).flightString(1000000, 10000); got != "-1" {
+		t.Errorf("flight without data %q", got)
+	}
+}
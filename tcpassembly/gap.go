@@ -0,0 +1,94 @@
+package tcpassembly
+
+import (
+	"fmt"
+	"time"
+)
+
+// gapThresholds are the lengths of the idle gaps counted within a stream,
+// gaps of the first threshold or longer are idle time.
+var gapThresholds = [...]time.Duration{time.Second, 10 * time.Second, time.Minute}
+
+// gapStat measures the silences between the packets of a stream, they tell
+// an idle pooled connection from a slow application.
+type gapStat struct {
+	Gaps    [len(gapThresholds)]int64
+	Longest time.Duration
+	Idle    time.Duration
+}
+
+func (g *gapStat) add(gap time.Duration) {
+	if gap > g.Longest {
+		g.Longest = gap
+	}
+	if gap < gapThresholds[0] {
+		return
+	}
+
+	g.Idle += gap
+	for i, threshold := range gapThresholds {
+		if gap >= threshold {
+			g.Gaps[i]++
+		}
+	}
+}
+
+// gap accounts the silence before a packet of the stream seen at ts. The
+// interval only gets the part of it after the previous record, the part
+// before was reported as idle by that record.
+func (s *stream) gap(ts time.Time) {
+	if gap := ts.Sub(s.lastSeen); gap > 0 {
+		s.gaps.add(gap)
+	}
+	if gap := ts.Sub(s.intervalIdleSince()); gap > 0 {
+		s.gapsInterval.add(gap)
+	}
+}
+
+// intervalIdleSince returns when the current silence of the interval began,
+// at the last packet or at the previous record.
+func (s *stream) intervalIdleSince() time.Time {
+	if s.lastRecord.After(s.lastSeen) {
+		return s.lastRecord
+	}
+	return s.lastSeen
+}
+
+// endGaps starts the gap accounting of the next interval.
+func (s *stream) endGaps() {
+	s.gapsInterval = gapStat{}
+	s.keepalivesRecord = s.c2s.inflight.keepalives + s.s2c.inflight.keepalives
+}
+
+// idle returns the gaps, the active time and the keepalive probes of the
+// stream once it finished, or else of the interval from the previous record
+// to now, the silence since the last packet counted as idle.
+func (s *stream) idle(finish bool, now time.Time) (g gapStat, active time.Duration, keepalives int64) {
+	keepalives = s.c2s.inflight.keepalives + s.s2c.inflight.keepalives
+	duration := s.lastSeen.Sub(s.firstSeen)
+	if finish {
+		g = s.gaps
+	} else {
+		g, duration = s.gapsInterval, now.Sub(s.lastRecord)
+		if gap := now.Sub(s.intervalIdleSince()); gap > 0 {
+			g.add(gap)
+		}
+		keepalives -= s.keepalivesRecord
+	}
+
+	active = duration - g.Idle
+	if active < 0 {
+		active = 0
+	}
+	return
+}
+
+// IdleStat reports the idle and active time of the stream with its gaps and
+// keepalive probes. For an interim record it covers the interval until now.
+func (s *stream) IdleStat(finish bool, now time.Time) string {
+	g, active, keepalives := s.idle(finish, now)
+	return fmt.Sprintf(" IDLE[idle:%v/active:%v, gaps>%v:%d/>%v:%d/>%v:%d, max:%v, keepalive:%d]",
+		g.Idle, active,
+		gapThresholds[0], g.Gaps[0], gapThresholds[1], g.Gaps[1], gapThresholds[2], g.Gaps[2],
+		g.Longest, keepalives)
+}
@@ -0,0 +1,59 @@
+package tcpassembly
+
+import (
+	"testing"
+	"time"
+)
+
+func TestGapStat(t *testing.T) {
+	var g gapStat
+	for _, gap := range []time.Duration{100 * time.Millisecond, time.Second, 15 * time.Second, 2 * time.Minute, 999 * time.Millisecond} {
+		g.add(gap)
+	}
+	if g.Gaps != [len(gapThresholds)]int64{3, 2, 1} {
+		t.Errorf("gaps %v", g.Gaps)
+	}
+	if g.Idle != time.Second+15*time.Second+2*time.Minute || g.Longest != 2*time.Minute {
+		t.Errorf("idle %v, longest %v", g.Idle, g.Longest)
+	}
+}
+
+func TestIdleStat(t *testing.T) {
+	start := time.Unix(1500000000, 0)
+	at := func(d time.Duration) time.Time { return start.Add(d) }
+	s := &stream{firstSeen: start, lastSeen: start, lastRecord: start, c2s: &conn{}, s2c: &conn{}}
+	packet := func(d time.Duration) {
+		s.gap(at(d))
+		s.lastSeen = at(d)
+	}
+	interim := func(d time.Duration) {
+		s.endGaps()
+		s.lastRecord = at(d)
+	}
+	check := func(name string, finish bool, now time.Duration, idle, active time.Duration, gaps [len(gapThresholds)]int64, longest time.Duration) {
+		g, a, _ := s.idle(finish, at(now))
+		if g.Idle != idle || a != active || g.Gaps != gaps || g.Longest != longest {
+			t.Errorf("%s: idle %v, active %v, gaps %v, longest %v", name, g.Idle, a, g.Gaps, g.Longest)
+		}
+	}
+
+	packet(100 * time.Millisecond)
+	// 整个区间空闲，正在进行的空闲也计入
+	check("idle interval", false, 30*time.Second, 29900*time.Millisecond, 100*time.Millisecond, [...]int64{1, 1, 0}, 29900*time.Millisecond)
+	interim(30 * time.Second)
+
+	// 跨越记录时间的gap被分开，后一个区间只计入记录之后的部分
+	packet(45 * time.Second)
+	packet(45500 * time.Millisecond)
+	check("split gap", false, 50*time.Second, 19500*time.Millisecond, 500*time.Millisecond, [...]int64{2, 1, 0}, 15*time.Second)
+	interim(50 * time.Second)
+
+	check("no packet", false, 60*time.Second, 10*time.Second, 0, [...]int64{1, 1, 0}, 10*time.Second)
+
+	// 整个stream的统计不分区间
+	check("finish", true, 0, 44900*time.Millisecond, 600*time.Millisecond, [...]int64{1, 1, 0}, 44900*time.Millisecond)
+
+	if got := s.IdleStat(false, at(60*time.Second)); got != " IDLE[idle:10s/active:0s, gaps>1s:1/>10s:1/>1m0s:0, max:10s, keepalive:0]" {
+		t.Errorf("IdleStat %q", got)
+	}
+}
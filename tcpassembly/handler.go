@@ -0,0 +1,193 @@
+package tcpassembly
+
+import (
+	"github.com/google/gopacket"
+	"github.com/liuxp0827/Tcppass/dpi"
+	"github.com/liuxp0827/Tcppass/flow"
+	"time"
+)
+
+// Direction tells which side of a stream sent some data.
+type Direction int
+
+const (
+	ClientToServer Direction = iota
+	ServerToClient
+)
+
+func (d Direction) String() string {
+	if d == ClientToServer {
+		return "c2s"
+	}
+	return "s2c"
+}
+
+// StreamInfo identifies a stream in the events of a Handler.
+type StreamInfo struct {
+	ID        int64
+	Iface     string
+	Net       gopacket.Flow // client -> server
+	Transport gopacket.Flow // client -> server
+	FirstSeen time.Time
+}
+
+// Handler receives the events of the streams of a StreamPool. The events of
+// one stream are delivered in order from the goroutine of the stream, the
+// methods must not block.
+type Handler interface {
+	OnStreamOpen(info *StreamInfo)
+	// OnData is called with the payload sent by dir that was not seen
+	// before, gap is the number of bytes missing from the capture just
+	// before it.
+	OnData(info *StreamInfo, dir Direction, data []byte, gap int, ts time.Time)
+	OnTransaction(info *StreamInfo, record *flow.HTTPRecord)
+	// OnInterim is called every active timeout of a long-lived stream
+	// with what it did since its previous record, record.Final is false.
+	OnInterim(info *StreamInfo, record *flow.FlowRecord)
+	OnStreamClose(info *StreamInfo, record *flow.FlowRecord)
+}
+
+// NopHandler ignores every event, embed it to implement some of them only.
+type NopHandler struct{}
+
+func (NopHandler) OnStreamOpen(info *StreamInfo) {}
+
+func (NopHandler) OnData(info *StreamInfo, dir Direction, data []byte, gap int, ts time.Time) {}
+
+func (NopHandler) OnTransaction(info *StreamInfo, record *flow.HTTPRecord) {}
+
+func (NopHandler) OnInterim(info *StreamInfo, record *flow.FlowRecord) {}
+
+func (NopHandler) OnStreamClose(info *StreamInfo, record *flow.FlowRecord) {}
+
+type multiHandler []Handler
+
+// MultiHandler returns a Handler that passes every event to handlers in turn.
+func MultiHandler(handlers ...Handler) Handler {
+	return multiHandler(handlers)
+}
+
+func (m multiHandler) OnStreamOpen(info *StreamInfo) {
+	for _, h := range m {
+		h.OnStreamOpen(info)
+	}
+}
+
+func (m multiHandler) OnData(info *StreamInfo, dir Direction, data []byte, gap int, ts time.Time) {
+	for _, h := range m {
+		h.OnData(info, dir, data, gap, ts)
+	}
+}
+
+func (m multiHandler) OnTransaction(info *StreamInfo, record *flow.HTTPRecord) {
+	for _, h := range m {
+		h.OnTransaction(info, record)
+	}
+}
+
+func (m multiHandler) OnInterim(info *StreamInfo, record *flow.FlowRecord) {
+	for _, h := range m {
+		h.OnInterim(info, record)
+	}
+}
+
+func (m multiHandler) OnStreamClose(info *StreamInfo, record *flow.FlowRecord) {
+	for _, h := range m {
+		h.OnStreamClose(info, record)
+	}
+}
+
+// record summarizes the stream so far, final once it finished.
+func (s *stream) record(final bool) *flow.FlowRecord {
+	r := &flow.FlowRecord{
+		Kind:           flow.KindTCP,
+		ID:             s.id,
+		Iface:          s.iface,
+		FirstSeen:      s.firstSeen,
+		LastSeen:       s.lastSeen,
+		Final:          final,
+		TxBytes:        s.c2s.Bytes,
+		TxPackets:      s.c2s.Packets,
+		RxBytes:        s.s2c.Bytes,
+		RxPackets:      s.s2c.Packets,
+		TxRetransBytes: s.c2s.inflight.holes.retrans,
+		RxRetransBytes: s.s2c.inflight.holes.retrans,
+		CaptureLoss:    s.c2s.inflight.holes.missing() + s.s2c.inflight.holes.missing(),
+		DPIType:        dpi.TypeName(s.StreamType),
+		Asymmetry:      s.asymmetry().String(),
+		LowConfidence:  s.lowConfidence(),
+		SamplingRate:   s.samplingRate,
+		Unanswered:     s.synSeen && !s.s2c.synSeen,
+	}
+	r.SetEndpoints(s.key[0], s.key[1])
+
+	if final {
+		r.CloseReason = s.closeReason.String()
+	}
+
+	if s.Resp != nil {
+		r.HTTPStatus = s.Resp.StatusCode
+	}
+
+	r.RTT = rttStats(s.rtt())
+	s.setIdle(r, true, s.lastSeen)
+	return r
+}
+
+// interimRecord describes the interval since the previous record, from
+// lastRecord to now, it must be built before the interval ends.
+func (s *stream) interimRecord(now time.Time) *flow.FlowRecord {
+	r := s.record(false)
+	r.FirstSeen, r.LastSeen = s.lastRecord, now
+	r.TxBytes, r.TxPackets = s.c2s.Bytes-s.c2s.OldBytes, s.c2s.Packets-s.c2s.OldPackets
+	r.RxBytes, r.RxPackets = s.s2c.Bytes-s.s2c.OldBytes, s.s2c.Packets-s.s2c.OldPackets
+	r.TxRetransBytes, r.RxRetransBytes, r.CaptureLoss = 0, 0, 0 // 只在最终记录中
+	r.RTT = rttStats(s.rttDelta())
+	s.setIdle(r, false, now)
+	return r
+}
+
+// setIdle fills the idle time, the gaps and the keepalive probes of r.
+func (s *stream) setIdle(r *flow.FlowRecord, finish bool, now time.Time) {
+	g, active, keepalives := s.idle(finish, now)
+	r.IdleTime, r.ActiveTime = g.Idle.Microseconds(), active.Microseconds()
+	r.Gaps, r.LongestGap = g.Gaps[0], g.Longest.Microseconds()
+	r.Keepalives = keepalives
+}
+
+func rttStats(est rttEstimator, rtt *rttStat) *flow.RTTStats {
+	if rtt.Count == 0 {
+		return nil
+	}
+	return &flow.RTTStats{
+		Estimator: string(est),
+		Count:     rtt.Count,
+		First:     rtt.First,
+		Min:       rtt.Min,
+		Max:       rtt.Max,
+		Avg:       rtt.avg(),
+		P50:       rtt.Hist.Quantile(0.5),
+		P90:       rtt.Hist.Quantile(0.9),
+		P99:       rtt.Hist.Quantile(0.99),
+		Jitter:    int64(rtt.Hist.StdDev()),
+	}
+}
+
+// httpRecord describes the last HTTP transaction of the stream.
+func (s *stream) httpRecord() *flow.HTTPRecord {
+	r := &flow.HTTPRecord{
+		Kind:    flow.KindHTTP,
+		FlowID:  s.id,
+		Iface:   s.iface,
+		Time:    s.Req.GetTimestamp(),
+		Method:  s.Req.Method,
+		Host:    s.Req.Host,
+		Status:  s.Resp.StatusCode,
+		Latency: s.Resp.GetTimestamp().Sub(s.Req.GetTimestamp()).Nanoseconds() / 1000,
+	}
+	if s.Req.URL != nil {
+		r.URL = s.Req.URL.String()
+	}
+	r.SetEndpoints(s.key[0], s.key[1])
+	return r
+}
@@ -0,0 +1,135 @@
+package tcpassembly
+
+import (
+	"fmt"
+	. "github.com/liuxp0827/Tcppass/tcp"
+)
+
+// maxHoles bounds the sequence ranges tracked per direction, the oldest hole
+// is given up as lost when a new one does not fit.
+const maxHoles = 64
+
+// lowConfidenceLoss is the share of the sequence space missing from the
+// capture above which the metrics of a stream are not trusted.
+const lowConfidenceLoss = 0.01
+
+type seqRange struct {
+	start, end Sequence
+}
+
+// seqHoles tracks the sequence ranges of one direction that were skipped by
+// the captured segments. A hole filled later was a segment lost on the way
+// to the capture point and retransmitted by the sender, a hole that stays
+// open was acknowledged by the receiver and therefore dropped by the capture.
+type seqHoles struct {
+	holes   []seqRange
+	given   int64 // bytes of the holes evicted from the list
+	filled  int64 // bytes of the holes filled by retransmissions
+	retrans int64 // payload bytes sent again below the highest sequence
+}
+
+func (h *seqHoles) reset() {
+	h.holes = h.holes[:0]
+	h.given = 0
+	h.filled = 0
+	h.retrans = 0
+}
+
+// open adds the hole [start, end).
+func (h *seqHoles) open(start, end Sequence) {
+	if start.Difference(end) <= 0 {
+		return
+	}
+	if len(h.holes) == maxHoles {
+		h.given += int64(h.holes[0].start.Difference(h.holes[0].end))
+		h.holes = h.holes[1:]
+	}
+	h.holes = append(h.holes, seqRange{start, end})
+}
+
+// fill removes the range [start, end) of a retransmitted segment from the
+// holes.
+func (h *seqHoles) fill(start, end Sequence) {
+	h.retrans += int64(start.Difference(end))
+
+	holes := h.holes[:0]
+	for _, r := range h.holes {
+		if end.Difference(r.start) >= 0 || r.end.Difference(start) >= 0 {
+			holes = append(holes, r)
+			continue
+		}
+
+		if r.start.Difference(start) > 0 {
+			holes = append(holes, seqRange{r.start, start})
+		}
+		if end.Difference(r.end) > 0 {
+			holes = append(holes, seqRange{end, r.end})
+		}
+
+		low, high := r.start, r.end
+		if low.Difference(start) > 0 {
+			low = start
+		}
+		if end.Difference(high) > 0 {
+			high = end
+		}
+		h.filled += int64(low.Difference(high))
+	}
+	h.holes = holes
+}
+
+// missing returns the bytes the capture never saw.
+func (h *seqHoles) missing() int64 {
+	n := h.given
+	for _, r := range h.holes {
+		n += int64(r.start.Difference(r.end))
+	}
+	return n
+}
+
+// covered returns the sequence space advanced by the data and the ACKs of
+// the direction.
+func (f *flightStat) covered() int64 {
+	if !f.started {
+		return 0
+	}
+	return int64(f.start.Difference(f.nxt))
+}
+
+// captureLoss returns the share of the covered sequence space that is
+// missing from the capture.
+func (f *flightStat) captureLoss() float64 {
+	covered := f.covered()
+	if covered <= 0 {
+		return 0
+	}
+	return float64(f.holes.missing()) / float64(covered)
+}
+
+// lowConfidence reports whether the capture missed enough of the stream to
+// distort its other metrics.
+func (s *stream) lowConfidence() bool {
+	return s.samplingRate > 1 || s.asymmetry() != asymNone ||
+		s.c2s.inflight.captureLoss() > lowConfidenceLoss || s.s2c.inflight.captureLoss() > lowConfidenceLoss
+}
+
+// LossStat reports per direction the bytes missing from the capture and the
+// bytes retransmitted by the sender, and whether the stream can be trusted.
+func (s *stream) LossStat() string {
+	if s.samplingRate > 1 {
+		return " CONFIDENCE[low]"
+	}
+
+	confidence := "high"
+	if s.lowConfidence() {
+		confidence = "low"
+	}
+	return fmt.Sprintf(" LOSS[tx:%s, rx:%s] CONFIDENCE[%s]", s.c2s.inflight.lossString(), s.s2c.inflight.lossString(), confidence)
+}
+
+func (f *flightStat) lossString() string {
+	if !f.started {
+		return "-1"
+	}
+	return fmt.Sprintf("cap:%s(%.2f%%)/retx:%s", byteSize(f.holes.missing()), f.captureLoss()*100, byteSize(f.holes.retrans))
+}
@@ -0,0 +1,84 @@
+package tcpassembly
+
+import (
+	"fmt"
+	. "github.com/liuxp0827/Tcppass/tcp"
+	"testing"
+)
+
+func TestSeqHoles(t *testing.T) {
+	type op struct {
+		fill       bool
+		start, end uint32
+	}
+	open := func(start, end uint32) op { return op{false, start, end} }
+	fill := func(start, end uint32) op { return op{true, start, end} }
+
+	tests := []struct {
+		name    string
+		ops     []op
+		holes   string
+		missing int64
+		filled  int64
+		retrans int64
+	}{
+		{"open", []op{open(100, 200)}, "[{100 200}]", 100, 0, 0},
+		{"empty range", []op{open(200, 200), open(200, 100)}, "[]", 0, 0, 0},
+		{"filled", []op{open(100, 200), fill(100, 200)}, "[]", 0, 100, 100},
+		{"split", []op{open(100, 200), fill(120, 150)}, "[{100 120} {150 200}]", 70, 30, 30},
+		{"overlapping fill", []op{open(100, 200), fill(50, 250)}, "[]", 0, 100, 200},
+		{"fill across holes", []op{open(100, 200), open(300, 400), fill(150, 350)}, "[{100 150} {350 400}]", 100, 100, 200},
+		{"retransmission outside", []op{open(100, 200), fill(300, 400)}, "[{100 200}]", 100, 0, 100},
+		{"adjacent fill", []op{open(100, 200), fill(200, 300), fill(0, 100)}, "[{100 200}]", 100, 0, 200},
+		{"wraparound", []op{open(0xFFFFFFF0, 0x10), fill(0xFFFFFFF8, 0x8)}, "[{4294967280 4294967288} {8 16}]", 16, 16, 16},
+	}
+	for _, test := range tests {
+		var h seqHoles
+		for _, o := range test.ops {
+			if o.fill {
+				h.fill(Sequence(o.start), Sequence(o.end))
+			} else {
+				h.open(Sequence(o.start), Sequence(o.end))
+			}
+		}
+		if got := fmt.Sprint(h.holes); got != test.holes {
+			t.Errorf("%s: holes %s, want %s", test.name, got, test.holes)
+		}
+		if h.missing() != test.missing || h.filled != test.filled || h.retrans != test.retrans {
+			t.Errorf("%s: missing %d, filled %d, retrans %d", test.name, h.missing(), h.filled, h.retrans)
+		}
+	}
+}
+
+func TestSeqHolesEviction(t *testing.T) {
+	var h seqHoles
+	for i := 0; i <= maxHoles; i++ {
+		h.open(Sequence(i*100), Sequence(i*100+10))
+	}
+	if len(h.holes) != maxHoles || h.given != 10 || h.missing() != (maxHoles+1)*10 {
+		t.Errorf("%d holes, given %d, missing %d", len(h.holes), h.given, h.missing())
+	}
+	// 被放弃的空洞不能再被填补
+	h.fill(0, 10)
+	if h.filled != 0 || h.missing() != (maxHoles+1)*10 {
+		t.Errorf("given up hole filled, missing %d", h.missing())
+	}
+}
+
+func TestCaptureLoss(t *testing.T) {
+	var f flightStat
+	f.reset()
+	if f.captureLoss() != 0 || f.lossString() != "-1" {
+		t.Errorf("loss before any data %v %q", f.captureLoss(), f.lossString())
+	}
+
+	f.started, f.start, f.nxt = true, 0xFFFFFF00, 0x300 // 1KB，跨越回绕
+	f.holes.open(0xFFFFFFF0, 0x10)
+	f.holes.fill(0x100, 0x200)
+	if f.covered() != 1024 || f.captureLoss() != 32.0/1024 {
+		t.Errorf("covered %d, loss %v", f.covered(), f.captureLoss())
+	}
+	if got := f.lossString(); got != "cap:32B(3.12%)/retx:256B" {
+		t.Errorf("loss %q", got)
+	}
+}
@@ -1,59 +1,45 @@
 package tcpassembly
 
-import "fmt"
+import (
+	"fmt"
+	"github.com/liuxp0827/Tcppass/common/clock"
+	"github.com/liuxp0827/Tcppass/stat"
+)
 
+// RTTStat reports the RTT of the preferred estimator. Sequence matching only
+// sees the server side, TCP timestamps see both sides of the capture point.
 func (s *stream) RTTStat() string {
-	if s.RttCount != 0 {
-		first, max, min, total, recv := s.SYNRTT, s.MaxRTT, s.MinRTT, s.TotalRTT, s.RttCount
-		rttStr := "RTT["
-
-		if first < 5000 {
-			rttStr += fmt.Sprintf("syn:%d(µs)/", first)
-		} else {
-			if first < 5*1000*1000 {
-				rttStr += fmt.Sprintf("syn:%d(ms)/", first/1000)
-			} else {
-				rttStr += fmt.Sprintf("syn:%d(s)/", first/(1000*1000))
-			}
-		}
+	return s.rttString(&s.SeqRTT, &s.s2c.TsRTT, &s.c2s.TsRTT)
+}
 
-		if max < 5000 {
-			rttStr += fmt.Sprintf("max:%d(µs)/", max)
-		} else {
-			if max < 5*1000*1000 {
-				rttStr += fmt.Sprintf("max:%d(ms)/", max/1000)
-			} else {
-				rttStr += fmt.Sprintf("max:%d(s)/", max/(1000*1000))
-			}
-		}
+// RTTDeltaStat is RTTStat for the samples taken since the previous record.
+func (s *stream) RTTDeltaStat() string {
+	return s.rttString(&s.seqDelta, &s.s2c.tsDelta, &s.c2s.tsDelta)
+}
 
-		if min < 5000 {
-			rttStr += fmt.Sprintf("min:%d(µs)/", min)
-		} else {
-			if min < 5*1000*1000 {
-				rttStr += fmt.Sprintf("min:%d(ms)/", min/1000)
-			} else {
-				rttStr += fmt.Sprintf("min:%d(s)/", min/(1000*1000))
-			}
-		}
+func (s *stream) rttString(seq, srv, cli *rttStat) string {
+	if est, rtt := s.preferredRTT(seq, srv); est == estimatorTS {
+		return fmt.Sprintf("RTT(ts)[srv %s, cli %s]", rtt.String(), cli.String())
+	}
 
-		if avg := (total / recv); avg < 5000 {
-			rttStr += fmt.Sprintf("avg:%d(µs)|%d]", avg, recv)
-		} else {
-			if avg < 5*1000*1000 {
-				rttStr += fmt.Sprintf("avg:%d(ms)|%d]", avg/1000, recv)
-			} else {
-				rttStr += fmt.Sprintf("avg:%d(s)|%d]", avg/(1000*1000), recv)
-			}
-		}
-		return rttStr
+	if seq.Count != 0 {
+		return "RTT[" + seq.String() + "]"
 	}
 	return fmt.Sprintf("RTT[-1/-1/-1](µs)")
 }
 
-func (s *stream) BPStat(finish bool) string {
-	speedStr := "B/P[tx:"
+func (r *rttStat) String() string {
+	if r.Count == 0 {
+		return "-1"
+	}
+	return fmt.Sprintf("syn:%s/max:%s/min:%s/avg:%s|%d %s",
+		stat.Microseconds(r.First), stat.Microseconds(r.Max), stat.Microseconds(r.Min), stat.Microseconds(r.avg()), r.Count, r.Hist.String())
+}
 
+// BPStat reports the bytes and packets of both directions. The final record
+// carries the totals, an interim record the deltas since the previous record
+// and the rates over that interval.
+func (s *stream) BPStat(finish bool) string {
 	var s2cbytes, olds2cbytes, s2cpackets, olds2cpackets, c2sbytes, oldc2sbytes, c2spackets, oldc2spackets int64
 
 	s2cbytes, olds2cbytes, s2cpackets, olds2cpackets = s.s2c.Bytes, s.s2c.OldBytes, s.s2c.Packets, s.s2c.OldPackets
@@ -66,48 +52,30 @@ func (s *stream) BPStat(finish bool) string {
 		s.c2s.OldBytes = c2sbytes
 	}
 
-	if c2sbytes > 5*1024 {
-		if c2sbytes > 5*1024*1024 {
-			speedStr += fmt.Sprintf("%dMB/%d, rx:", c2sbytes/(1024*1024), c2spackets)
-		} else {
-			speedStr += fmt.Sprintf("%dKB/%d, rx:", c2sbytes/1024, c2spackets)
-		}
-	} else {
-		speedStr += fmt.Sprintf("%dB/%d, rx:", c2sbytes, c2spackets)
-	}
-
-	if s2cbytes > 5*1024 {
-		if s2cbytes > 5*1024*1024 {
-			speedStr += fmt.Sprintf("%dMB/%d]", s2cbytes/(1024*1024), s2cpackets)
-		} else {
-			speedStr += fmt.Sprintf("%dKB/%d]", s2cbytes/1024, s2cpackets)
-		}
-	} else {
-		speedStr += fmt.Sprintf("%dB/%d]", s2cbytes, s2cpackets)
-	}
 	if finish {
-		return speedStr
+		return fmt.Sprintf("B/P[tx:%s/%d, rx:%s/%d]", byteSize(c2sbytes), c2spackets, byteSize(s2cbytes), s2cpackets)
 	}
 
-	if c2sspeed := (c2sbytes - oldc2sbytes) / 5; c2sspeed > 5*1024 {
-		if c2sspeed > 5*1024*1024 {
-			speedStr += fmt.Sprintf(" Bps/Pps[tx:%d(MB/s)/%.1f, rx:", c2sspeed/(1024*1024), float32(c2spackets-oldc2spackets)/5.0)
-		} else {
-			speedStr += fmt.Sprintf(" Bps/Pps[tx:%d(KB/s)/%.1f, rx:", c2sspeed/1024, float32(c2spackets-oldc2spackets)/5.0)
-		}
-	} else {
-		speedStr += fmt.Sprintf(" Bps/Pps[tx:%d(B/s)/%.1f, rx:", c2sspeed, float32(c2spackets-oldc2spackets)/5.0)
-	}
+	c2sbytes, c2spackets = c2sbytes-oldc2sbytes, c2spackets-oldc2spackets
+	s2cbytes, s2cpackets = s2cbytes-olds2cbytes, s2cpackets-olds2cpackets
 
-	if s2cspeed := (s2cbytes - olds2cbytes) / 5; s2cspeed > 5*1024 {
-		if s2cspeed > 5*1024*1024 {
-			speedStr += fmt.Sprintf("%d(MB/s)/%.1f]", s2cspeed/(1024*1024), float32(s2cpackets-olds2cpackets)/5.0)
-		} else {
-			speedStr += fmt.Sprintf("%d(KB/s)/%.1f]", s2cspeed/1024, float32(s2cpackets-olds2cpackets)/5.0)
-		}
-	} else {
-		speedStr += fmt.Sprintf("%d(B/s)/%.1f]", s2cspeed, float32(s2cpackets-olds2cpackets)/5.0)
+	// 按距上次输出的实际间隔计算速率
+	seconds := clock.Since(s.lastRecord).Seconds()
+	if seconds <= 0 {
+		seconds = 1
 	}
 
-	return speedStr
+	return fmt.Sprintf("B/P[tx:%s/%d, rx:%s/%d] Bps/Pps[tx:%s/%.1f, rx:%s/%.1f]",
+		byteSize(c2sbytes), c2spackets, byteSize(s2cbytes), s2cpackets,
+		byteSize(int64(float64(c2sbytes)/seconds))+"/s", float64(c2spackets)/seconds,
+		byteSize(int64(float64(s2cbytes)/seconds))+"/s", float64(s2cpackets)/seconds)
+}
+
+func byteSize(b int64) string {
+	if b > 5*1024*1024 {
+		return fmt.Sprintf("%dMB", b/(1024*1024))
+	} else if b > 5*1024 {
+		return fmt.Sprintf("%dKB", b/1024)
+	}
+	return fmt.Sprintf("%dB", b)
 }
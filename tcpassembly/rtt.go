@@ -0,0 +1,123 @@
+package tcpassembly
+
+import (
+	"encoding/binary"
+	"github.com/google/gopacket/layers"
+	"github.com/liuxp0827/Tcppass/stat"
+	"math"
+	"time"
+)
+
+// rttEstimator names the method that produced an RTT sample.
+type rttEstimator string
+
+const (
+	estimatorSeq = rttEstimator("seq") // data sequence matched with the ACK of the other side
+	estimatorTS  = rttEstimator("ts")  // TSval matched with the TSecr of the other side
+)
+
+// rttStat summarizes RTT samples in µs, Hist keeps their distribution.
+type rttStat struct {
+	First, Min, Max, Total, Count int64
+	Hist                          stat.Histogram
+}
+
+func (r *rttStat) reset() {
+	r.First = -1
+	r.Min = math.MaxInt64
+	r.Max = math.MinInt64
+	r.Total = 0
+	r.Count = 0
+	r.Hist.Reset()
+}
+
+func (r *rttStat) add(rtt int64) {
+	r.Count++
+	if r.Count == 1 {
+		r.First = rtt
+	}
+	if rtt < r.Min {
+		r.Min = rtt
+	}
+	if rtt > r.Max {
+		r.Max = rtt
+	}
+	r.Total += rtt
+	r.Hist.Observe(rtt)
+}
+
+func (r *rttStat) avg() int64 {
+	if r.Count == 0 {
+		return -1
+	}
+	return r.Total / r.Count
+}
+
+// tcpTimestamps returns the TSval and TSecr of the timestamps option.
+func tcpTimestamps(tcp *layers.TCP) (val, ecr uint32, ok bool) {
+	for _, opt := range tcp.Options {
+		if opt.OptionType == layers.TCPOptionKindTimestamps && len(opt.OptionData) == 8 {
+			return binary.BigEndian.Uint32(opt.OptionData[:4]), binary.BigEndian.Uint32(opt.OptionData[4:]), true
+		}
+	}
+	return 0, 0, false
+}
+
+// timestamps records the TSval sent by c and matches its TSecr with a TSval
+// of the reverse direction. The sample is the round trip between the capture
+// point and the sender of c: the server side on s2c, the client side on c2s.
+func (c *conn) timestamps(tcp *layers.TCP, ts time.Time) {
+	val, ecr, ok := tcpTimestamps(tcp)
+	if !ok {
+		return
+	}
+
+	c.tsSeen = true
+	c.tsvals.Push(val, ts)
+
+	if !tcp.ACK || ecr == 0 {
+		return
+	}
+
+	if seen, ok := c.reverse.tsvals.Pull(ecr); ok {
+		if rtt := ts.Sub(seen).Nanoseconds() / 1000; rtt >= 0 {
+			c.s.addRTTSample(estimatorTS, c, rtt)
+		}
+	}
+}
+
+// addRTTSample accounts an RTT sample in µs measured by est on conn c, in the
+// totals and in the interval of the next record.
+func (s *stream) addRTTSample(est rttEstimator, c *conn, rtt int64) {
+	switch est {
+	case estimatorSeq:
+		s.SeqRTT.add(rtt)
+		s.seqDelta.add(rtt)
+	case estimatorTS:
+		c.TsRTT.add(rtt)
+		c.tsDelta.add(rtt)
+	}
+}
+
+// tsNegotiated reports whether both sides send the timestamps option.
+func (s *stream) tsNegotiated() bool {
+	return s.c2s.tsSeen && s.s2c.tsSeen
+}
+
+// rtt returns the preferred RTT of the server side: from the timestamps when
+// both sides negotiated them, from the sequence numbers otherwise.
+func (s *stream) rtt() (rttEstimator, *rttStat) {
+	return s.preferredRTT(&s.SeqRTT, &s.s2c.TsRTT)
+}
+
+// rttDelta is rtt for the samples taken since the previous record.
+func (s *stream) rttDelta() (rttEstimator, *rttStat) {
+	return s.preferredRTT(&s.seqDelta, &s.s2c.tsDelta)
+}
+
+func (s *stream) preferredRTT(seq, ts *rttStat) (rttEstimator, *rttStat) {
+	if s.tsNegotiated() && s.s2c.TsRTT.Count > 0 {
+		return estimatorTS, ts
+	}
+	return estimatorSeq, seq
+}
@@ -0,0 +1,131 @@
+package tcpassembly
+
+import (
+	"github.com/liuxp0827/Tcppass/flow"
+	"sync"
+	"time"
+)
+
+// StreamSnapshot is the state of an active stream at one instant. It is taken
+// by the goroutine of the stream, so it is consistent and safe to read while
+// the stream goes on.
+type StreamSnapshot struct {
+	Record *flow.FlowRecord `json:"record"` // counters so far
+
+	DPIInspected   int  `json:"dpiInspected"`   // payloads handed to the DPI engine
+	PendingRequest bool `json:"pendingRequest"` // an HTTP request waits for its response
+
+	Turns     int64 `json:"turns"` // request/response turns
+	ReqBytes  int64 `json:"reqBytes"`
+	RespBytes int64 `json:"respBytes"`
+
+	LastHTTP *flow.HTTPRecord `json:"lastHttp,omitempty"`
+}
+
+// snapshotWait bounds the wait for the goroutines of the streams, they may
+// be busy or finishing their stream.
+const snapshotWait = 100 * time.Millisecond
+
+// snapshotWorkers ask that many streams for their state at the same time.
+const snapshotWorkers = 32
+
+// Snapshots returns the state of the active streams. The streams finished
+// meanwhile, or that did not answer within snapshotWait, are left out.
+func (sp *StreamPool) Snapshots() []*StreamSnapshot {
+	streams := sp.allStream()
+
+	expired := make(chan struct{})
+	timer := time.AfterFunc(snapshotWait, func() { close(expired) })
+	defer timer.Stop()
+
+	results := make([]*StreamSnapshot, len(streams))
+	next := make(chan int, len(streams))
+	for i := range streams {
+		next <- i
+	}
+	close(next)
+
+	workers := snapshotWorkers
+	if workers > len(streams) {
+		workers = len(streams)
+	}
+	var wg sync.WaitGroup
+	wg.Add(workers)
+	for w := 0; w < workers; w++ {
+		go func() {
+			defer wg.Done()
+			for i := range next {
+				results[i] = streams[i].snapshot(expired)
+			}
+		}()
+	}
+	wg.Wait()
+
+	snaps := make([]*StreamSnapshot, 0, len(streams))
+	seen := make(map[int64]bool, len(streams))
+	for _, snap := range results {
+		// 复用的stream可能已经属于另一个连接
+		if snap != nil && !seen[snap.Record.ID] {
+			seen[snap.Record.ID] = true
+			snaps = append(snaps, snap)
+		}
+	}
+	return snaps
+}
+
+// Snapshot returns the state of the active stream id, nil if there is none.
+func (sp *StreamPool) Snapshot(id int64) *StreamSnapshot {
+	sp.mu.RLock()
+	var found *stream
+	for _, stream := range sp.streams {
+		if stream.id == id {
+			found = stream
+			break
+		}
+	}
+	sp.mu.RUnlock()
+
+	if found == nil {
+		return nil
+	}
+	expired := make(chan struct{})
+	timer := time.AfterFunc(snapshotWait, func() { close(expired) })
+	defer timer.Stop()
+
+	if snap := found.snapshot(expired); snap != nil && snap.Record.ID == id {
+		return snap
+	}
+	return nil
+}
+
+// snapshot asks the dump goroutine of the stream for its state, giving up
+// once expired is closed.
+func (s *stream) snapshot(expired <-chan struct{}) *StreamSnapshot {
+	s.mu.Lock()
+	closed := s.closed
+	s.mu.Unlock()
+	if closed {
+		return nil
+	}
+
+	reply := make(chan *StreamSnapshot, 1)
+	select {
+	case s.snap <- reply:
+		return <-reply
+	case <-expired:
+		return nil
+	}
+}
+
+// takeSnapshot runs in the dump goroutine.
+func (s *stream) takeSnapshot() *StreamSnapshot {
+	return &StreamSnapshot{
+		Record:         s.record(false),
+		DPIInspected:   s.dpitotal,
+		PendingRequest: s.Req != nil && (s.Resp == nil || s.Resp.GetTimestamp().Before(s.Req.GetTimestamp())),
+		Turns:          s.turns.Turns,
+		ReqBytes:       s.turns.ReqBytes,
+		RespBytes:      s.turns.RespBytes,
+		LastHTTP:       s.lastHTTP,
+	}
+}
@@ -1,43 +1,79 @@
 package tcpassembly
 
 import (
-	"flag"
-	"math"
+	"fmt"
+	"github.com/google/gopacket"
 	"github.com/liuxp0827/Tcppass/common/cache"
+	"github.com/liuxp0827/Tcppass/common/clock"
 	"github.com/liuxp0827/Tcppass/dpi"
+	"github.com/liuxp0827/Tcppass/dump"
+	"github.com/liuxp0827/Tcppass/flow"
 	"github.com/google/gopacket/layers"
 	"github.com/liuxp0827/Tcppass/httpassembly"
 	"github.com/liuxp0827/Tcppass/common/log"
 	"github.com/liuxp0827/Tcppass/stat"
+	. "github.com/liuxp0827/Tcppass/tcp"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
-var timeoutRtt = flag.Int("t", 300000, "timeout for rtt, default 300000 ms")
-
 const timeout time.Duration = time.Minute * 2
 
 type pbody struct {
-	key key
-	tcp layers.TCP
-	ts  time.Time
+	key          key
+	tcp          layers.TCP
+	ts           time.Time
+	ci           gopacket.CaptureInfo
+	data         []byte
+	samplingRate uint32
+	payloadLen   int           // 载荷在线路上的长度，截断的采样包大于len(tcp.Payload)
+	retire       int64         // 非0时结束ID为retire的stream
+	flushed      chan struct{} // 非nil时按超时结束stream，结束后关闭
 }
 
 type stream struct {
 	pool    *StreamPool
+	id      int64 // flow ID
 	key     key
+	info    StreamInfo
 	c2s     *conn
 	s2c     *conn
 	connMap map[key]*conn
 
 	data      chan pbody
+	snap      chan chan *StreamSnapshot // 管理接口的快照请求
 	firstSeen time.Time
 	lastSeen  time.Time
 	closed    bool
 	mu        sync.Mutex
 
-	CloseFlag                                  int32
-	SYNRTT, MinRTT, MaxRTT, TotalRTT, RttCount int64
+	CloseFlag int32
+	SeqRTT    rttStat
+	seqDelta  rttStat // 上次输出记录以来的SeqRTT
+
+	turns turnStat // 请求/响应轮次
+
+	gaps             gapStat // 包间的空闲间隔
+	gapsInterval     gapStat // 上次输出记录以来的gaps，跨越记录时间的gap被分开
+	keepalivesRecord int64   // 上次输出记录时的keepalive数
+
+	lastRecord time.Time // 上次输出记录的时间
+	records    int       // 已输出的中间记录数
+
+	iface        string
+	linkType     layers.LinkType
+	rst          bool // 收到过RST
+	closeReason  closeReason
+	packets      *dump.FlowBuffer
+	samplingRate uint32 // 采样率，非采样流量为0
+	synSeen      bool   // 由客户端SYN创建
+	isn          uint32 // 客户端初始序列号
+	reused       bool   // 4元组被新连接复用
+
+	// 由抓包侧在入队时更新，dump协程处理前即可用于判断4元组复用
+	ends    int32  // 已入队的FIN/RST，endFIN|endRST
+	cliNext uint64 // 客户端下一个序列号，第32位表示已知
 
 	RttCache *cache.RTTCache
 	stat     *stat.Stats
@@ -48,9 +84,10 @@ type stream struct {
 	dpier    *dpi.DPIEnginer
 	Req      *httpassembly.HTTPRequest
 	Resp     *httpassembly.HTTPResponse
+	lastHTTP *flow.HTTPRecord // 最近一次完整的HTTP事务
 }
 
-func (s *stream) reset(pool *StreamPool, k key, stat *stat.Stats, ts time.Time) {
+func (s *stream) reset(pool *StreamPool, k key, a *Assembler, ts time.Time) {
 	if s.pool == nil {
 		s.pool = pool
 	}
@@ -79,26 +116,55 @@ func (s *stream) reset(pool *StreamPool, k key, stat *stat.Stats, ts time.Time)
 	s.connMap[k] = s.c2s
 	s.connMap[k.Reverse()] = s.s2c
 
+	s.info = StreamInfo{
+		ID:        s.id,
+		Iface:     a.Iface,
+		Net:       k[0],
+		Transport: k[1],
+		FirstSeen: ts,
+	}
+
 	s.firstSeen = ts
 	s.lastSeen = ts
+	s.lastRecord = ts
+	s.records = 0
 	s.closed = false
+	s.iface = a.Iface
+	s.linkType = a.LinkType
+	s.rst = false
+	s.reused = false
+	atomic.StoreInt32(&s.ends, 0)
+	atomic.StoreUint64(&s.cliNext, 0)
+	s.closeReason = closeFIN
+	s.samplingRate = 0
+
+	if pool.exporter != nil {
+		if s.packets == nil {
+			s.packets = dump.NewFlowBuffer(pool.export.MaxPackets, pool.export.MaxBytes)
+		}
+		s.packets.Reset()
+	}
 
 	if s.data == nil {
 		s.data = make(chan pbody, 10)
 	}
+	if s.snap == nil {
+		s.snap = make(chan chan *StreamSnapshot)
+	}
 
-	s.MinRTT = math.MaxInt64
-	s.MaxRTT = math.MinInt64
-	s.TotalRTT = 0
-	s.RttCount = 0
-	s.SYNRTT = -1
+	s.SeqRTT.reset()
+	s.seqDelta.reset()
+	s.turns.reset()
+	s.gaps = gapStat{}
+	s.gapsInterval = gapStat{}
+	s.keepalivesRecord = 0
 
 	if s.RttCache == nil {
-		s.RttCache = cache.NewRTTCache(time.Duration(*timeoutRtt) * time.Millisecond)
+		s.RttCache = cache.NewRTTCache(pool.rttTimeout)
 	}
 
 	s.RttCache.Reset()
-	s.stat = stat
+	s.stat = a.stat
 
 	s.StreamType = dpi.UNKNOWN
 	s.dpitotal = 0
@@ -108,8 +174,13 @@ func (s *stream) reset(pool *StreamPool, k key, stat *stat.Stats, ts time.Time)
 
 	s.Req = nil
 	s.Resp = nil
+	s.lastHTTP = nil
 
-	go s.dump(60000)
+	interval := 60000
+	if active := int(pool.activeTimeout / time.Millisecond); active > 0 && active < interval {
+		interval = active
+	}
+	go s.dump(interval)
 }
 
 func (s *stream) getConn(k key) *conn {
@@ -119,7 +190,7 @@ func (s *stream) getConn(k key) *conn {
 	return nil
 }
 
-func (s *stream) handle(key key, tcp *layers.TCP, ts time.Time) {
+func (s *stream) handle(key key, tcp *layers.TCP, ctx *CaptureContext) {
 	s.mu.Lock()
 
 	if s.closed {
@@ -129,45 +200,93 @@ func (s *stream) handle(key key, tcp *layers.TCP, ts time.Time) {
 
 	s.mu.Unlock()
 
+	s.track(key, tcp)
 	ttcp := *tcp
 
-	s.data <- pbody{
-		key: key,
-		tcp: ttcp,
-		ts:  ts,
+	body := pbody{
+		key:          key,
+		tcp:          ttcp,
+		ts:           ctx.CaptureInfo.Timestamp,
+		samplingRate: ctx.SamplingRate,
+		payloadLen:   len(tcp.Payload),
+	}
+	if ctx.PayloadLength > body.payloadLen {
+		body.payloadLen = ctx.PayloadLength
 	}
+
+	if s.packets != nil {
+		body.ci, body.data = ctx.CaptureInfo, ctx.Data
+	}
+
+	s.data <- body
 }
 
 func (s *stream) dump(interval int) {
 
-	ticker := time.NewTicker(time.Duration(interval) * time.Millisecond)
+	ticker := clock.NewTicker(time.Duration(interval) * time.Millisecond)
 	defer ticker.Stop()
 	var conn *conn
 
+	if h := s.pool.handler; h != nil {
+		h.OnStreamOpen(&s.info)
+	}
+
 	for !s.closed {
 		select {
 		case data, ok := <-s.data:
 			if ok && !s.closed {
+				if data.retire != 0 {
+					if data.retire == s.id {
+						if data.flushed != nil {
+							s.close(true)
+						} else {
+							s.reused = true
+							s.close(false)
+						}
+					}
+					if data.flushed != nil {
+						close(data.flushed)
+					}
+					continue
+				}
+
 				conn = s.getConn(data.key)
 				if conn == nil {
 					continue
 				}
 
 				if s.lastSeen.Before(data.ts) {
+					s.gap(data.ts)
 					s.lastSeen = data.ts
 				}
 
-				conn.handle(data.tcp, data.ts)
+				if s.packets != nil {
+					s.packets.Add(data.ci, data.data)
+				}
+
+				if data.samplingRate > s.samplingRate {
+					s.samplingRate = data.samplingRate
+				}
+
+				conn.handle(data.tcp, data.payloadLen, data.ts)
 			}
+		case reply := <-s.snap:
+			reply <- s.takeSnapshot()
 		case <-ticker.C:
-			if s.lastSeen.Before(time.Now().Add(-timeout)) {
+			now := clock.Now()
+			s.RttCache.Purge(now)
+			if s.lastSeen.Before(now.Add(-timeout)) {
 				s.close(true)
+			} else if active := s.pool.activeTimeout; active > 0 && now.Sub(s.lastRecord) >= active {
+				s.interim(now)
 			}
 		}
 	}
 
 	for len(s.data) > 0 {
-		<-s.data
+		if data := <-s.data; data.flushed != nil {
+			close(data.flushed)
+		}
 	}
 
 	return
@@ -200,7 +319,13 @@ func (s *stream) dpicb(streamType int, entry interface{}) {
 		s.Resp = entry.(*httpassembly.HTTPResponse)
 		if s.Req != nil && s.Resp != nil {
 			httpStream := httpassembly.NewHttpStream(s.Req, s.Resp)
-			log.Alertf("[%v] %s", s.key, httpStream)
+			log.Alertf("[%v] ID[%d] %s", s.key, s.id, httpStream)
+			s.stat.AddHTTPStatus(s.Resp.StatusCode)
+
+			s.lastHTTP = s.httpRecord()
+			if h := s.pool.handler; h != nil {
+				h.OnTransaction(&s.info, s.lastHTTP)
+			}
 
 			s.StreamType = dpi.HTTP
 			s.dpitotal = 0
@@ -211,18 +336,208 @@ func (s *stream) dpicb(streamType int, entry interface{}) {
 }
 
 func (s *stream) finish(timeout bool) {
-	var timeoutFinish string
+	if s.rst {
+		s.closeReason = closeRST
+	} else if timeout {
+		s.closeReason = closeTimeout
+	} else if s.reused && !s.c2s.waitClose && !s.s2c.waitClose {
+		s.closeReason = closeReuse
+	}
 
-	if timeout {
-		timeoutFinish = "TIMEOUT FINISH"
-	} else {
-		timeoutFinish = "FINISH"
+	var sampled string
+	if s.samplingRate > 1 {
+		sampled = fmt.Sprintf(" SAMPLED[1/%d]", s.samplingRate)
 	}
 
+	s.endTurn()
+
 	switch s.StreamType {
 	default:
-		log.Noticef("[%v] %s %s %s, Duration[%v]",
-			s.key, timeoutFinish, s.BPStat(true), s.RTTStat(), s.lastSeen.Sub(s.firstSeen))
+		log.Noticef("[%v] ID[%d] %s%s%s %s %s%s%s%s%s, Duration[%v]",
+			s.key, s.id, s.closeReason.finishString(), sampled, s.AsymStat(), s.BPStat(true), s.RTTStat(), s.FlightStat(), s.LossStat(), s.TurnStat(), s.IdleStat(true, s.lastSeen), s.lastSeen.Sub(s.firstSeen))
+	}
+
+	s.stat.AddStream(s.asymmetry() != asymNone)
+	s.stat.AddClose(s.closeReason.String())
+	s.stat.AddCoverage(s.c2s.inflight.covered()+s.s2c.inflight.covered(),
+		s.c2s.inflight.holes.missing()+s.s2c.inflight.holes.missing())
+
+	s.endInterval(s.lastSeen)
+
+	if h := s.pool.handler; h != nil {
+		h.OnStreamClose(&s.info, s.record(true))
+	}
+
+	if s.packets != nil {
+		if matchExport(s.pool.export, s) {
+			s.pool.exporter.Export(s.key.String(), s.firstSeen, s.lastSeen, s.linkType, s.packets)
+		} else {
+			s.packets.Reset()
+		}
+	}
+}
+
+// interim reports what a long-lived stream did since its previous record,
+// like the active timeout of NetFlow.
+func (s *stream) interim(now time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return
+	}
+
+	s.records++
+
+	var record *flow.FlowRecord
+	h := s.pool.handler
+	if h != nil {
+		record = s.interimRecord(now)
+	}
+
+	var sampled string
+	if s.samplingRate > 1 {
+		sampled = fmt.Sprintf(" SAMPLED[1/%d]", s.samplingRate)
+	}
+
+	log.Noticef("[%v] ID[%d] ACTIVE#%d%s%s %s %s%s, Interval[%v], Duration[%v]",
+		s.key, s.id, s.records, sampled, s.AsymStat(), s.BPStat(false), s.RTTDeltaStat(), s.IdleStat(false, now), now.Sub(s.lastRecord), now.Sub(s.firstSeen))
+
+	s.endInterval(now)
+
+	if h != nil {
+		h.OnInterim(&s.info, record)
+	}
+}
+
+// endInterval hands the RTT and think time samples of the interval to the
+// service stats and starts the next interval.
+func (s *stream) endInterval(now time.Time) {
+	if _, rtt := s.rttDelta(); rtt.Count > 0 {
+		stat.Services.Add(s.service(), s.lastSeen, &rtt.Hist)
+	}
+	stat.Responses.Add(s.service(), s.lastSeen, &s.turns.thinkDelta)
+	s.turns.thinkDelta.Reset()
+
+	s.endGaps()
+
+	s.seqDelta.reset()
+	s.c2s.tsDelta.reset()
+	s.s2c.tsDelta.reset()
+	s.lastRecord = now
+}
+
+const (
+	endFIN = 1 << iota
+	endRST
+)
+
+// track records the FIN, RST and client sequence numbers of a packet queued
+// to s, before its dump goroutine gets to them.
+func (s *stream) track(k key, t *layers.TCP) {
+	if t.FIN || t.RST {
+		flag := int32(endFIN)
+		if t.RST {
+			flag = endRST
+		}
+		for {
+			ends := atomic.LoadInt32(&s.ends)
+			if ends&flag != 0 || atomic.CompareAndSwapInt32(&s.ends, ends, ends|flag) {
+				break
+			}
+		}
 	}
 
+	if k != s.key || t.RST {
+		return
+	}
+	r := Reassembly{Seq: Sequence(t.Seq), Bytes: t.Payload, SYN: t.SYN, FIN: t.FIN}
+	next := uint64(r.Next()) | 1<<32
+	for {
+		old := atomic.LoadUint64(&s.cliNext)
+		if old != 0 && Sequence(uint32(old)).Difference(r.Next()) <= 0 {
+			return
+		}
+		if atomic.CompareAndSwapUint64(&s.cliNext, old, next) {
+			return
+		}
+	}
+}
+
+// reusedBy reports whether a client SYN with isn opens a new connection on
+// the 4-tuple of s rather than retransmitting the SYN of s or hitting an open
+// connection. A reset connection is gone, a closing one or one whose opening
+// was not seen is replaced only by an ISN above its next sequence number, as
+// in TIME-WAIT (RFC 6191).
+func (s *stream) reusedBy(isn uint32) bool {
+	if s.synSeen && s.isn == isn {
+		return false
+	}
+
+	ends := atomic.LoadInt32(&s.ends)
+	if ends&endRST != 0 {
+		return true
+	}
+	if s.synSeen && ends&endFIN == 0 {
+		return false
+	}
+
+	next := atomic.LoadUint64(&s.cliNext)
+	return next == 0 || Sequence(uint32(next)).Difference(Sequence(isn)) > 0
+}
+
+// retire finishes the stream from its dump goroutine after the packets
+// already queued, its 4-tuple was taken over by a new connection.
+func (s *stream) retire() {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return
+	}
+	id := s.id
+	s.mu.Unlock()
+
+	s.data <- pbody{retire: id}
+}
+
+// flush asks the dump goroutine to finish the stream after the packets
+// already queued, the returned channel is closed once it did.
+func (s *stream) flush() chan struct{} {
+	done := make(chan struct{})
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		close(done)
+		return done
+	}
+	id := s.id
+	s.mu.Unlock()
+
+	s.data <- pbody{retire: id, flushed: done}
+	return done
+}
+
+// wait waits for done of flush. The request may be left in the queue by a
+// dump goroutine that finished meanwhile, the stream is polled for that.
+func (s *stream) wait(done chan struct{}) {
+	ticker := time.NewTicker(10 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			s.mu.Lock()
+			closed := s.closed
+			s.mu.Unlock()
+			if closed {
+				return
+			}
+		}
+	}
+}
+
+// service names the server side of the stream, ip:port.
+func (s *stream) service() string {
+	return fmt.Sprintf("%s:%s", s.key[0].Dst(), s.key[1].Dst())
 }
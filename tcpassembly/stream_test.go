@@ -0,0 +1,59 @@
+package tcpassembly
+
+import (
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"net"
+	"testing"
+)
+
+func TestReusedBy(t *testing.T) {
+	k := key{
+		gopacket.NewFlow(layers.EndpointIPv4, net.IP{10, 0, 0, 1}, net.IP{10, 0, 0, 2}),
+		gopacket.NewFlow(layers.EndpointTCPPort, []byte{0x9c, 0x40}, []byte{0, 80}),
+	}
+	type packet struct {
+		server        bool
+		syn, fin, rst bool
+		seq           uint32
+		len           int
+	}
+	syn := func(seq uint32) packet { return packet{syn: true, seq: seq} }
+	data := func(seq uint32) packet { return packet{seq: seq, len: 100} }
+	fin := func(seq uint32) packet { return packet{fin: true, seq: seq} }
+
+	tests := []struct {
+		name    string
+		synSeen bool
+		isn     uint32
+		packets []packet
+		newISN  uint32
+		want    bool
+	}{
+		{"retransmitted syn", true, 1000, []packet{syn(1000)}, 1000, false},
+		{"open connection", true, 1000, []packet{syn(1000), data(1001)}, 5000, false},
+		{"fin, isn above", true, 1000, []packet{syn(1000), data(1001), fin(1101)}, 5000, true},
+		{"fin, isn below", true, 1000, []packet{syn(1000), data(1001), fin(1101)}, 1050, false},
+		{"server fin, isn above", true, 1000, []packet{syn(1000), {server: true, fin: true, seq: 7000}}, 5000, true},
+		{"rst, isn below", true, 1000, []packet{syn(1000), data(1001), {server: true, rst: true, seq: 7000}}, 10, true},
+		{"fin, isn wrapped", true, 0xFFFFFF00, []packet{syn(0xFFFFFF00), fin(0xFFFFFF01)}, 100, true},
+		{"no syn, nothing seen", false, 0, nil, 5000, true},
+		{"no syn, isn above", false, 0, []packet{data(3000)}, 5000, true},
+		{"no syn, isn below", false, 0, []packet{data(3000)}, 2000, false},
+	}
+	for _, test := range tests {
+		s := &stream{key: k, synSeen: test.synSeen, isn: test.isn}
+		for _, p := range test.packets {
+			tcp := &layers.TCP{Seq: p.seq, SYN: p.syn, FIN: p.fin, RST: p.rst}
+			tcp.Payload = make([]byte, p.len)
+			if p.server {
+				s.track(k.Reverse(), tcp)
+			} else {
+				s.track(k, tcp)
+			}
+		}
+		if got := s.reusedBy(test.newISN); got != test.want {
+			t.Errorf("%s: reusedBy(%d) = %v, want %v", test.name, test.newISN, got, test.want)
+		}
+	}
+}
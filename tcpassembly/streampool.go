@@ -1,8 +1,11 @@
 package tcpassembly
 
 import (
+	"github.com/google/gopacket/layers"
+	. "github.com/liuxp0827/Tcppass/common/config"
 	"github.com/liuxp0827/Tcppass/common/log"
-	"github.com/liuxp0827/Tcppass/stat"
+	"github.com/liuxp0827/Tcppass/dump"
+	"github.com/liuxp0827/Tcppass/flow"
 	"sync"
 	"time"
 )
@@ -17,15 +20,79 @@ type StreamPool struct {
 	all                [][]stream
 	nextAlloc          int
 	newConnectionCount int64
+
+	export   *ExportConfig
+	exporter *dump.FlowExporter
+
+	rttTimeout    time.Duration // 序列号RTT样本的超时
+	activeTimeout time.Duration // 长连接输出中间记录的间隔
+	statInterval  int           // 各接口统计日志的间隔秒数
+
+	handler Handler
 }
 
-func NewStreamPool() *StreamPool {
-	return &StreamPool{
+// PoolOptions configure a StreamPool, the zero value tracks the streams
+// without pcap export, interim records or periodic logs.
+type PoolOptions struct {
+	RTTTimeout    time.Duration // how long a segment waits for its ACK, 0 for 5 minutes
+	ActiveTimeout time.Duration // interval of the interim records of long-lived streams, 0 disables them
+	StatInterval  int           // seconds between the traffic logs of each assembler, 0 disables them
+	Export        *ExportConfig // pcap export of the finished streams, nil disables it
+}
+
+func NewStreamPool(opts PoolOptions) *StreamPool {
+	sp := &StreamPool{
 		streams:   make(map[key]*stream, initialAllocSize),
 		free:      make([]*stream, 0, initialAllocSize),
 		nextAlloc: initialAllocSize,
 		mu:        &sync.RWMutex{},
+
+		rttTimeout:    opts.RTTTimeout,
+		activeTimeout: opts.ActiveTimeout,
+		statInterval:  opts.StatInterval,
+	}
+	if sp.rttTimeout <= 0 {
+		sp.rttTimeout = 5 * time.Minute
 	}
+
+	if opts.Export.Enabled() {
+		exporter, err := dump.NewFlowExporter(opts.Export.Dir, opts.Export.Queue)
+		if err != nil {
+			log.Errorf("StreamPool: disable pcap export, %v", err)
+		} else {
+			sp.export = opts.Export
+			sp.exporter = exporter
+		}
+	}
+	return sp
+}
+
+// SetHandler installs the receiver of the stream events, it must be called
+// before the first packet is assembled.
+func (sp *StreamPool) SetHandler(h Handler) {
+	sp.handler = h
+}
+
+// PoolStats are the counters of a StreamPool.
+type PoolStats struct {
+	Active        int   `json:"active"`        // streams not finished yet
+	Created       int64 `json:"created"`       // streams created since the start
+	ExportDropped int64 `json:"exportDropped"` // finished streams not exported, the queue was full
+}
+
+// Stats returns the counters of the pool.
+func (sp *StreamPool) Stats() PoolStats {
+	sp.mu.RLock()
+	st := PoolStats{
+		Active:  len(sp.streams),
+		Created: sp.newConnectionCount,
+	}
+	sp.mu.RUnlock()
+
+	if sp.exporter != nil {
+		st.ExportDropped = sp.exporter.Dropped()
+	}
+	return st
 }
 
 func (sp *StreamPool) grow() {
@@ -49,10 +116,34 @@ func (sp *StreamPool) allStream() []*stream {
 	return streams
 }
 
-func (sp *StreamPool) newStream(k key, stat *stat.Stats, ts time.Time) (stream *stream) {
+// Flush finishes every stream like a timeout, after the packets already
+// queued to it, and returns once their handlers ran. Packets must not be
+// assembled meanwhile.
+func (sp *StreamPool) Flush() {
+	streams := sp.allStream()
+	done := make([]chan struct{}, len(streams))
+	for i, stream := range streams {
+		done[i] = stream.flush()
+	}
+	for i, stream := range streams {
+		stream.wait(done[i])
+	}
+}
+
+func (sp *StreamPool) newStream(k key, a *Assembler, syn bool, isn uint32, ts time.Time) (stream *stream) {
 	sp.mu.Lock()
 	defer sp.mu.Unlock()
 
+	// 加锁后再次确认，另一个接口可能已经创建或替换了stream
+	if old := sp.streams[k]; old != nil {
+		if !syn || !old.reusedBy(isn) {
+			return old
+		}
+		log.Infof("stream [%s] ID[%d] is reused by a new connection, ISN %d", k, old.id, isn)
+		delete(sp.streams, k)
+		go old.retire()
+	}
+
 	sp.newConnectionCount++
 	if sp.newConnectionCount&0x7FFF == 0 {
 		log.Info("StreamPool:", sp.newConnectionCount, "requests,", len(sp.streams), "used,", len(sp.free), "free")
@@ -63,13 +154,20 @@ func (sp *StreamPool) newStream(k key, stat *stat.Stats, ts time.Time) (stream *
 	}
 	index := len(sp.free) - 1
 	stream, sp.free = sp.free[index], sp.free[:index]
-	stream.reset(sp, k, stat, ts)
+	stream.id = flow.NextID()
+	stream.synSeen, stream.isn = syn, isn
+	stream.reset(sp, k, a, ts)
 
 	sp.streams[k] = stream
 	return stream
 }
 
-func (sp *StreamPool) getStream(k key, stat *stat.Stats, end bool, SYN bool, ts time.Time) *stream {
+// getStream returns the stream of k in either direction, create allows to
+// create it from a SYN of either side, or from any packet of sampled traffic.
+// A SYN of the client that reuses the 4-tuple of a reset or closing stream,
+// see reusedBy, is a new connection: the old stream is finished and a new one
+// replaces it.
+func (sp *StreamPool) getStream(k key, a *Assembler, end bool, create bool, tcp *layers.TCP, ts time.Time) *stream {
 	sp.mu.RLock()
 	stream := sp.streams[k]
 	if stream == nil {
@@ -77,13 +175,30 @@ func (sp *StreamPool) getStream(k key, stat *stat.Stats, end bool, SYN bool, ts
 	}
 	sp.mu.RUnlock()
 
-	if end || !SYN || stream != nil {
+	if end || !create {
 		return stream
 	}
 
-	log.Infof("created the bidirectional stream %s at %s", k, ts.Format("2006-01-02 15:04:05.999999"))
+	switch {
+	case tcp.SYN && !tcp.ACK:
+		if stream != nil && (stream.key != k || !stream.reusedBy(tcp.Seq)) {
+			return stream
+		}
+		stream = sp.newStream(k, a, true, tcp.Seq, ts)
+	case tcp.SYN:
+		// 只看到服务端的SYN-ACK，stream仍以客户端方向为key
+		if stream != nil {
+			return stream
+		}
+		stream = sp.newStream(k.Reverse(), a, true, tcp.Ack-1, ts)
+	default:
+		if stream != nil {
+			return stream
+		}
+		stream = sp.newStream(k, a, false, 0, ts)
+	}
 
-	stream = sp.newStream(k, stat, ts)
+	log.Infof("created the bidirectional stream [%s] ID[%d] at %s", stream.key, stream.id, ts.Format("2006-01-02 15:04:05.999999"))
 	return stream
 }
 
@@ -91,7 +206,10 @@ func (sp *StreamPool) remove(_s *stream) {
 	sp.mu.Lock()
 	defer sp.mu.Unlock()
 	if _s != nil {
-		delete(sp.streams, _s.key)
+		// 4元组被新连接复用时，map中已经是新的stream
+		if sp.streams[_s.key] == _s {
+			delete(sp.streams, _s.key)
+		}
 		sp.free = append(sp.free, _s)
 	}
 }
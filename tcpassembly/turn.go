@@ -0,0 +1,104 @@
+package tcpassembly
+
+import (
+	"fmt"
+	"github.com/liuxp0827/Tcppass/common/log"
+	"github.com/liuxp0827/Tcppass/stat"
+	"time"
+)
+
+const (
+	turnIdle     = iota
+	turnRequest  // the client is sending
+	turnResponse // the server is sending
+)
+
+// turnStat cuts a stream into request/response turns at the direction
+// changes of its payload, which needs no decoder of the protocol. The think
+// time of a turn runs from the last request byte to the first response byte,
+// its transfer time from the first to the last response byte.
+type turnStat struct {
+	phase     int
+	reqBytes  int64
+	respBytes int64
+	reqLast   time.Time
+	respFirst time.Time
+	respLast  time.Time
+
+	Turns     int64
+	ReqBytes  int64
+	RespBytes int64
+	Think     stat.Histogram // µs
+	Transfer  stat.Histogram // µs
+
+	thinkDelta stat.Histogram // 上次输出记录以来的Think
+}
+
+func (t *turnStat) reset() {
+	t.phase = turnIdle
+	t.reqBytes, t.respBytes = 0, 0
+	t.Turns, t.ReqBytes, t.RespBytes = 0, 0, 0
+	t.Think.Reset()
+	t.Transfer.Reset()
+	t.thinkDelta.Reset()
+}
+
+// turn accounts n new payload bytes sent by c at ts.
+func (s *stream) turn(c *conn, n int, ts time.Time) {
+	t := &s.turns
+
+	if c.cli2srv {
+		if t.phase == turnResponse {
+			s.endTurn()
+		}
+		t.phase = turnRequest
+		t.reqBytes += int64(n)
+		t.reqLast = ts
+		return
+	}
+
+	if t.phase != turnResponse {
+		// 服务端先发送数据（如欢迎信息）时，该轮没有请求
+		t.phase = turnResponse
+		t.respFirst = ts
+	}
+	t.respBytes += int64(n)
+	t.respLast = ts
+}
+
+// endTurn reports the turn in progress if the server answered it.
+func (s *stream) endTurn() {
+	t := &s.turns
+	if t.phase != turnResponse {
+		return
+	}
+
+	think := int64(-1)
+	if t.reqBytes > 0 {
+		think = t.respFirst.Sub(t.reqLast).Nanoseconds() / 1000
+		t.Think.Observe(think)
+		t.thinkDelta.Observe(think)
+	}
+	transfer := t.respLast.Sub(t.respFirst).Nanoseconds() / 1000
+	t.Transfer.Observe(transfer)
+
+	t.Turns++
+	t.ReqBytes += t.reqBytes
+	t.RespBytes += t.respBytes
+
+	log.Infof("[%v] ID[%d] TURN#%d req:%s, resp:%s, think:%s, transfer:%s",
+		s.key, s.id, t.Turns, byteSize(t.reqBytes), byteSize(t.respBytes), stat.Microseconds(think), stat.Microseconds(transfer))
+
+	t.phase = turnIdle
+	t.reqBytes, t.respBytes = 0, 0
+}
+
+// TurnStat summarizes the turns of the stream.
+func (s *stream) TurnStat() string {
+	t := &s.turns
+	if t.Turns == 0 {
+		return ""
+	}
+	return fmt.Sprintf(" TURNS[%d req:%s/resp:%s, think:%s, transfer:%s]",
+		t.Turns, byteSize(t.ReqBytes/t.Turns), byteSize(t.RespBytes/t.Turns), t.Think.String(), t.Transfer.String())
+}